@@ -0,0 +1,169 @@
+package btree
+
+import (
+	"fmt"
+	"sort"
+)
+
+// BatchError is the error InsertBatch returns when some of the indexes of
+// a batch could not be inserted, such as those with keys that were
+// already in the tree. The rest of the batch is inserted all the same.
+type BatchError struct {
+	Errors map[uint64]error // The error of every key that was not inserted
+}
+
+// Error reports how many keys were not inserted and why the first of them
+// was not.
+func (e *BatchError) Error() string {
+	if len(e.Errors) == 0 {
+		return "some keys of the batch were not inserted"
+	}
+
+	keys := make([]uint64, 0, len(e.Errors))
+	for key := range e.Errors {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return fmt.Sprintf("%v keys of the batch were not inserted, the key %v: %v", len(keys), keys[0], e.Errors[keys[0]])
+}
+
+// insertBatch inserts the indexes in key order. Every descent from the
+// root inserts the run of indexes that belong in the leaf it ends in, see
+// insertRunLatched. It returns how many indexes were inserted and a
+// *BatchError if some were not. Any other error stops the batch.
+func insertBatch(t BTree, indexes []Index) (inserted int, err error) {
+	failed := make(map[uint64]error)
+	run := make([]*Entry, 0, len(indexes))
+	for i := range indexes {
+		entry, err := storedEntry(t, indexes[i].entry())
+		if err != nil {
+			failed[indexes[i].Key] = err
+			continue
+		}
+		run = append(run, entry)
+	}
+
+	//Of the same key given twice the first one is inserted
+	sort.SliceStable(run, func(i, j int) bool {
+		return t.Compare(run[i].Key, run[j].Key) < 0
+	})
+
+	inserted = len(run)
+	fail := func(entry *Entry, err error) {
+		index, _ := entry.index()
+		failed[index.Key] = err
+		inserted--
+	}
+	for len(run) > 0 {
+		n, unlatch, err := readRootLatched(t, true)
+		if err != nil {
+			return inserted - len(run), err
+		}
+		done, err := n.insertRunLatched(run, fail, unlatch)
+		run = run[done:]
+		if err != nil {
+			return inserted - len(run), err
+		}
+	}
+
+	if len(failed) > 0 {
+		return inserted, &BatchError{Errors: failed}
+	}
+	return inserted, nil
+}
+
+// insertRunLatched is insertLatched for a run of entries in key order. It
+// descends to the leaf the first entry belongs in and also inserts the
+// entries after it that belong in the same leaf for as long as the leaf
+// has room, so the leaf is only written once for all of them. Entries
+// whose key is already in the tree are handed to fail. It returns how
+// many entries of the run it is done with.
+//
+// How many entries the nodes on the way down have to count is only known
+// once the leaf is filled, so unlike insertLatched it holds the latches
+// of the whole path until the counts are raised on the way back up.
+func (n *Node) insertRunLatched(run []*Entry, fail func(entry *Entry, err error), unlatch func()) (done int, err error) {
+	if n.nodeIsFull() {
+		next, err := n.splitIntoTwoSubnodes()
+		if err != nil {
+			unlatch()
+			return 0, err
+		}
+		n = next
+	}
+	done, _, err = n.insertRunNonFull(run, nil, fail)
+	unlatch()
+	return done, err
+}
+
+// insertRunNonFull is insertNonFull for a run of entries. Only entries
+// with keys before hi belong in the subtree of this node, a nil hi leaves
+// the subtree open to the right. It also returns how many entries were
+// added to the subtree.
+func (n *Node) insertRunNonFull(run []*Entry, hi []byte, fail func(entry *Entry, err error)) (done int, added int, err error) {
+	x, found := n.search(run[0].Key)
+	if found {
+		fail(run[0], fmt.Errorf("the key %x was already in the b-tree", run[0].Key))
+		return 1, 0, nil
+	}
+
+	if n.Pointers[x] == 0 { //Insert as much of the run into this node as fits
+		for ; done < len(run) && !n.nodeIsFull(); done++ {
+			entry := run[done]
+			if hi != nil && n.tree.Compare(entry.Key, hi) >= 0 {
+				break
+			}
+
+			x, found = n.search(entry.Key)
+			if found {
+				fail(entry, fmt.Errorf("the key %x was already in the b-tree", entry.Key))
+			} else {
+				n.insertThisNodeLeft(entry, x)
+				added++
+			}
+		}
+		return done, added, n.Write()
+	}
+
+	child, childUnlatch, err := readLatched(n.tree, n.Pointers[x], true)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer childUnlatch()
+
+	//The separator after the child bounds its subtree
+	bound := hi
+	if x < n.size() {
+		bound = n.Data[x].Key
+	}
+	if child.nodeIsFull() {
+		err = n.splitChild(x, child)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		//The median of the child now sits at x, decide which half to continue in
+		c := n.tree.Compare(run[0].Key, n.Data[x].Key)
+		if c == 0 {
+			fail(run[0], fmt.Errorf("the key %x was already in the b-tree", run[0].Key))
+			return 1, 0, nil
+		} else if c < 0 {
+			bound = n.Data[x].Key
+		} else {
+			right, rightUnlatch, err := readLatched(n.tree, n.Pointers[x+1], true)
+			if err != nil {
+				return 0, 0, err
+			}
+			defer rightUnlatch()
+			child = right
+			x++
+		}
+	}
+
+	done, added, err = child.insertRunNonFull(run, bound, fail)
+	if err != nil || added == 0 {
+		return done, added, err
+	}
+	n.Counts[x] += uint64(added)
+	return done, added, n.Write()
+}
@@ -0,0 +1,125 @@
+package btree
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// keyCounter is implemented by the trees that keep count of their keys.
+type keyCounter interface {
+	KeyCount() uint64
+}
+
+func TestInsertBatch(t *testing.T) {
+	forEachBackend(t, "test-insert-batch.bin", func(t *testing.T, tree BTree) {
+		keys := randomKeys(3000)
+		insertKeys(t, tree, keys[:500])
+
+		//The batch repeats some keys of the tree and, after them, some of its
+		//own
+		batch := make([]Index, 0, 2600)
+		for _, key := range keys[500:] {
+			batch = append(batch, Index{Key: key, Pointer: int64(key) * 2})
+		}
+		rand.Shuffle(len(batch), func(i, j int) { batch[i], batch[j] = batch[j], batch[i] })
+		expected := make(map[uint64]bool)
+		for _, key := range keys[:50] {
+			batch = append(batch, Index{Key: key, Pointer: 1})
+			expected[key] = true
+		}
+		for _, key := range keys[2950:] {
+			batch = append(batch, Index{Key: key, Pointer: 1})
+			expected[key] = true
+		}
+
+		err := tree.InsertBatch(batch)
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) {
+			t.Errorf("the batch returned %v, expected a *BatchError", err)
+			return
+		} else if len(batchErr.Errors) != len(expected) {
+			t.Errorf("the batch failed for %v keys, expected %v", len(batchErr.Errors), len(expected))
+		}
+		for key := range batchErr.Errors {
+			if !expected[key] {
+				t.Errorf("the batch failed for the key %v: %v", key, batchErr.Errors[key])
+			}
+		}
+
+		height, err := checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		} else if dt, ok := tree.(*BTreeOnDisk); ok && height != dt.Height() {
+			t.Errorf("the tree has a height of %v, the header records %v", height, dt.Height())
+		}
+		if kc, ok := tree.(keyCounter); ok && kc.KeyCount() != uint64(len(keys)) {
+			t.Errorf("the tree has a key count of %v, expected %v", kc.KeyCount(), len(keys))
+		}
+
+		//A repeated key keeps the pointer it was first given
+		for _, key := range keys {
+			index, err := tree.QueryIndex(key)
+			if err != nil {
+				t.Error(err)
+			} else if index.Pointer != int64(key)*2 {
+				t.Errorf("the key %v has a pointer of %v, expected %v", key, index.Pointer, int64(key)*2)
+			}
+		}
+		indexes, err := tree.Range(0, maxInt64, nil)
+		if err != nil {
+			t.Error(err)
+		} else if len(indexes) != len(keys) {
+			t.Errorf("the tree holds %v keys, expected %v", len(indexes), len(keys))
+		}
+
+		err = tree.InsertBatch(nil)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestInsertBatchSequential(t *testing.T) {
+	forEachBackend(t, "test-insert-batch-seq.bin", func(t *testing.T, tree BTree) {
+		//Batches of keys that all go after the keys already in the tree
+		for b := 0; b < 20; b++ {
+			batch := make([]Index, 100)
+			for i := range batch {
+				key := uint64(b*100 + i)
+				batch[i] = Index{Key: key, Pointer: int64(key)}
+			}
+			err := tree.InsertBatch(batch)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		_, err := checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+		indexes, err := tree.Range(0, maxInt64, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		} else if len(indexes) != 2000 {
+			t.Errorf("the tree holds %v keys, expected 2000", len(indexes))
+		}
+		for i, index := range indexes {
+			if index.Key != uint64(i) {
+				t.Errorf("the range returned the key %v at position %v", index.Key, i)
+				return
+			}
+		}
+	})
+}
+
+func TestBatchErrorWithoutErrors(t *testing.T) {
+	for _, err := range []*BatchError{{}, {Errors: map[uint64]error{}}} {
+		if err.Error() == "" {
+			t.Error("a batch error without errors has no message")
+		}
+	}
+}
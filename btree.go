@@ -1,12 +1,382 @@
 package btree
 
+import (
+	"bytes"
+	"fmt"
+)
+
 // BTree is an interface into a b-tree collection.
 // There are two types of b-trees available in this library. The BTreeOnDisk and
 // the BTreeInMemory. These are accessible by this interface.
+//
+// Keys are slices of bytes, see Entry. The methods that take and return
+// an Index are a convenience for trees with uint64 keys only.
 type BTree interface {
+	InsertEntry(entry *Entry) (err error)
+	QueryEntry(key []byte) (entry *Entry, err error)
+	RangeEntries(lo []byte, hi []byte, opts *RangeOptions) (entries []Entry, err error)
+	RangeEntriesFunc(lo []byte, hi []byte, opts *RangeOptions, fn func(entry *Entry) bool) (err error)
+	RemoveEntry(key []byte) (err error)
+	Put(key []byte, value []byte) (err error)
+	Get(key []byte) (value []byte, err error)
 	InsertIndex(index *Index) (err error)
+	InsertBatch(indexes []Index) (err error)
+	Update(key uint64, pointer int64) (err error)
+	Upsert(index *Index) (err error)
+	CompareAndSwap(key uint64, old int64, new int64) (swapped bool, err error)
 	QueryIndex(key uint64) (index *Index, err error)
+	Range(lo uint64, hi uint64, opts *RangeOptions) (indexes []Index, err error)
+	RangeFunc(lo uint64, hi uint64, opts *RangeOptions, fn func(index *Index) bool) (err error)
+	RemoveIndex(key uint64) (err error)
+	Rank(key uint64) (rank uint64, err error)
+	Select(i uint64) (index *Index, err error)
+	CountRange(lo uint64, hi uint64) (count uint64, err error)
 	WriteNode(n *Node) error
 	NewNode() (n *Node, err error)
 	ReadNode(address int64) (n *Node, err error)
+	Root() (n *Node, err error)
+	RemoveNode(address int64) (err error)
+	PageSize() int
+	MaxKeySize() int
+	InlineValueSize() int
+	Compare(a []byte, b []byte) int
+}
+
+// Options are the settings a new b-tree is created with. A nil *Options
+// or a field left at its zero value uses the default.
+type Options struct {
+	// PageSize is the number of bytes in a node page. Larger pages hold
+	// more keys per node and make for shallower trees. It has to be
+	// between MinPageSize and MaxPageSize and defaults to DefaultPageSize.
+	PageSize int
+
+	// CacheSize is the number of pages a BTreeOnDisk keeps in memory. It
+	// defaults to DefaultCacheSize and is not used by a BTreeInMemory.
+	CacheSize int
+
+	// NoSync skips syncing a BTreeOnDisk to disk after every operation.
+	// The tree still recovers if the process is killed but the latest
+	// operations can be lost, or the tree left corrupt, if the machine
+	// stops.
+	NoSync bool
+
+	// CopyOnWrite creates a BTreeOnDisk that never changes a page of the
+	// tree in place. Changed nodes are written to new pages and the root
+	// in the header is switched over to them last, which keeps the tree
+	// safe from crashes without a write-ahead log. Snapshots of it do not
+	// need the pages they read to be saved before they change.
+	// The mode is recorded in the file and kept when it is opened again.
+	CopyOnWrite bool
+
+	// MaxKeySize is the length in bytes of the longest key the tree
+	// accepts. Nodes always leave room for keys of this length, so a
+	// larger limit means fewer keys per node. It defaults to
+	// DefaultMaxKeySize, the length of a uint64 key, and is recorded in
+	// the file like the page size.
+	MaxKeySize int
+
+	// InlineValueSize is the length in bytes of the longest value that
+	// is stored in a node next to its key, see Put. Longer values are
+	// stored in overflow pages. Nodes always leave room for values of
+	// this length as they do for keys, and at least for the 12 bytes
+	// that say where a longer value is. It defaults to zero, which makes
+	// a tree of keys and pointers only, and is recorded in the file like
+	// the page size.
+	InlineValueSize int
+
+	// Compare orders the keys of the tree. It returns a negative number
+	// if a comes before b, zero if they are the same key and a positive
+	// number otherwise. It defaults to bytes.Compare. It is not recorded
+	// in the file, a BTreeOnDisk has to be opened with the Compare it was
+	// created with.
+	Compare func(a []byte, b []byte) int
+}
+
+// DefaultMaxKeySize is the longest key a tree accepts when it is created
+// without choosing a limit.
+const DefaultMaxKeySize = uint64KeySize
+
+// minNodeOrder is the fewest subnode pointers a node can have. A full
+// node needs at least three entries to be split around its median.
+const minNodeOrder = 4
+
+// pageSize returns the page size chosen by the options or the default.
+func (o *Options) pageSize() (int, error) {
+	if o == nil || o.PageSize == 0 {
+		return DefaultPageSize, nil
+	} else if o.PageSize < MinPageSize || o.PageSize > MaxPageSize {
+		return 0, fmt.Errorf("the page size of %v is not between %v and %v", o.PageSize, MinPageSize, MaxPageSize)
+	}
+	return o.PageSize, nil
+}
+
+// entrySize returns the key size limit and inline value size chosen by
+// the options or the defaults. Nodes of the given page size have to hold
+// enough entries of those sizes to be split.
+func (o *Options) entrySize(pageSize int) (maxKeySize int, inlineValueSize int, err error) {
+	maxKeySize = DefaultMaxKeySize
+	if o != nil && o.MaxKeySize != 0 {
+		maxKeySize = o.MaxKeySize
+	}
+	if o != nil {
+		inlineValueSize = o.InlineValueSize
+	}
+	return maxKeySize, inlineValueSize, checkEntrySize(pageSize, maxKeySize, inlineValueSize)
+}
+
+// checkEntrySize returns an error if nodes of the given page size do not
+// have room for enough keys of up to maxKeySize bytes with values of up
+// to inlineValueSize bytes.
+func checkEntrySize(pageSize int, maxKeySize int, inlineValueSize int) error {
+	if maxKeySize < 1 {
+		return fmt.Errorf("the maximum key size of %v is not positive", maxKeySize)
+	} else if inlineValueSize < 0 {
+		return fmt.Errorf("the inline value size of %v is negative", inlineValueSize)
+	} else if nodeOrder(pageSize, maxKeySize, inlineValueSize) < minNodeOrder {
+		return fmt.Errorf("a page size of %v does not leave room for %v keys of %v bytes with values of %v bytes", pageSize, minNodeOrder-1, maxKeySize, inlineValueSize)
+	}
+	return nil
+}
+
+// compare returns the key order chosen by the options or the default.
+func (o *Options) compare() func(a []byte, b []byte) int {
+	if o == nil || o.Compare == nil {
+		return bytes.Compare
+	}
+	return o.Compare
+}
+
+// cacheSize returns the cache size chosen by the options or the default.
+func (o *Options) cacheSize() (int, error) {
+	if o == nil || o.CacheSize == 0 {
+		return DefaultCacheSize, nil
+	} else if o.CacheSize < 0 {
+		return 0, fmt.Errorf("the cache size of %v is negative", o.CacheSize)
+	}
+	return o.CacheSize, nil
+}
+
+// The operations below only go through the BTree interface so that every
+// implementation shares the same node algorithms.
+
+func queryEntry(t BTree, key []byte) (entry *Entry, err error) {
+	entry, err = lookupEntry(t, key)
+	if err != nil {
+		return nil, err
+	}
+	return entry, loadValue(t, entry)
+}
+
+// lookupEntry is queryEntry that leaves a value kept in overflow pages
+// unread, for the lookups that only need the key and pointer.
+func lookupEntry(t BTree, key []byte) (entry *Entry, err error) {
+	n, unlatch, err := readRootLatched(t, false)
+	if err != nil {
+		return nil, err
+	} else if n.IsEmpty() {
+		unlatch()
+		return nil, fmt.Errorf("the b-tree is empty")
+	}
+
+	return n.queryLatched(key, unlatch)
+}
+
+// insertEntry writes a value that is too long for a node to overflow
+// pages before the entry is inserted. The pages are handed back if the
+// insert fails.
+func insertEntry(t BTree, entry *Entry) (err error) {
+	_, err = upsertEntry(t, entry, nil)
+	return err
+}
+
+// upsertEntry is insertEntry that hands the entry with the same key to
+// update if the key is already in the tree, see Node.upsertLatched. It
+// returns true if the entry was inserted.
+func upsertEntry(t BTree, entry *Entry, update func(existing *Entry)) (inserted bool, err error) {
+	entry, err = storedEntry(t, entry)
+	if err != nil {
+		return false, err
+	}
+	err = writeOverflow(t, entry)
+	if err != nil {
+		return false, err
+	}
+
+	inserted = true
+	existing := update
+	if update != nil {
+		existing = func(e *Entry) {
+			inserted = false
+			update(e)
+		}
+	}
+	n, unlatch, err := readRootLatched(t, true)
+	if err == nil {
+		err = n.upsertLatched(entry, existing, unlatch)
+	}
+	if err != nil || !inserted {
+		return false, firstError(err, freeOverflow(t, entry))
+	}
+	return true, nil
+}
+
+// updateEntry hands the entry with key to update, which changes it in
+// place and returns true if it did. Only the node that holds the entry is
+// written. found is false if the key is not in the tree.
+func updateEntry(t BTree, key []byte, update func(entry *Entry) (changed bool)) (found bool, err error) {
+	n, unlatch, err := readRootLatched(t, true)
+	if err != nil {
+		return false, err
+	}
+	return n.updateLatched(key, update, unlatch)
+}
+
+// removeEntry hands the overflow pages of the value of the entry back
+// once it is removed.
+func removeEntry(t BTree, key []byte) (err error) {
+	n, err := t.Root()
+	if err != nil {
+		return err
+	} else if n.IsEmpty() {
+		return fmt.Errorf("the b-tree is empty")
+	}
+
+	var removed *Entry
+	if t.InlineValueSize() > 0 {
+		removed, err = n.query(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = n.remove(key)
+	if err != nil || removed == nil {
+		return err
+	}
+	return freeOverflow(t, removed)
+}
+
+// storedEntry returns the copy of entry that is inserted into the tree,
+// so the caller is free to reuse its key and value afterwards.
+func storedEntry(t BTree, entry *Entry) (stored *Entry, err error) {
+	if len(entry.Key) > t.MaxKeySize() {
+		return nil, fmt.Errorf("the key of %v bytes is longer than the maximum of %v", len(entry.Key), t.MaxKeySize())
+	} else if len(entry.Value) > 0 && t.InlineValueSize() == 0 {
+		return nil, fmt.Errorf("the b-tree was created without room for values")
+	} else if uint64(len(entry.Value)) > maxValueSize {
+		return nil, fmt.Errorf("the value of %v bytes is longer than the maximum of %v", len(entry.Value), maxValueSize)
+	}
+
+	stored = NewEntry(append([]byte{}, entry.Key...), entry.Pointer)
+	if len(entry.Value) > 0 {
+		stored.Value = append([]byte{}, entry.Value...)
+	}
+	return stored, nil
+}
+
+// entryValue returns the value of an entry that was looked up, so that Get
+// can be written as entryValue(QueryEntry(key)).
+func entryValue(entry *Entry, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value, nil
+}
+
+// queryIndex, insertIndex and removeIndex are the operations above for
+// uint64 keys.
+
+func queryIndex(t BTree, key uint64) (index *Index, err error) {
+	entry, err := lookupEntry(t, Uint64Key(key))
+	if err != nil {
+		return nil, err
+	}
+	return entry.index()
+}
+
+func insertIndex(t BTree, index *Index) (err error) {
+	return insertEntry(t, index.entry())
+}
+
+func removeIndex(t BTree, key uint64) (err error) {
+	return removeEntry(t, Uint64Key(key))
+}
+
+// updateIndex and compareAndSwap change the pointer of a key that is in
+// the tree, upsertIndex also inserts the index if its key is not. The
+// pointer is changed in the node that holds the key and nothing else is
+// written.
+
+func updateIndex(t BTree, key uint64, pointer int64) (err error) {
+	found, err := updateEntry(t, Uint64Key(key), setPointer(pointer))
+	if err == nil && !found {
+		return fmt.Errorf("the key %v was not found in the b-tree", key)
+	}
+	return err
+}
+
+func compareAndSwap(t BTree, key uint64, old int64, new int64) (swapped bool, err error) {
+	found, err := updateEntry(t, Uint64Key(key), func(entry *Entry) bool {
+		swapped = entry.Pointer == old
+		if swapped {
+			entry.Pointer = new
+		}
+		return swapped
+	})
+	if err == nil && !found {
+		return false, fmt.Errorf("the key %v was not found in the b-tree", key)
+	}
+	return swapped, err
+}
+
+// upsertIndex returns true if the index was inserted. A key that is
+// missing when it is looked up can still be inserted by someone else
+// before the index is, in which case its pointer is changed after all.
+func upsertIndex(t BTree, index *Index) (inserted bool, err error) {
+	update := setPointer(index.Pointer)
+	found, err := updateEntry(t, Uint64Key(index.Key), update)
+	if found || err != nil {
+		return false, err
+	}
+	return upsertEntry(t, index.entry(), func(existing *Entry) {
+		update(existing)
+	})
+}
+
+// setPointer returns the update that sets the pointer of an entry.
+func setPointer(pointer int64) func(entry *Entry) (changed bool) {
+	return func(entry *Entry) bool {
+		entry.Pointer = pointer
+		return true
+	}
+}
+
+// measureHeight counts the levels of the tree by following the leftmost
+// pointers from the root down to a leaf.
+func measureHeight(t BTree) (height int, err error) {
+	n, err := t.Root()
+	if err != nil {
+		return 0, err
+	}
+
+	height = 1
+	for !n.isLeaf() {
+		n, err = n.readLeftPtr(0)
+		if err != nil {
+			return 0, err
+		}
+		height++
+	}
+	return height, nil
+}
+
+// firstError returns the first of the errors that is not nil. It is used
+// where cleaning up after an error can itself fail.
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
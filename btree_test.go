@@ -0,0 +1,466 @@
+package btree
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+// backends are the BTree implementations that every tree test is run
+// against. Each one creates a new, empty tree for the named test.
+var backends = []struct {
+	name   string
+	create func(name string, opts *Options) (BTree, error)
+}{
+	{"OnDisk", func(name string, opts *Options) (BTree, error) {
+		//The tree tests do not need the write-ahead log to survive the
+		//machine stopping so they skip syncing it
+		o := Options{NoSync: true}
+		if opts != nil {
+			o = *opts
+			o.NoSync = true
+		}
+		return CreateBTreeOnDiskWithOptions(path.Join(os.TempDir(), name), true, &o)
+	}},
+	{"InMemory", func(name string, opts *Options) (BTree, error) {
+		return NewBTreeInMemWithOptions(0, opts)
+	}},
+}
+
+// forEachBackend runs test as a subtest with a new tree from every backend.
+func forEachBackend(t *testing.T, name string, test func(t *testing.T, tree BTree)) {
+	forEachBackendWithOptions(t, name, nil, test)
+}
+
+// forEachBackendWithOptions is forEachBackend for trees created with the
+// given options.
+func forEachBackendWithOptions(t *testing.T, name string, opts *Options, test func(t *testing.T, tree BTree)) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			tree, err := b.create(name, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dt, ok := tree.(*BTreeOnDisk); ok {
+				defer dt.Close()
+			}
+			test(t, tree)
+		})
+	}
+}
+
+// entry returns the entry a uint64 key is stored as in a node.
+func entry(key uint64, pointer int64) Entry {
+	return *NewIndex(key, pointer).entry()
+}
+
+// keyOf returns the uint64 key of an entry in a node, or zero for an
+// unused entry.
+func keyOf(e Entry) uint64 {
+	index, err := e.index()
+	if err != nil {
+		return 0
+	}
+	return index.Key
+}
+
+func availableAddresses(tree BTree) []int64 {
+	switch tt := tree.(type) {
+	case *BTreeOnDisk:
+		return tt.AvailableAddresses
+	case *BTreeInMemory:
+		return tt.AvailableAddresses
+	}
+	return nil
+}
+
+func insertKeys(t *testing.T, tree BTree, keys []uint64) {
+	for _, key := range keys {
+		err := tree.InsertIndex(NewIndex(key, int64(key)*2))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func randomKeys(count int) []uint64 {
+	keys := make([]uint64, 0, count)
+	for _, k := range rand.Perm(count * 4) {
+		if len(keys) == count {
+			break
+		}
+		keys = append(keys, uint64(k)*3+1)
+	}
+	return keys
+}
+
+func sortedKeys(keys []uint64) []uint64 {
+	sorted := append([]uint64(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+func TestQueryIndex(t *testing.T) {
+	forEachBackend(t, "test-query-index.bin", func(t *testing.T, tree BTree) {
+		//Build the tree from the bottom up so the pointers are known
+		n3, err := tree.NewNode()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		n3.Pointers[0] = 0
+		n3.Data[0] = entry(63, 24)
+		n3.Pointers[1] = 0
+		n3.Data[1] = entry(64, 25)
+		n3.Pointers[2] = 0
+		n3.Data[2] = entry(70, 26) //The target value
+		n3.count = 3
+		n3.Pointers[3] = 0
+		err = n3.Write()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		n2, err := tree.NewNode()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		n2.Pointers[0] = 0
+		n2.Data[0] = entry(35, 24)
+		n2.Pointers[1] = 0
+		n2.Data[1] = entry(51, 25)
+		n2.Pointers[2] = 0
+		n2.Data[2] = entry(62, 26)
+		n2.count = 3
+		n2.Pointers[3] = n3.Address
+		err = n2.Write()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		n1, err := tree.Root()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		n1.Pointers[0] = 0
+		n1.Data[0] = entry(25, 21)
+		n1.Pointers[1] = 0
+		n1.Data[1] = entry(34, 22)
+		n1.Pointers[2] = n2.Address
+		n1.Data[2] = entry(78, 23)
+		n1.count = 3
+		n1.Pointers[3] = 0
+		err = n1.Write()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		index, err := tree.QueryIndex(70)
+		if err != nil {
+			t.Error(err)
+		} else if index.Key != 70 {
+			t.Errorf("the query function returned the wrong key of %v. Expected 70", index.Key)
+		} else if index.Pointer != 26 {
+			t.Errorf("the query function returned the wrong pointer of %v. Expected 26", index.Pointer)
+		}
+	})
+}
+
+func TestInsertTreeIndex(t *testing.T) {
+	forEachBackend(t, "test-insert-index.bin", func(t *testing.T, tree BTree) {
+		for i := 0; i < 100; i++ {
+			rand.Seed(time.Now().UTC().UnixNano())
+			key := uint64(rand.Uint32())<<32 + uint64(rand.Uint32())
+
+			index := Index{Key: key, Pointer: 45}
+			err := tree.InsertIndex(&index)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestRemoveTreeIndex(t *testing.T) {
+	forEachBackend(t, "test-remove-index.bin", func(t *testing.T, tree BTree) {
+		var err error
+		keys := rand.Perm(500)
+		for _, key := range keys {
+			err = tree.InsertIndex(NewIndex(uint64(key)+1, int64(key)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		//Remove every other key and make sure only those are gone
+		for _, key := range keys[:250] {
+			err = tree.RemoveIndex(uint64(key) + 1)
+			if err != nil {
+				t.Errorf("unable to remove key %v: %v", key+1, err)
+				return
+			}
+		}
+		for _, key := range keys[:250] {
+			_, err = tree.QueryIndex(uint64(key) + 1)
+			if err == nil {
+				t.Errorf("the removed key %v was still found in the b-tree", key+1)
+			}
+		}
+		for _, key := range keys[250:] {
+			index, err := tree.QueryIndex(uint64(key) + 1)
+			if err != nil {
+				t.Errorf("the key %v was lost from the b-tree: %v", key+1, err)
+			} else if index.Pointer != int64(key) {
+				t.Errorf("the key %v has a pointer of %v, expected %v", key+1, index.Pointer, key)
+			}
+		}
+
+		_, err = checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = tree.RemoveIndex(uint64(keys[0]) + 1)
+		if err == nil {
+			t.Error("removing a key that was already removed did not return an error")
+		}
+
+		for _, key := range keys[250:] {
+			err = tree.RemoveIndex(uint64(key) + 1)
+			if err != nil {
+				t.Errorf("unable to remove key %v: %v", key+1, err)
+				return
+			}
+		}
+
+		root, err := tree.Root()
+		if err != nil {
+			t.Error(err)
+		} else if !root.IsEmpty() {
+			t.Error("the root of the b-tree is not empty after removing every key")
+		}
+
+		if len(availableAddresses(tree)) == 0 {
+			t.Error("no node addresses were made available after removing every key")
+		}
+	})
+}
+
+func TestZeroKey(t *testing.T) {
+	forEachBackend(t, "test-zero-key.bin", func(t *testing.T, tree BTree) {
+		//Every entry is all zeros apart from its key, key 0 is all zeros
+		keys := rand.Perm(300)
+		for _, key := range keys {
+			err := tree.InsertIndex(NewIndex(uint64(key), 0))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		err := tree.InsertIndex(NewIndex(0, 0))
+		if err == nil {
+			t.Error("the key 0 was inserted twice")
+		}
+		_, err = checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+
+		index, err := tree.QueryIndex(0)
+		if err != nil {
+			t.Error(err)
+		} else if index.Key != 0 || index.Pointer != 0 {
+			t.Errorf("the key 0 returned %v", index)
+		}
+		indexes, err := tree.Range(0, 299, nil)
+		if err != nil {
+			t.Error(err)
+		} else if len(indexes) != 300 || indexes[0].Key != 0 {
+			t.Errorf("the range from 0 returned %v keys, expected 300 starting at 0", len(indexes))
+		}
+
+		for _, key := range keys {
+			err = tree.RemoveIndex(uint64(key))
+			if err != nil {
+				t.Errorf("unable to remove key %v: %v", key, err)
+				return
+			}
+		}
+		root, err := tree.Root()
+		if err != nil {
+			t.Error(err)
+		} else if !root.IsEmpty() {
+			t.Error("the root of the b-tree is not empty after removing every key")
+		}
+	})
+}
+
+func TestInsertTreeSequentialHeight(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the insert of one million keys in short mode")
+	}
+
+	forEachBackend(t, "test-insert-sequential.bin", func(t *testing.T, tree BTree) {
+		const count = 1000000
+		for key := uint64(1); key <= count; key++ {
+			err := tree.InsertIndex(NewIndex(key, int64(key)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		height, err := checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		root, err := tree.Root()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		//Every node other than the root holds at least minKeys entries so the
+		//tree has a minimum degree of minKeys+1
+		minDegree := float64(root.minKeys() + 1)
+		maxHeight := 1 + int(math.Log(float64(count+1)/2)/math.Log(minDegree))
+		if height > maxHeight {
+			t.Errorf("the b-tree has a height of %v after %v sequential inserts, expected at most %v", height, count, maxHeight)
+		}
+
+		for _, key := range []uint64{1, 2, count / 2, count - 1, count} {
+			index, err := tree.QueryIndex(key)
+			if err != nil {
+				t.Error(err)
+			} else if index.Pointer != int64(key) {
+				t.Errorf("the key %v has a pointer of %v, expected %v", key, index.Pointer, key)
+			}
+		}
+	})
+}
+
+func TestPageSize(t *testing.T) {
+	for _, pageSize := range []int{MinPageSize, 4096, 16384} {
+		t.Run(fmt.Sprint(pageSize), func(t *testing.T) {
+			opts := &Options{PageSize: pageSize}
+			forEachBackendWithOptions(t, "test-page-size.bin", opts, func(t *testing.T, tree BTree) {
+				if tree.PageSize() != pageSize {
+					t.Errorf("the tree has a page size of %v, expected %v", tree.PageSize(), pageSize)
+				}
+
+				keys := randomKeys(5000)
+				insertKeys(t, tree, keys)
+
+				root, err := tree.Root()
+				if err != nil {
+					t.Error(err)
+					return
+				} else if len(root.Data) != nodeOrder(pageSize, DefaultMaxKeySize, 0)-1 {
+					t.Errorf("the nodes hold %v keys, expected %v", len(root.Data), nodeOrder(pageSize, DefaultMaxKeySize, 0)-1)
+				}
+
+				for _, key := range keys[:2500] {
+					err = tree.RemoveIndex(key)
+					if err != nil {
+						t.Errorf("unable to remove key %v: %v", key, err)
+						return
+					}
+				}
+
+				_, err = checkBalanced(tree)
+				if err != nil {
+					t.Error(err)
+				}
+
+				indexes, err := tree.Range(0, maxInt64, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				expected := sortedKeys(keys[2500:])
+				if len(indexes) != len(expected) {
+					t.Errorf("the tree holds %v keys, expected %v", len(indexes), len(expected))
+					return
+				}
+				for i, index := range indexes {
+					if index.Key != expected[i] || index.Pointer != int64(expected[i])*2 {
+						t.Errorf("the index at %v is %v, expected the key %v", i, index, expected[i])
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestPageSizeInvalid(t *testing.T) {
+	for _, b := range backends {
+		for _, pageSize := range []int{-1, 1, MinPageSize - 1, MaxPageSize + 1} {
+			_, err := b.create("test-page-size-invalid.bin", &Options{PageSize: pageSize})
+			if err == nil {
+				t.Errorf("creating a %v tree with a page size of %v did not return an error", b.name, pageSize)
+			}
+		}
+	}
+}
+
+// checkBalanced walks the whole tree and returns its height. It returns
+// an error if the leaves are not all at the same depth, if a node other
+// than the root holds fewer than minKeys entries or if a node counts a
+// different number of entries under a pointer than the subnode holds.
+func checkBalanced(tree BTree) (height int, err error) {
+	root, err := tree.Root()
+	if err != nil {
+		return 0, err
+	}
+	height, _, err = checkSubtree(tree, root.Address, true)
+	return height, err
+}
+
+func checkSubtree(tree BTree, addr int64, isRoot bool) (height int, entries uint64, err error) {
+	n, err := tree.ReadNode(addr)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	size := n.size()
+	entries = uint64(size)
+	if !isRoot && size < n.minKeys() {
+		return 0, 0, fmt.Errorf("the node at %v only holds %v entries", addr, size)
+	} else if n.isLeaf() {
+		for i, c := range n.Counts {
+			if c != 0 {
+				return 0, 0, fmt.Errorf("the leaf at %v counts %v entries under pointer %v", addr, c, i)
+			}
+		}
+		return 1, entries, nil
+	}
+
+	for i := 0; i <= size; i++ {
+		h, e, err := checkSubtree(tree, n.Pointers[i], false)
+		if err != nil {
+			return 0, 0, err
+		} else if i > 0 && h != height {
+			return 0, 0, fmt.Errorf("the subnodes of the node at %v have heights of %v and %v", addr, height, h)
+		} else if e != n.Counts[i] {
+			return 0, 0, fmt.Errorf("the node at %v counts %v entries under pointer %v, the subnode holds %v", addr, n.Counts[i], i, e)
+		}
+		height = h
+		entries += e
+	}
+	return height + 1, entries, nil
+}
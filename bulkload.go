@@ -0,0 +1,312 @@
+package btree
+
+import (
+	"fmt"
+	"iter"
+	"math"
+)
+
+// BulkLoadOptions changes how BulkLoad packs the nodes it writes. The
+// zero value fills every node completely.
+type BulkLoadOptions struct {
+	FillFactor float64 // The share of the entries a node has room for that it is filled with, zero means 1
+}
+
+// BulkLoad fills an empty b-tree with the indexes, which have to be in
+// ascending key order without duplicates. The nodes are built from the
+// leaves up and written as soon as they are complete, in one pass and
+// without searching the tree, which makes loading many keys much faster
+// than inserting them one by one.
+//
+// Every node but the last few on the right edge of the tree is filled to
+// the fill factor of opts. A fill factor below one leaves room in the
+// nodes for keys inserted later, one that would leave them less than half
+// full is raised to the fewest entries a node can hold.
+//
+// The tree is only switched over to the loaded nodes at the end. If the
+// indexes are out of order or the load fails, the tree is left empty and
+// the pages written so far are handed back. Only that switch is logged,
+// the nodes are written to the file without going through the
+// write-ahead log. If the process crashes during a load, the tree is
+// empty when it is opened again and the pages written by the load are
+// neither in the tree nor on the free list. They are lost until the file
+// is rewritten.
+func (t *BTreeOnDisk) BulkLoad(indexes iter.Seq[Index], opts *BulkLoadOptions) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err = t.checkOpen()
+	if err == nil {
+		err = t.checkWritable()
+	}
+	if err != nil {
+		return err
+	} else if t.header.KeyCount > 0 {
+		return fmt.Errorf("the b-tree already holds %v keys, only an empty b-tree can be bulk loaded", t.header.KeyCount)
+	}
+
+	l, err := newBulkLoader(t, opts)
+	if err != nil {
+		return err
+	}
+	if t.cow == nil {
+		//The log must not hold older images of the pages written by the
+		//load, replaying it would write them over the loaded nodes
+		err = t.checkpoint()
+		if err != nil {
+			return err
+		}
+	}
+	for index := range indexes {
+		err = l.load(index)
+		if err != nil {
+			return firstError(err, l.free())
+		}
+	}
+	err = l.finish()
+	if err != nil {
+		return firstError(err, l.free())
+	}
+	return nil
+}
+
+// bulkLoader builds the levels of a tree from entries in key order. Every
+// level holds the entries and subnode pointers that are not in a node
+// yet. A node is only written once enough entries follow it to fill the
+// last node of its level, the entry after the node separates it from the
+// next one and moves up to the level above.
+type bulkLoader struct {
+	t       *BTreeOnDisk
+	fill    int //The number of entries in a node that is written before the end
+	maxKeys int
+	minKeys int
+	levels  []*bulkLevel
+	last    []byte  //The key of the last entry loaded
+	count   uint64  //The number of entries loaded
+	written []int64 //The pages written so far, handed back if the load fails
+}
+
+// bulkLevel is a level of the tree being loaded. The entries of a level
+// above the leaves have a subnode pointer on either side, once the last
+// subnode of the level below is written, and every pointer the number of
+// entries in its subnode.
+type bulkLevel struct {
+	entries  []Entry
+	pointers []int64
+	counts   []uint64
+}
+
+func newBulkLoader(t *BTreeOnDisk, opts *BulkLoadOptions) (l *bulkLoader, err error) {
+	factor := 1.0
+	if opts != nil && opts.FillFactor != 0 {
+		factor = opts.FillFactor
+	}
+	if !(factor > 0 && factor <= 1) {
+		return nil, fmt.Errorf("the fill factor of %v is not between 0 and 1", factor)
+	}
+
+	n, err := NewNode(t.nodes())
+	if err != nil {
+		return nil, err
+	}
+	l = &bulkLoader{
+		t:       t,
+		maxKeys: len(n.Data),
+		minKeys: n.minKeys(),
+		levels:  []*bulkLevel{{}},
+	}
+	l.fill = int(math.Round(factor * float64(l.maxKeys)))
+	if l.fill < l.minKeys {
+		l.fill = l.minKeys
+	}
+	return l, nil
+}
+
+// load adds the next index to the leaves.
+func (l *bulkLoader) load(index Index) error {
+	entry, err := storedEntry(l.t.nodes(), index.entry())
+	if err != nil {
+		return err
+	}
+	if l.count > 0 {
+		if c := l.t.Compare(entry.Key, l.last); c == 0 {
+			return fmt.Errorf("the key %v was loaded twice", index.Key)
+		} else if c < 0 {
+			return fmt.Errorf("the key %v was loaded after a larger key, the keys have to be in ascending order", index.Key)
+		}
+	}
+	l.last = entry.Key
+	l.count++
+	return l.add(0, *entry)
+}
+
+// add appends an entry to a level and writes a node from the start of the
+// level if there are enough entries after it.
+func (l *bulkLoader) add(level int, entry Entry) error {
+	lv := l.levels[level]
+	lv.entries = append(lv.entries, entry)
+	if len(lv.entries) < l.fill+1+l.minKeys {
+		return nil
+	}
+
+	addr, size, err := l.writeNode(level, l.fill)
+	if err != nil {
+		return err
+	}
+	separator := lv.entries[l.fill]
+	l.shift(level, l.fill+1)
+	return l.addSubnode(level+1, addr, size, &separator)
+}
+
+// addSubnode appends the pointer to a node written on the level below to
+// a level, with the number of entries under it, followed by the entry
+// that separates it from the next node if there is one. The level is
+// started if it is the first node of the level below.
+func (l *bulkLoader) addSubnode(level int, addr int64, size uint64, separator *Entry) error {
+	if level == len(l.levels) {
+		l.levels = append(l.levels, &bulkLevel{})
+	}
+	lv := l.levels[level]
+	lv.pointers = append(lv.pointers, addr)
+	lv.counts = append(lv.counts, size)
+	if separator == nil {
+		return nil
+	}
+	return l.add(level, *separator)
+}
+
+// shift drops the first count entries of a level and the subnode
+// pointers to the left of them.
+func (l *bulkLoader) shift(level int, count int) {
+	lv := l.levels[level]
+	lv.entries = append(lv.entries[:0], lv.entries[count:]...)
+	if level > 0 {
+		lv.pointers = append(lv.pointers[:0], lv.pointers[count:]...)
+		lv.counts = append(lv.counts[:0], lv.counts[count:]...)
+	}
+}
+
+// node builds a node from the first size entries of a level.
+func (l *bulkLoader) node(level int, size int) (n *Node, err error) {
+	n, err = NewNode(l.t.nodes())
+	if err != nil {
+		return nil, err
+	}
+	lv := l.levels[level]
+	copy(n.Data, lv.entries[:size])
+	if level > 0 {
+		copy(n.Pointers, lv.pointers[:size+1])
+		copy(n.Counts, lv.counts[:size+1])
+	}
+	n.count = size
+	return n, nil
+}
+
+// writeNode writes a node of the first size entries of a level to a new
+// page. The page can not be reached from the root until the load is
+// done, so it is written where it is also in copy-on-write mode and it
+// is not logged. The cache is free to write it to the file right away,
+// which keeps a long load from piling up pages in the cache. It also
+// returns the number of entries under the node.
+func (l *bulkLoader) writeNode(level int, size int) (addr int64, entries uint64, err error) {
+	n, err := l.node(level, size)
+	if err != nil {
+		return 0, 0, err
+	}
+	n.Address, err = l.t.nextNodeAddress()
+	if err != nil {
+		return 0, 0, err
+	}
+	data, err := n.ToBinary()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = l.t.writePage(n.Address, data)
+	if err != nil {
+		return 0, 0, err
+	}
+	l.t.cache.markLogged()
+	l.written = append(l.written, n.Address)
+	return n.Address, n.subtreeSize(), nil
+}
+
+// finish writes the entries left on every level from the leaves up. They
+// are enough for one node, or two if they do not fit into one. The single
+// node of the top level becomes the root.
+func (l *bulkLoader) finish() error {
+	for level := 0; ; level++ {
+		lv := l.levels[level]
+		if level == len(l.levels)-1 && len(lv.entries) <= l.maxKeys {
+			return l.writeRoot(level)
+		}
+
+		if len(lv.entries) > l.maxKeys {
+			half := (len(lv.entries) - 1) / 2
+			addr, size, err := l.writeNode(level, half)
+			if err != nil {
+				return err
+			}
+			separator := lv.entries[half]
+			l.shift(level, half+1)
+			err = l.addSubnode(level+1, addr, size, &separator)
+			if err != nil {
+				return err
+			}
+		}
+
+		addr, size, err := l.writeNode(level, len(lv.entries))
+		if err != nil {
+			return err
+		}
+		err = l.addSubnode(level+1, addr, size, nil)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeRoot writes the last node of the top level over the empty root and
+// records the loaded keys in the header, as one operation. The nodes
+// written before are not logged, so they are written to the file first.
+// The root and the header are logged and can not reach the file before
+// the nodes they lead to.
+func (l *bulkLoader) writeRoot(level int) error {
+	root, err := l.node(level, len(l.levels[level].entries))
+	if err != nil {
+		return err
+	}
+	root.Address = l.t.header.RootAddress
+
+	if l.t.cow == nil {
+		err = l.t.cache.flushPages()
+		if err == nil && l.t.sync {
+			err = l.t.file.Sync()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return l.t.update(func() error {
+		err := l.t.writeNode(root)
+		if err != nil {
+			return err
+		}
+		l.t.header.KeyCount = l.count
+		l.t.header.Height = uint32(level + 1)
+		return l.t.writeHeader()
+	})
+}
+
+// free hands the pages written by a load that failed back to the tree.
+func (l *bulkLoader) free() error {
+	for _, addr := range l.written {
+		err := l.t.removeNode(addr)
+		if err != nil {
+			return err
+		}
+	}
+	l.written = nil
+	return nil
+}
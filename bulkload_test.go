@@ -0,0 +1,220 @@
+package btree
+
+import (
+	"fmt"
+	"iter"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// evenIndexes returns the indexes of the keys 0, 2, 4 and so on up to
+// count keys in ascending order.
+func evenIndexes(count int) iter.Seq[Index] {
+	return func(yield func(Index) bool) {
+		for i := 0; i < count; i++ {
+			if !yield(Index{Key: uint64(2 * i), Pointer: int64(i)}) {
+				return
+			}
+		}
+	}
+}
+
+// checkLoaded checks that a tree holds the keys of evenIndexes(count) and
+// nothing else, and that it is balanced.
+func checkLoaded(t *testing.T, tree *BTreeOnDisk, count int) {
+	height, err := checkBalanced(tree)
+	if err != nil {
+		t.Error(err)
+	} else if height != tree.Height() {
+		t.Errorf("the tree has a height of %v, the header records %v", height, tree.Height())
+	}
+	if tree.KeyCount() != uint64(count) {
+		t.Errorf("the tree has a key count of %v, expected %v", tree.KeyCount(), count)
+	}
+
+	i := 0
+	err = tree.RangeFunc(0, maxInt64, nil, func(index *Index) bool {
+		if index.Key != uint64(2*i) || index.Pointer != int64(i) {
+			t.Errorf("the range returned %v at position %v, expected %v", *index, i, Index{uint64(2 * i), int64(i)})
+			return false
+		}
+		i++
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	} else if i != count {
+		t.Errorf("the range returned %v keys, expected %v", i, count)
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	for _, cow := range []bool{false, true} {
+		for _, factor := range []float64{0, 0.5, 0.8} {
+			for _, count := range []int{0, 1, 18, 19, 27, 1000, 20000} {
+				t.Run(fmt.Sprintf("cow=%v/fill=%v/%v", cow, factor, count), func(t *testing.T) {
+					testBulkLoad(t, cow, factor, count)
+				})
+			}
+		}
+	}
+}
+
+func testBulkLoad(t *testing.T, cow bool, factor float64, count int) {
+	f := path.Join(os.TempDir(), "test-bulk-load.bin")
+
+	//The counts of 18, 19 and 27 keys sit at the edges of 752 byte nodes
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CopyOnWrite: cow, NoSync: true, PageSize: 752})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = tree.BulkLoad(evenIndexes(count), &BulkLoadOptions{FillFactor: factor})
+	if err != nil {
+		t.Error(err)
+		tree.Close()
+		return
+	}
+	checkLoaded(t, tree, count)
+	if cow {
+		checkFreePages(t, tree)
+	}
+
+	//A fully packed tree has no room left in its leaves
+	if factor == 0 && count == 1000 {
+		root, err := tree.Root()
+		if err != nil {
+			t.Error(err)
+		} else if leaf, err := root.readLeftPtr(0); err != nil {
+			t.Error(err)
+		} else if !leaf.nodeIsFull() {
+			t.Errorf("the first leaf of a packed tree holds %v entries", leaf.size())
+		}
+	}
+
+	//The loaded tree works like any other
+	for i := 0; i < count; i += 3 {
+		err = tree.InsertIndex(NewIndex(uint64(2*i+1), 0))
+		if err != nil {
+			t.Error(err)
+		}
+		err = tree.RemoveIndex(uint64(2*i + 1))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+	checkLoaded(t, tree, count)
+	if cow {
+		checkFreePages(t, tree)
+	}
+}
+
+func TestBulkLoadLogsRootOnly(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-bulk-load-log.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{NoSync: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	err = tree.BulkLoad(evenIndexes(20000), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	checkLoaded(t, tree, 20000)
+
+	//The root and the header make up the only record
+	pages := tree.size / int64(tree.PageSize())
+	if max := int64(3 * tree.PageSize()); tree.wal.size > max {
+		t.Errorf("loading %v pages logged %v bytes, expected no more than %v", pages, tree.wal.size, max)
+	}
+}
+
+func TestBulkLoadInvalid(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-bulk-load-invalid.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{NoSync: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	tests := []struct {
+		name    string
+		indexes []Index
+		message string
+	}{
+		{"unsorted", []Index{{2000, 1}, {1999, 2}}, "ascending order"},
+		{"duplicate", []Index{{2000, 1}, {2000, 2}}, "loaded twice"},
+	}
+	for _, test := range tests {
+		//The error is found after some nodes have been written
+		var indexes []Index
+		for index := range evenIndexes(500) {
+			indexes = append(indexes, Index{Key: index.Key + 10, Pointer: index.Pointer})
+		}
+		indexes = append(indexes, test.indexes...)
+
+		err = tree.BulkLoad(slices.Values(indexes), nil)
+		if err == nil {
+			t.Errorf("%v keys were bulk loaded", test.name)
+		} else if !strings.Contains(err.Error(), test.message) {
+			t.Errorf("loading %v keys returned the error %q", test.name, err)
+		}
+		if tree.KeyCount() != 0 {
+			t.Errorf("the tree has a key count of %v after loading %v keys", tree.KeyCount(), test.name)
+		}
+		root, err := tree.Root()
+		if err != nil {
+			t.Error(err)
+		} else if !root.IsEmpty() {
+			t.Errorf("the root is not empty after loading %v keys", test.name)
+		}
+		if len(tree.AvailableAddresses) == 0 {
+			t.Errorf("the pages written while loading %v keys were not handed back", test.name)
+		}
+	}
+
+	for _, factor := range []float64{-0.5, 1.5} {
+		err = tree.BulkLoad(evenIndexes(10), &BulkLoadOptions{FillFactor: factor})
+		if err == nil {
+			t.Errorf("keys were bulk loaded with a fill factor of %v", factor)
+		}
+	}
+
+	//The pages handed back are used again
+	free := len(tree.AvailableAddresses)
+	err = tree.BulkLoad(evenIndexes(500), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	checkLoaded(t, tree, 500)
+	if len(tree.AvailableAddresses) >= free {
+		t.Errorf("the tree has %v free pages after loading, %v before", len(tree.AvailableAddresses), free)
+	}
+
+	err = tree.BulkLoad(evenIndexes(10), nil)
+	if err == nil {
+		t.Error("keys were bulk loaded into a tree that is not empty")
+	}
+}
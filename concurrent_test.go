@@ -0,0 +1,631 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// The tests in this file share a tree between goroutines. They are meant
+// to be run with the race detector as well, go test -race.
+
+// stressRounds returns the number of rounds each goroutine of a stress
+// test runs.
+func stressRounds() int {
+	if testing.Short() {
+		return 50
+	}
+	return 300
+}
+
+func TestConcurrentReadersAndWriters(t *testing.T) {
+	test := func(t *testing.T, tree BTree) {
+		//The keys that stay in the tree are one more than a multiple of
+		//three, the writers only insert and remove the others
+		stable := randomKeys(500)
+		for _, key := range stable {
+			err := tree.InsertIndex(NewIndex(key, int64(key)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		rounds := stressRounds()
+		var wg sync.WaitGroup
+		errs := make(chan error, 16)
+
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < rounds; i++ {
+					key := uint64(i*4+w)*3 + 2
+					err := tree.InsertIndex(NewIndex(key, int64(key)))
+					if err == nil && i%2 == 0 {
+						err = tree.RemoveIndex(key)
+					}
+					if err != nil {
+						errs <- fmt.Errorf("writer %v: %v", w, err)
+						return
+					}
+				}
+			}(w)
+		}
+
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func(r int) {
+				defer wg.Done()
+				for i := 0; i < rounds; i++ {
+					key := stable[(i*7+r)%len(stable)]
+					index, err := tree.QueryIndex(key)
+					if err != nil {
+						errs <- fmt.Errorf("reader %v: %v", r, err)
+						return
+					} else if index.Pointer != int64(key) {
+						errs <- fmt.Errorf("reader %v: the key %v has a pointer of %v", r, key, index.Pointer)
+						return
+					}
+
+					if i%20 != 0 {
+						continue
+					}
+					indexes, err := tree.Range(0, maxInt64, nil)
+					if err != nil {
+						errs <- fmt.Errorf("reader %v: %v", r, err)
+						return
+					}
+					found := 0
+					for j, index := range indexes {
+						if j > 0 && indexes[j-1].Key >= index.Key {
+							errs <- fmt.Errorf("reader %v: the range is out of order at %v", r, index.Key)
+							return
+						} else if index.Key%3 == 1 {
+							found++
+						}
+					}
+					if found != len(stable) {
+						errs <- fmt.Errorf("reader %v: the range holds %v of the %v stable keys", r, found, len(stable))
+						return
+					}
+				}
+			}(r)
+		}
+
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+
+		_, err := checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+		indexes, err := tree.Range(0, maxInt64, nil)
+		if err != nil {
+			t.Error(err)
+		} else if expected := len(stable) + 4*rounds/2; len(indexes) != expected {
+			t.Errorf("the tree holds %v keys, expected %v", len(indexes), expected)
+		}
+	}
+
+	forEachBackend(t, "test-concurrent.bin", test)
+	t.Run("CopyOnWrite", func(t *testing.T) {
+		f := path.Join(os.TempDir(), "test-concurrent-cow.bin")
+		tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CopyOnWrite: true, NoSync: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tree.Close()
+		test(t, tree)
+	})
+}
+
+func TestConcurrentCursors(t *testing.T) {
+	forEachBackend(t, "test-concurrent-cursors.bin", func(t *testing.T, tree BTree) {
+		stable := randomKeys(300)
+		for _, key := range stable {
+			err := tree.InsertIndex(NewIndex(key, int64(key)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		rounds := stressRounds()
+		var wg sync.WaitGroup
+		errs := make(chan error, 4)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				key := uint64(i)*3 + 2
+				err := tree.InsertIndex(NewIndex(key, int64(key)))
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+
+		//A cursor only reads one node at a time so it can see the tree
+		//change under it, but every read has to be safe
+		for r := 0; r < 3; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < rounds/10; i++ {
+					c := NewCursor(tree)
+					for c.Next() {
+					}
+					if c.Err() != nil {
+						errs <- c.Err()
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+	})
+}
+
+func TestConcurrentTransactions(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-concurrent-tx.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{NoSync: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	stable := randomKeys(300)
+	for _, key := range stable {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	rounds := stressRounds()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+
+	//Read-only transactions share the tree, one of them is used by
+	//several goroutines at once
+	shared, err := tree.Begin(false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				tx := shared
+				if r%2 == 0 {
+					var err error
+					tx, err = tree.Begin(false)
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+
+				key := stable[(i*3+r)%len(stable)]
+				_, err := tx.QueryIndex(key)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if tx != shared {
+					err = tx.Commit()
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	err = shared.Commit()
+	if err != nil {
+		t.Error(err)
+	}
+
+	//Read-write transactions from several goroutines take turns
+	var mu sync.Mutex
+	committed := 0
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds/10; {
+				tx, err := tree.Begin(true)
+				if err != nil {
+					continue //Another goroutine has a transaction open
+				}
+
+				key := uint64(i*4+w)*3 + 2
+				err = tx.InsertIndex(NewIndex(key, int64(key)))
+				if err != nil {
+					errs <- firstError(err, tx.Rollback())
+					return
+				}
+				err = tx.Commit()
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				mu.Lock()
+				committed++
+				mu.Unlock()
+				i++
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if tree.KeyCount() != uint64(len(stable)+committed) {
+		t.Errorf("the tree has a key count of %v, expected %v", tree.KeyCount(), len(stable)+committed)
+	}
+	_, err = checkBalanced(tree)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConcurrentSnapshots(t *testing.T) {
+	test := func(t *testing.T, tree snapshotter) {
+		keys := randomKeys(300)
+		for _, key := range keys {
+			err := tree.InsertIndex(NewIndex(key, int64(key)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		rounds := stressRounds()
+		var wg sync.WaitGroup
+		errs := make(chan error, 5)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for _, key := range keys[:len(keys)/2] {
+				err := tree.RemoveIndex(key)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				key := uint64(i)*3 + 2
+				err := tree.InsertIndex(NewIndex(key, int64(key)))
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+
+		for r := 0; r < 3; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < rounds/10; i++ {
+					s, err := tree.Snapshot()
+					if err != nil {
+						errs <- err
+						return
+					}
+
+					indexes, err := s.Range(0, maxInt64, nil)
+					if err != nil {
+						errs <- err
+						return
+					} else if uint64(len(indexes)) != s.KeyCount() {
+						errs <- fmt.Errorf("the snapshot holds %v keys, its key count is %v", len(indexes), s.KeyCount())
+						return
+					}
+
+					err = s.Release()
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+		if n := savedPages(tree); n != 0 {
+			t.Errorf("releasing every snapshot left %v pages saved", n)
+		}
+	}
+
+	forEachBackend(t, "test-concurrent-snapshots.bin", func(t *testing.T, tree BTree) {
+		test(t, tree.(snapshotter))
+	})
+	t.Run("CopyOnWrite", func(t *testing.T) {
+		f := path.Join(os.TempDir(), "test-concurrent-snapshots-cow.bin")
+		tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CopyOnWrite: true, NoSync: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tree.Close()
+		test(t, tree)
+		checkFreePages(t, tree)
+	})
+}
+
+func TestConcurrentInserts(t *testing.T) {
+	forEachBackend(t, "test-concurrent-inserts.bin", func(t *testing.T, tree BTree) {
+		keys := randomKeys(4000)
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < len(keys); i += 8 {
+					err := tree.InsertIndex(NewIndex(keys[i], int64(keys[i])))
+					if err == nil {
+						_, err = tree.QueryIndex(keys[i])
+					}
+					if err != nil {
+						errs <- fmt.Errorf("inserter %v: %v", w, err)
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+
+		_, err := checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+		indexes, err := tree.Range(0, maxInt64, nil)
+		if err != nil {
+			t.Error(err)
+		} else if len(indexes) != len(keys) {
+			t.Errorf("the tree holds %v keys, expected %v", len(indexes), len(keys))
+		}
+	})
+}
+
+// BenchmarkInsertParallel inserts into a tree of every backend from as
+// many goroutines as GOMAXPROCS allows, for a range of GOMAXPROCS values.
+// It reports the speedup over a single goroutine and fails if inserts do
+// not scale with the goroutines where there are CPUs enough to run them.
+// The speedup is only checked on runs long enough to measure it, such as
+// go test -bench InsertParallel -benchtime 20000x.
+func BenchmarkInsertParallel(b *testing.B) {
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			var single float64 //Nanoseconds per insert of a single goroutine
+			for _, procs := range []int{1, 2, 4, 8} {
+				b.Run(fmt.Sprintf("GOMAXPROCS=%v", procs), func(b *testing.B) {
+					defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+
+					tree, err := backend.create("bench-insert-parallel.bin", nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if dt, ok := tree.(*BTreeOnDisk); ok {
+						defer dt.Close()
+					}
+
+					var next uint64
+					b.ResetTimer()
+					b.RunParallel(func(pb *testing.PB) {
+						for pb.Next() {
+							//Spread the keys over the whole tree so that the
+							//inserts do not all end up in the same leaf
+							key := atomic.AddUint64(&next, 1) * 0x9e3779b97f4a7c15
+							err := tree.InsertIndex(NewIndex(key, 1))
+							if err != nil {
+								b.Error(err)
+								return
+							}
+						}
+					})
+					b.StopTimer()
+
+					perInsert := float64(b.Elapsed().Nanoseconds()) / float64(b.N)
+					if procs == 1 {
+						single = perInsert
+						return
+					} else if single == 0 {
+						return
+					}
+					speedup := single / perInsert
+					b.ReportMetric(speedup, "speedup")
+					if b.N >= 10000 && procs <= runtime.NumCPU() && speedup <= 1 {
+						b.Errorf("%v goroutines inserted no faster than one, %.2f times as fast", procs, speedup)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestConcurrentInsertBatch(t *testing.T) {
+	tree, err := NewBTreeInMem(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	//Every goroutine inserts batches of keys spread over the whole tree
+	rounds := stressRounds() / 5
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				batch := make([]Index, 50)
+				for j := range batch {
+					key := uint64((j*rounds+i)*4 + w)
+					batch[j] = Index{Key: key, Pointer: int64(key)}
+				}
+				err := tree.InsertBatch(batch)
+				if err != nil {
+					errs <- fmt.Errorf("writer %v: %v", w, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	_, err = checkBalanced(tree)
+	if err != nil {
+		t.Error(err)
+	}
+	if tree.KeyCount() != uint64(4*rounds*50) {
+		t.Errorf("the tree has a key count of %v, expected %v", tree.KeyCount(), 4*rounds*50)
+	}
+}
+
+func TestConcurrentUpsert(t *testing.T) {
+	forEachBackend(t, "test-concurrent-upsert.bin", func(t *testing.T, tree BTree) {
+		//Every goroutine upserts the same keys and counts up the pointer
+		//of the key 0 with CompareAndSwap
+		err := tree.InsertIndex(NewIndex(0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rounds := stressRounds()
+		var wg sync.WaitGroup
+		errs := make(chan error, 4)
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < rounds; i++ {
+					err := tree.Upsert(NewIndex(uint64(i+1), int64(w)))
+					for err == nil {
+						var index *Index
+						index, err = tree.QueryIndex(0)
+						if err != nil {
+							break
+						}
+						var swapped bool
+						swapped, err = tree.CompareAndSwap(0, index.Pointer, index.Pointer+1)
+						if swapped {
+							break
+						}
+					}
+					if err != nil {
+						errs <- fmt.Errorf("writer %v: %v", w, err)
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+
+		_, err = checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+		count, err := tree.CountRange(0, maxInt64)
+		if err != nil {
+			t.Error(err)
+		} else if count != uint64(rounds+1) {
+			t.Errorf("the tree holds %v keys, expected %v", count, rounds+1)
+		}
+		index, err := tree.QueryIndex(0)
+		if err != nil {
+			t.Error(err)
+		} else if index.Pointer != int64(4*rounds) {
+			t.Errorf("the counter has a pointer of %v, expected %v", index.Pointer, 4*rounds)
+		}
+	})
+}
+
+func TestConcurrentPutOverflow(t *testing.T) {
+	forEachBackendWithOptions(t, "test-concurrent-put-overflow.bin", &Options{InlineValueSize: 16}, func(t *testing.T, tree BTree) {
+		//Every goroutine puts long values under the same keys, the ones
+		//that lose a key to another goroutine free their overflow pages
+		//again while the others grow the tree
+		value := func(w int) []byte {
+			return bytes.Repeat([]byte{byte(w)}, 3000)
+		}
+		const keys = 200
+		var wg sync.WaitGroup
+		var inserted int64
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for key := uint64(0); key < keys; key++ {
+					if tree.Put(Uint64Key(key), value(w)) == nil {
+						atomic.AddInt64(&inserted, 1)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		if inserted != keys {
+			t.Errorf("%v puts succeeded, expected %v", inserted, keys)
+		}
+		for key := uint64(0); key < keys; key++ {
+			found, err := tree.Get(Uint64Key(key))
+			if err != nil {
+				t.Error(err)
+			} else if len(found) != 3000 || !bytes.Equal(found, value(int(found[0]))) {
+				t.Errorf("the key %v has a value of %v bytes that was not put", key, len(found))
+			}
+		}
+		_, err := checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,490 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// cowState is the state of a BTreeOnDisk in copy-on-write mode. Nodes
+// written during an operation are held in memory and only written to
+// pages that the last committed tree does not use when the operation
+// commits, after which the header is switched over to the new root. A
+// crash before the header is written leaves the last committed tree as
+// it was, so no write-ahead log is needed.
+//
+// The free pages are listed in pages of their own that every commit
+// writes before the header, see writeFreeList. Files written before the
+// list was kept have no list, their free pages are found by a scan of the
+// tree when they are opened.
+type cowState struct {
+	dirty   map[int64][]byte //The nodes written in the current operation
+	fresh   map[int64]bool   //The pages allocated in the current operation
+	removed []int64          //The committed pages removed in the current operation
+
+	committed fileHeader    //The header of the last committed tree
+	listPages []int64       //The pages holding the free list of the last committed tree
+	epoch     uint64        //The number of commits since the tree was opened
+	retired   []retiredPage //Pages replaced by a commit that a snapshot may still read
+	snapshots map[uint64]int
+}
+
+// retiredPage is a page that stopped being part of the tree when the
+// commit of the given epoch replaced it.
+type retiredPage struct {
+	addr  int64
+	epoch uint64
+}
+
+func newCowState(h fileHeader) *cowState {
+	c := &cowState{
+		committed: h,
+		snapshots: make(map[uint64]int),
+	}
+	c.reset()
+	return c
+}
+
+// reset forgets the changes made by the current operation.
+func (c *cowState) reset() {
+	c.dirty = make(map[int64][]byte)
+	c.fresh = make(map[int64]bool)
+	c.removed = nil
+}
+
+// allocatePage returns a page that neither the last committed tree nor a
+// snapshot uses. It is taken from the free pages or added to the end of
+// the file.
+func (t *BTreeOnDisk) allocatePage() (addr int64) {
+	if len(t.AvailableAddresses) > 0 {
+		addr = t.AvailableAddresses[0]
+		t.AvailableAddresses = t.AvailableAddresses[1:]
+	} else {
+		addr = t.size
+		t.size += int64(t.PageSize())
+	}
+	t.cow.fresh[addr] = true
+	return addr
+}
+
+// writeDirtyNode keeps the node written at addr in memory until the
+// current operation commits.
+func (t *BTreeOnDisk) writeDirtyNode(addr int64, data []byte) error {
+	if !IsValidAddress(addr, t.PageSize()) || addr == 0 {
+		return fmt.Errorf("Invalid address. Cannot write node at %v", addr)
+	}
+	t.cow.dirty[addr] = data
+	return nil
+}
+
+// removePage hands a page back in copy-on-write mode. A page allocated in
+// the current operation is free again straight away, a committed page is
+// retired when the operation commits.
+func (t *BTreeOnDisk) removePage(addr int64) error {
+	for _, e := range t.cow.removed {
+		if e == addr {
+			return fmt.Errorf("the node at %v has already been removed", addr)
+		}
+	}
+
+	delete(t.cow.dirty, addr)
+	if t.cow.fresh[addr] {
+		delete(t.cow.fresh, addr)
+		t.AvailableAddresses = append(t.AvailableAddresses, addr)
+		return nil
+	}
+	t.cow.removed = append(t.cow.removed, addr)
+	return nil
+}
+
+// commitCopyOnWrite writes the nodes changed by the current operation to
+// new pages, copying every node on the path from the root to them so
+// that the pointers lead to the new pages, and then writes the header
+// with the new root.
+func (t *BTreeOnDisk) commitCopyOnWrite() error {
+	if len(t.cow.dirty) == 0 && len(t.cow.removed) == 0 && t.header == t.cow.committed {
+		return nil
+	}
+
+	copied, err := t.pathsToDirtyNodes()
+	if err != nil {
+		return err
+	}
+
+	root, err := t.relocate(t.header.RootAddress, copied)
+	if err != nil {
+		return err
+	}
+
+	//Nodes that can not be reached from the root yet, like those being
+	//built up by hand, are kept where they are if that is safe
+	for addr, data := range t.cow.dirty {
+		if t.cow.fresh[addr] {
+			err = t.writePage(addr, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	listPages, err := t.writeFreeList()
+	if err != nil {
+		return err
+	}
+	t.cache.markLogged()
+
+	err = t.cache.flushPages()
+	if err != nil {
+		return err
+	}
+	if t.sync {
+		err = t.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	t.header.RootAddress = root
+	data, err := t.header.ToBinary()
+	if err != nil {
+		return err
+	}
+	_, err = t.file.WriteAt(data, 0)
+	if err != nil {
+		return err
+	}
+	if t.sync {
+		err = t.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	t.cow.epoch++
+	for _, addr := range t.cow.removed {
+		t.cow.retired = append(t.cow.retired, retiredPage{addr: addr, epoch: t.cow.epoch})
+	}
+	//Snapshots do not read the free list, so its old pages are free now
+	t.AvailableAddresses = append(t.AvailableAddresses, t.cow.listPages...)
+	t.cow.listPages = listPages
+	t.cow.committed = t.header
+	t.cow.reset()
+	t.releaseRetiredPages()
+	return nil
+}
+
+// pathsToDirtyNodes returns the addresses of the nodes that have to be
+// copied by a commit. These are the changed nodes and every node on the
+// path from the root to them. The path is found by searching for one of
+// the keys of the node, or by walking the whole tree for a node without
+// keys.
+func (t *BTreeOnDisk) pathsToDirtyNodes() (copied map[int64]bool, err error) {
+	copied = make(map[int64]bool)
+	copied[t.header.RootAddress] = true
+
+	for addr, data := range t.cow.dirty {
+		copied[addr] = true
+
+		n, err := nodeFromBinary(data, addr, t.nodes())
+		if err != nil {
+			return nil, err
+		}
+
+		var path []int64
+		if n.size() > 0 {
+			path, err = t.searchPath(addr, n.Data[0].Key)
+		} else {
+			path, err = t.walkPath(t.header.RootAddress, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range path {
+			copied[p] = true
+		}
+	}
+	return copied, nil
+}
+
+// searchPath returns the addresses of the nodes on the path from the
+// root to the node at addr that holds key. The path is empty if the node
+// can not be reached from the root.
+func (t *BTreeOnDisk) searchPath(addr int64, key []byte) (path []int64, err error) {
+	cur := t.header.RootAddress
+	for cur != addr {
+		path = append(path, cur)
+
+		p, err := t.nodes().ReadNode(cur)
+		if err != nil {
+			return nil, err
+		}
+		x, found := p.search(key)
+		if found || p.Pointers[x] == 0 {
+			return nil, nil
+		}
+		cur = p.Pointers[x]
+	}
+	return path, nil
+}
+
+// walkPath is searchPath for a node without keys. It walks the subtree
+// rooted at from until it finds the node at addr.
+func (t *BTreeOnDisk) walkPath(from int64, addr int64) (path []int64, err error) {
+	if from == addr {
+		return []int64{}, nil
+	}
+
+	n, err := t.nodes().ReadNode(from)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range n.Pointers {
+		if p == 0 {
+			continue
+		}
+		path, err = t.walkPath(p, addr)
+		if err != nil {
+			return nil, err
+		} else if path != nil {
+			return append(path, from), nil
+		}
+	}
+	return nil, nil
+}
+
+// relocate writes the node at addr and the nodes below it that have to
+// be copied to pages the last committed tree does not use. It returns
+// the address the node ends up at.
+func (t *BTreeOnDisk) relocate(addr int64, copied map[int64]bool) (newAddr int64, err error) {
+	if !copied[addr] {
+		return addr, nil
+	}
+
+	n, err := t.nodes().ReadNode(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, p := range n.Pointers {
+		if p != 0 {
+			n.Pointers[i], err = t.relocate(p, copied)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	newAddr = addr
+	if !t.cow.fresh[addr] {
+		newAddr = t.allocatePage()
+		t.cow.removed = append(t.cow.removed, addr)
+	}
+	delete(t.cow.dirty, addr)
+
+	data, err := n.ToBinary()
+	if err != nil {
+		return 0, err
+	}
+	return newAddr, t.writePage(newAddr, data)
+}
+
+// releaseRetiredPages makes the retired pages that no snapshot can read
+// any more available again.
+func (t *BTreeOnDisk) releaseRetiredPages() {
+	oldest := t.cow.epoch
+	for epoch := range t.cow.snapshots {
+		if epoch < oldest {
+			oldest = epoch
+		}
+	}
+
+	//A page retired by the commit of an epoch is still part of the trees
+	//of every earlier epoch
+	kept := t.cow.retired[:0]
+	for _, p := range t.cow.retired {
+		if p.epoch <= oldest {
+			t.AvailableAddresses = append(t.AvailableAddresses, p.addr)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	t.cow.retired = kept
+}
+
+// freeListPageMagic marks a page that holds part of the free list of a
+// tree in copy-on-write mode.
+const freeListPageMagic = 0x5453494c_45455246 //"FREELIST"
+
+// freeListPage is the start of a page of the free list of a tree in
+// copy-on-write mode, the addresses of Count free pages follow it. The
+// pages form a linked list that starts at the free list head in the file
+// header. Unlike the free list of a tree with a write-ahead log, which
+// links the free pages themselves, it can be written to pages the last
+// committed tree does not use.
+type freeListPage struct {
+	Magic uint64
+	Next  int64
+	Count uint64
+}
+
+// writeFreeList writes the pages that are free once the current operation
+// commits to new pages and points the header at the first of them. These
+// are the free pages, the retired pages, which no snapshot can read after
+// the tree is opened again, and the pages of the last free list. At least
+// one page is written so that a tree with an empty free list can be told
+// apart from one written before the list was kept.
+func (t *BTreeOnDisk) writeFreeList() (pages []int64, err error) {
+	perPage := (t.PageSize() - binary.Size(freeListPage{})) / 8
+
+	//Taking a page for the list can shrink the list by one
+	var free []int64
+	for {
+		free = append([]int64{}, t.AvailableAddresses...)
+		for _, p := range t.cow.retired {
+			free = append(free, p.addr)
+		}
+		free = append(free, t.cow.removed...)
+		free = append(free, t.cow.listPages...)
+		if len(pages) > 0 && len(pages)*perPage >= len(free) {
+			break
+		}
+		pages = append(pages, t.allocatePage())
+	}
+
+	for i, addr := range pages {
+		p := freeListPage{Magic: freeListPageMagic}
+		if i+1 < len(pages) {
+			p.Next = pages[i+1]
+		}
+		chunk := free[min(i*perPage, len(free)):min((i+1)*perPage, len(free))]
+		p.Count = uint64(len(chunk))
+
+		buf := new(bytes.Buffer)
+		err = binary.Write(buf, binary.LittleEndian, p)
+		if err == nil {
+			err = binary.Write(buf, binary.LittleEndian, chunk)
+		}
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, t.PageSize())
+		copy(data, buf.Bytes())
+
+		err = t.writePage(addr, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	t.header.FreeListHead = pages[0]
+	return pages, nil
+}
+
+// loadFreeListPages reads the free list of a tree in copy-on-write mode
+// from the pages the header leads to. A file without a free list is
+// scanned for its free pages instead.
+func (t *BTreeOnDisk) loadFreeListPages() error {
+	if t.header.FreeListHead == 0 {
+		return t.findFreePages()
+	}
+
+	t.AvailableAddresses = nil
+	t.cow.listPages = nil
+	pageSize := int64(t.PageSize())
+	for addr := t.header.FreeListHead; addr != 0; {
+		if !IsValidAddress(addr, t.PageSize()) || addr >= t.size {
+			return fmt.Errorf("the free list points to the invalid address %v", addr)
+		} else if int64(len(t.cow.listPages)) > t.size/pageSize {
+			return fmt.Errorf("the free list contains a loop")
+		}
+
+		data, err := t.readPage(addr)
+		if err != nil {
+			return err
+		}
+		r := bytes.NewReader(data)
+		var p freeListPage
+		err = binary.Read(r, binary.LittleEndian, &p)
+		if err != nil {
+			return err
+		} else if p.Magic != freeListPageMagic {
+			return fmt.Errorf("the page at %v is not a page of the free list", addr)
+		} else if p.Count > uint64(r.Len()/8) {
+			return fmt.Errorf("the page of the free list at %v lists %v pages", addr, p.Count)
+		}
+
+		free := make([]int64, p.Count)
+		err = binary.Read(r, binary.LittleEndian, free)
+		if err != nil {
+			return err
+		}
+		for _, a := range free {
+			if !IsValidAddress(a, t.PageSize()) || a == 0 || a >= t.size {
+				return fmt.Errorf("the free list holds the invalid address %v", a)
+			}
+		}
+
+		t.AvailableAddresses = append(t.AvailableAddresses, free...)
+		t.cow.listPages = append(t.cow.listPages, addr)
+		addr = p.Next
+	}
+	sort.Slice(t.AvailableAddresses, func(i, j int) bool { return t.AvailableAddresses[i] < t.AvailableAddresses[j] })
+	return nil
+}
+
+// findFreePages rebuilds the free pages of a tree in copy-on-write mode
+// from the pages that can not be reached from the root or the free list.
+func (t *BTreeOnDisk) findFreePages() error {
+	used := make(map[int64]bool)
+	err := t.markReachable(t.header.RootAddress, used)
+	if err != nil {
+		return err
+	}
+	for _, addr := range t.cow.listPages {
+		used[addr] = true
+	}
+
+	t.AvailableAddresses = nil
+	pageSize := int64(t.PageSize())
+	for addr := pageSize; addr < t.size; addr += pageSize {
+		if !used[addr] {
+			t.AvailableAddresses = append(t.AvailableAddresses, addr)
+		}
+	}
+	sort.Slice(t.AvailableAddresses, func(i, j int) bool { return t.AvailableAddresses[i] < t.AvailableAddresses[j] })
+	return nil
+}
+
+func (t *BTreeOnDisk) markReachable(addr int64, used map[int64]bool) error {
+	if used[addr] {
+		return fmt.Errorf("the node at %v is reachable from more than one pointer", addr)
+	}
+	used[addr] = true
+
+	n, err := t.nodes().ReadNode(addr)
+	if err != nil {
+		return err
+	}
+	for _, p := range n.Pointers {
+		if p != 0 {
+			err = t.markReachable(p, used)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	//The overflow pages of the values in the node are in use as well
+	for i := range n.Data[:n.size()] {
+		err = overflowPages(t.nodes(), &n.Data[i], func(addr int64) error {
+			if used[addr] {
+				return fmt.Errorf("the overflow page at %v is used more than once", addr)
+			}
+			used[addr] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
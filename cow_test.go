@@ -0,0 +1,358 @@
+package btree
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCopyOnWrite(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-cow.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CopyOnWrite: true, NoSync: true, CacheSize: 16})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	if _, err = os.Stat(f + walSuffix); !os.IsNotExist(err) {
+		t.Error("a tree in copy-on-write mode has a write-ahead log")
+	}
+
+	keys := randomKeys(2000)
+	for _, key := range keys {
+		root := tree.header.RootAddress
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if tree.header.RootAddress == root {
+			t.Errorf("the root stayed at %v after inserting %v", root, key)
+			return
+		}
+	}
+	for _, key := range keys[:1000] {
+		err = tree.RemoveIndex(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	checkRecovered(t, tree, keys[1000:], keys[:1000])
+	if tree.KeyCount() != 1000 {
+		t.Errorf("the tree has a key count of %v, expected 1000", tree.KeyCount())
+	}
+	height, err := checkBalanced(tree)
+	if err != nil {
+		t.Error(err)
+	} else if height != tree.Height() {
+		t.Errorf("the tree has a height of %v, the header records %v", height, tree.Height())
+	}
+	checkFreePages(t, tree)
+}
+
+func TestCopyOnWriteReopen(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-cow-reopen.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CopyOnWrite: true, NoSync: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	keys := randomKeys(1000)
+	for _, key := range keys {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for _, key := range keys[:500] {
+		err = tree.RemoveIndex(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	if tree.cow == nil {
+		t.Error("the reopened tree is not in copy-on-write mode")
+		return
+	}
+	checkRecovered(t, tree, keys[500:], keys[:500])
+	checkFreePages(t, tree)
+	if len(tree.AvailableAddresses) == 0 {
+		t.Error("no free pages were found in the reopened tree")
+	}
+
+	//The free pages are used before the file grows
+	size := tree.size
+	err = tree.InsertIndex(NewIndex(2, 2))
+	if err != nil {
+		t.Error(err)
+	} else if tree.size != size {
+		t.Errorf("the insert grew the file from %v to %v bytes instead of using one of %v free pages", size, tree.size, len(tree.AvailableAddresses))
+	}
+}
+
+func TestCopyOnWriteFreeList(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-cow-free-list.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CopyOnWrite: true, NoSync: true, PageSize: 752})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	keys := randomKeys(5000)
+	for _, key := range keys {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for _, key := range keys[:4000] {
+		err = tree.RemoveIndex(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	//The free pages are read from the list, not found by a scan of the tree
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(tree.cow.listPages) < 2 {
+		t.Errorf("the free list of %v pages is kept in %v pages", len(tree.AvailableAddresses), len(tree.cow.listPages))
+	}
+	if reads := tree.cache.misses; reads != uint64(1+len(tree.cow.listPages)) {
+		t.Errorf("opening the tree read %v pages, its free list is kept in %v", reads, len(tree.cow.listPages))
+	}
+	checkRecovered(t, tree, keys[4000:], keys[:4000])
+	checkFreePages(t, tree)
+	header := tree.header
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	//A file written before the free list was kept is scanned
+	header.FreeListHead = 0
+	data, err := header.ToBinary()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	file, err := os.OpenFile(f, os.O_RDWR, 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = file.WriteAt(data, 0)
+	err = firstError(err, file.Close())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+	if len(tree.cow.listPages) != 0 {
+		t.Errorf("the tree without a free list was opened with %v pages of it", len(tree.cow.listPages))
+	}
+	checkRecovered(t, tree, keys[4000:], keys[:4000])
+	checkFreePages(t, tree)
+
+	err = tree.InsertIndex(NewIndex(keys[0], int64(keys[0])))
+	if err != nil {
+		t.Error(err)
+	} else if tree.header.FreeListHead == 0 {
+		t.Error("the commit did not write a free list")
+	}
+	checkFreePages(t, tree)
+}
+
+func TestCopyOnWriteCrash(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-cow-crash.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CopyOnWrite: true, CacheSize: 4})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	keys := randomKeys(1000)
+	for _, key := range keys[:500] {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	tx, err := tree.Begin(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, key := range keys[500:] {
+		err = tx.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for _, key := range keys[:100] {
+		err = tx.RemoveIndex(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	//Stop before the transaction is committed, nothing was flushed
+	err = tree.closeFiles()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	checkRecovered(t, tree, keys[:500], keys[500:])
+	if tree.KeyCount() != 500 {
+		t.Errorf("the recovered tree has a key count of %v, expected 500", tree.KeyCount())
+	}
+	checkFreePages(t, tree)
+}
+
+func TestCopyOnWriteRollback(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-cow-rollback.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CopyOnWrite: true, NoSync: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	keys := randomKeys(1000)
+	for _, key := range keys[:500] {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	root := tree.header.RootAddress
+	available := len(tree.AvailableAddresses)
+
+	tx, err := tree.Begin(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, key := range keys[500:] {
+		err = tx.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for _, key := range keys[:200] {
+		err = tx.RemoveIndex(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	checkRecovered(t, tree, keys[:500], keys[500:])
+	if tree.header.RootAddress != root {
+		t.Errorf("the root moved from %v to %v in the rollback", root, tree.header.RootAddress)
+	}
+	if len(tree.AvailableAddresses) != available {
+		t.Errorf("the tree has %v free pages after the rollback, expected %v", len(tree.AvailableAddresses), available)
+	}
+
+	err = tree.InsertIndex(NewIndex(keys[500], int64(keys[500])))
+	if err != nil {
+		t.Error(err)
+	}
+	checkFreePages(t, tree)
+}
+
+// checkFreePages checks that every page of a tree in copy-on-write mode
+// after the header is either reachable from the root, holds the free list
+// or is free, but only one of them.
+func checkFreePages(t *testing.T, tree *BTreeOnDisk) {
+	used := make(map[int64]bool)
+	err := tree.markReachable(tree.header.RootAddress, used)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, addr := range tree.cow.listPages {
+		if used[addr] {
+			t.Errorf("the page at %v holds the free list and is also in use", addr)
+		}
+		used[addr] = true
+	}
+
+	free := make(map[int64]bool)
+	for _, addr := range tree.AvailableAddresses {
+		if used[addr] || free[addr] {
+			t.Errorf("the page at %v is free more than once or also in use", addr)
+		}
+		free[addr] = true
+	}
+	for _, p := range tree.cow.retired {
+		free[p.addr] = true
+	}
+
+	pageSize := int64(tree.PageSize())
+	for addr := pageSize; addr < tree.size; addr += pageSize {
+		if !used[addr] && !free[addr] {
+			t.Errorf("the page at %v is neither in use nor free", addr)
+		}
+	}
+}
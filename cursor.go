@@ -0,0 +1,292 @@
+package btree
+
+// Iterator is implemented by anything that hands out indexes one at a time
+// in key order, such as a Cursor.
+type Iterator interface {
+	Next() bool
+	Index() *Index
+	Err() error
+}
+
+// Cursor is a position in a b-tree that can be moved forwards and
+// backwards through the indexes in key order. It works with any BTree
+// through its Root and ReadNode methods. A new cursor is not positioned
+// on anything, calling Next or Prev on it starts from the first or last
+// index. Once the cursor has moved past either end it stays there until
+// it is positioned again with First, Last or Seek. The cursor keeps
+// copies of the nodes on its path so it should also be positioned again
+// after the tree is changed.
+type Cursor struct {
+	tree      BTree
+	stack     []cursorFrame
+	exhausted bool
+	err       error
+}
+
+// cursorFrame is a node on the path from the root to the current index.
+// For the last frame pos is the position of the current index in the
+// node, for the ones above it pos is the pointer that was followed.
+type cursorFrame struct {
+	node *Node
+	pos  int
+}
+
+// NewCursor creates a cursor over the given b-tree.
+func NewCursor(t BTree) *Cursor {
+	c := new(Cursor)
+	c.tree = t
+	return c
+}
+
+// First moves the cursor to the smallest index in the tree. It returns
+// false if the tree is empty or the root could not be read.
+func (c *Cursor) First() bool {
+	root, ok := c.reset()
+	if !ok {
+		return false
+	}
+	return c.descendFirst(root)
+}
+
+// Last moves the cursor to the largest index in the tree. It returns false
+// if the tree is empty or the root could not be read.
+func (c *Cursor) Last() bool {
+	root, ok := c.reset()
+	if !ok {
+		return false
+	}
+	return c.descendLast(root)
+}
+
+// Seek is SeekKey for a uint64 key.
+func (c *Cursor) Seek(key uint64) bool {
+	return c.SeekKey(Uint64Key(key))
+}
+
+// SeekKey moves the cursor to the entry with the given key or, if the key
+// is not in the tree, to the first entry with a larger key. It returns
+// false if there is no such entry.
+func (c *Cursor) SeekKey(key []byte) bool {
+	n, ok := c.reset()
+	if !ok {
+		return false
+	}
+
+	for {
+		x, found := n.search(key)
+		c.stack = append(c.stack, cursorFrame{node: n, pos: x})
+		if found {
+			return true
+		} else if n.Pointers[x] == 0 {
+			if x < n.size() {
+				return true
+			}
+			return c.ascendNext()
+		}
+
+		next, err := n.readLeftPtr(x)
+		if err != nil {
+			return c.fail(err)
+		}
+		n = next
+	}
+}
+
+// Next moves the cursor to the index after the current one. On a cursor
+// that has not been positioned yet it moves to the first index. It
+// returns false once the cursor has moved past the last index.
+func (c *Cursor) Next() bool {
+	if c.err != nil || c.exhausted {
+		return false
+	} else if !c.Valid() {
+		return c.First()
+	}
+
+	top := &c.stack[len(c.stack)-1]
+	if top.node.Pointers[top.pos+1] != 0 {
+		top.pos++
+		child, err := top.node.readLeftPtr(top.pos)
+		if err != nil {
+			return c.fail(err)
+		}
+		return c.descendFirst(child)
+	} else if top.pos+1 < top.node.size() {
+		top.pos++
+		return true
+	}
+	return c.ascendNext()
+}
+
+// Prev moves the cursor to the index before the current one. On a cursor
+// that has not been positioned yet it moves to the last index. It returns
+// false once the cursor has moved past the first index.
+func (c *Cursor) Prev() bool {
+	if c.err != nil || c.exhausted {
+		return false
+	} else if !c.Valid() {
+		return c.Last()
+	}
+
+	top := &c.stack[len(c.stack)-1]
+	if top.node.Pointers[top.pos] != 0 {
+		child, err := top.node.readLeftPtr(top.pos)
+		if err != nil {
+			return c.fail(err)
+		}
+		return c.descendLast(child)
+	} else if top.pos > 0 {
+		top.pos--
+		return true
+	}
+	return c.ascendPrev()
+}
+
+// Valid returns true if the cursor is positioned on an index.
+func (c *Cursor) Valid() bool {
+	return c.err == nil && len(c.stack) > 0
+}
+
+// Key returns the key of the current index or zero if the cursor is not
+// positioned on an index or its key is not a uint64 key. Zero is a valid
+// key as well, so callers have to check Valid first, or that Index is not
+// nil if the tree can hold keys that are not uint64 keys.
+func (c *Cursor) Key() uint64 {
+	index := c.Index()
+	if index == nil {
+		return 0
+	}
+	return index.Key
+}
+
+// Index returns a copy of the current index or nil if the cursor is not
+// positioned on an index or its key is not a uint64 key. Unlike Entry it
+// leaves a value kept in overflow pages unread.
+func (c *Cursor) Index() *Index {
+	if !c.Valid() {
+		return nil
+	}
+	top := c.stack[len(c.stack)-1]
+	index, err := top.node.Data[top.pos].index()
+	if err != nil {
+		return nil
+	}
+	return index
+}
+
+// Entry returns a copy of the current entry or nil if the cursor is not
+// positioned on an entry. A value kept in overflow pages is read with the
+// entry, if that fails the cursor stops with the error.
+func (c *Cursor) Entry() *Entry {
+	if !c.Valid() {
+		return nil
+	}
+	top := c.stack[len(c.stack)-1]
+	entry := top.node.Data[top.pos]
+	err := loadValue(c.tree, &entry)
+	if err != nil {
+		c.err = err
+		return nil
+	}
+	return &entry
+}
+
+// Err returns the error that stopped the cursor, if any. Running off
+// either end of the tree is not an error.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+func (c *Cursor) reset() (root *Node, ok bool) {
+	c.stack = c.stack[:0]
+	c.exhausted = false
+	c.err = nil
+
+	root, err := c.tree.Root()
+	if err != nil {
+		return nil, c.fail(err)
+	}
+	return root, true
+}
+
+// descendFirst follows the leftmost pointers from n down to the smallest
+// index in its subtree.
+func (c *Cursor) descendFirst(n *Node) bool {
+	for {
+		c.stack = append(c.stack, cursorFrame{node: n, pos: 0})
+		if n.Pointers[0] == 0 {
+			break
+		}
+
+		next, err := n.readLeftPtr(0)
+		if err != nil {
+			return c.fail(err)
+		}
+		n = next
+	}
+
+	if n.size() == 0 {
+		return c.ascendNext()
+	}
+	return true
+}
+
+// descendLast follows the rightmost pointers from n down to the largest
+// index in its subtree.
+func (c *Cursor) descendLast(n *Node) bool {
+	for {
+		size := n.size()
+		c.stack = append(c.stack, cursorFrame{node: n, pos: size})
+		if n.Pointers[size] == 0 {
+			break
+		}
+
+		next, err := n.readLeftPtr(size)
+		if err != nil {
+			return c.fail(err)
+		}
+		n = next
+	}
+
+	if n.size() == 0 {
+		return c.ascendPrev()
+	}
+	c.stack[len(c.stack)-1].pos--
+	return true
+}
+
+// ascendNext leaves the current node and moves up to the first ancestor
+// that still has an index after the pointer that was followed.
+func (c *Cursor) ascendNext() bool {
+	c.stack = c.stack[:len(c.stack)-1]
+	for len(c.stack) > 0 {
+		top := c.stack[len(c.stack)-1]
+		if top.pos < top.node.size() {
+			return true
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+	c.exhausted = true
+	return false
+}
+
+// ascendPrev leaves the current node and moves up to the first ancestor
+// that still has an index before the pointer that was followed.
+func (c *Cursor) ascendPrev() bool {
+	c.stack = c.stack[:len(c.stack)-1]
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+		if top.pos > 0 {
+			top.pos--
+			return true
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+	c.exhausted = true
+	return false
+}
+
+func (c *Cursor) fail(err error) bool {
+	c.stack = c.stack[:0]
+	c.err = err
+	return false
+}
@@ -0,0 +1,146 @@
+package btree
+
+import "testing"
+
+func TestCursorForward(t *testing.T) {
+	forEachBackend(t, "test-cursor-forward.bin", func(t *testing.T, tree BTree) {
+		keys := randomKeys(1000)
+		insertKeys(t, tree, keys)
+		expected := sortedKeys(keys)
+
+		c := NewCursor(tree)
+		i := 0
+		for c.Next() {
+			if i >= len(expected) {
+				t.Errorf("the cursor returned more than the %v keys in the tree", len(expected))
+				return
+			} else if c.Index() == nil {
+				t.Errorf("the cursor moved to position %v but is not on an index", i)
+				return
+			} else if c.Key() != expected[i] {
+				t.Errorf("the cursor returned key %v at position %v, expected %v", c.Key(), i, expected[i])
+				return
+			} else if c.Index().Pointer != int64(expected[i])*2 {
+				t.Errorf("the cursor returned pointer %v for key %v", c.Index().Pointer, c.Key())
+			}
+			i++
+		}
+
+		if c.Err() != nil {
+			t.Error(c.Err())
+		} else if i != len(expected) {
+			t.Errorf("the cursor returned %v keys, expected %v", i, len(expected))
+		}
+
+		if c.Next() {
+			t.Error("the cursor moved on after running past the last key")
+		}
+	})
+}
+
+func TestCursorBackward(t *testing.T) {
+	forEachBackend(t, "test-cursor-backward.bin", func(t *testing.T, tree BTree) {
+		keys := randomKeys(1000)
+		insertKeys(t, tree, keys)
+		expected := sortedKeys(keys)
+
+		c := NewCursor(tree)
+		i := len(expected) - 1
+		for ok := c.Last(); ok; ok = c.Prev() {
+			if i < 0 {
+				t.Errorf("the cursor returned more than the %v keys in the tree", len(expected))
+				return
+			} else if !c.Valid() {
+				t.Errorf("the cursor moved to position %v but is not on an index", i)
+				return
+			} else if c.Key() != expected[i] {
+				t.Errorf("the cursor returned key %v at position %v, expected %v", c.Key(), i, expected[i])
+				return
+			}
+			i--
+		}
+
+		if c.Err() != nil {
+			t.Error(c.Err())
+		} else if i != -1 {
+			t.Errorf("the cursor stopped with %v keys left to return", i+1)
+		}
+	})
+}
+
+func TestCursorSeek(t *testing.T) {
+	forEachBackend(t, "test-cursor-seek.bin", func(t *testing.T, tree BTree) {
+		keys := randomKeys(1000)
+		insertKeys(t, tree, keys)
+		expected := sortedKeys(keys)
+
+		c := NewCursor(tree)
+		for i, key := range expected {
+			//Seek to the key itself and to the gap right before it
+			for _, target := range []uint64{key, key - 1} {
+				if !c.Seek(target) || !c.Valid() {
+					t.Errorf("seeking to %v did not find a key", target)
+					return
+				} else if c.Key() != key {
+					t.Errorf("seeking to %v returned %v, expected %v", target, c.Key(), key)
+					return
+				}
+			}
+
+			if i+1 < len(expected) {
+				if !c.Next() || !c.Valid() || c.Key() != expected[i+1] {
+					t.Errorf("moving on from %v returned %v, expected %v", key, c.Key(), expected[i+1])
+					return
+				}
+				c.Seek(key)
+			}
+			if i > 0 {
+				if !c.Prev() || !c.Valid() || c.Key() != expected[i-1] {
+					t.Errorf("moving back from %v returned %v, expected %v", key, c.Key(), expected[i-1])
+					return
+				}
+			}
+		}
+
+		if c.Seek(expected[len(expected)-1] + 1) {
+			t.Errorf("seeking past the last key found %v", c.Index())
+		} else if c.Valid() {
+			t.Error("the cursor is still positioned after seeking past the last key")
+		} else if c.Err() != nil {
+			t.Error(c.Err())
+		}
+	})
+}
+
+func TestCursorEmptyTree(t *testing.T) {
+	forEachBackend(t, "test-cursor-empty.bin", func(t *testing.T, tree BTree) {
+		c := NewCursor(tree)
+		if c.First() || c.Last() || c.Seek(10) || c.Next() || c.Prev() {
+			t.Error("the cursor found a key in an empty tree")
+		} else if c.Valid() || c.Index() != nil {
+			t.Errorf("the cursor returned the index %v from an empty tree", c.Index())
+		} else if c.Err() != nil {
+			t.Error(c.Err())
+		}
+	})
+}
+
+func TestCursorZeroKey(t *testing.T) {
+	forEachBackend(t, "test-cursor-zero-key.bin", func(t *testing.T, tree BTree) {
+		c := NewCursor(tree)
+		if c.Valid() {
+			t.Error("a cursor that was not positioned is valid")
+		}
+
+		insertKeys(t, tree, []uint64{0, 1, 2})
+		if !c.First() || !c.Valid() || c.Index() == nil {
+			t.Error("the cursor did not move to the key 0")
+		} else if c.Key() != 0 {
+			t.Errorf("the first key is %v, expected 0", c.Key())
+		}
+
+		if c.Prev() || c.Valid() || c.Index() != nil {
+			t.Errorf("moving back from the key 0 returned %v", c.Index())
+		}
+	})
+}
@@ -2,162 +2,657 @@ package btree
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 // BTreeOnDisk is a structure that references a b-tree structure that
-// resides on disk instead of in memory.
+// resides on disk instead of in memory. The first page of the file is a
+// header that records where the root node and the list of free pages
+// are, the nodes follow it. AvailableAddresses mirrors the free list
+// with its head first.
+//
+// The file is kept open and its pages are read and written through a
+// page cache. The pages changed by every operation are first written to
+// a write-ahead log next to the file and only then to the file itself,
+// once they are evicted from the cache or the tree is flushed. If the
+// process stops part way through, the log is replayed the next time the
+// tree is opened so the file never holds half of an operation. A tree
+// has to be closed with Close when it is no longer used.
+//
+// A tree created in copy-on-write mode has no write-ahead log. Instead
+// the nodes changed by an operation are written to free pages and the
+// header is switched over to the new root last, see cowState.
+//
+// A BTreeOnDisk is safe for concurrent use by multiple goroutines. Any
+// number of goroutines can read the tree at the same time. Like in a
+// BTreeInMemory, inserts, updates and compare-and-swaps latch the nodes
+// they work on, see latcher, so they run in parallel with each other and
+// with reads. The pages they write are logged together once none of them
+// is half done, and each of them returns once its pages are in the log.
+// Every other operation that changes the tree waits for the ones in
+// progress and runs on its own, as does every change in copy-on-write
+// mode, which switches the tree over to its new root as a whole.
+// AvailableAddresses must not be used directly while other goroutines
+// use the tree.
 type BTreeOnDisk struct {
 	File               string
 	AvailableAddresses []int64
+
+	mu         sync.RWMutex //Held for reading by reads and the operations that run in parallel, for writing by everything else
+	latches    latchTable
+	headerMu   sync.Mutex   //Held by the operations that run in parallel while they change the header, the free list or the size
+	commitMu   sync.RWMutex //Held for reading while an operation that runs in parallel is in progress and for writing while they are logged
+	pageSize   int          //Never changes so it is read without holding mu
+	maxKeySize int          //Never changes either
+	valueSize  int          //The inline value size, which never changes either
+	compare    func(a []byte, b []byte) int
+	header     fileHeader
+	file       *os.File
+	cache      *pageCache
+	wal        *writeAheadLog
+	cow        *cowState     //Only set in copy-on-write mode, which has no wal
+	versions   *pageVersions //Only set when not in copy-on-write mode
+	sync       bool
+	size       int64 //The size of the file including the pages still in the cache, grown atomically
+	opDepth    int32 //The number of operations in progress, changed atomically, see update
+	writer     *Tx   //The open read-write transaction
+	readers    int   //The number of open read-only transactions
+	inTx       bool  //True while the open read-write transaction changes the tree
+}
+
+// diskNodes is the view of a BTreeOnDisk that its operations hand to the
+// nodes they work on. The operations already hold the lock of the tree,
+// so the methods of the view do not take it again. Its nodes are latched
+// by the operations that run in parallel.
+type diskNodes BTreeOnDisk
+
+func (t *BTreeOnDisk) nodes() *diskNodes {
+	return (*diskNodes)(t)
+}
+
+func (d *diskNodes) tree() *BTreeOnDisk {
+	return (*BTreeOnDisk)(d)
 }
 
-// NewBTreeOnDisk creates a new b-tree that resides on disk. The
-// structure uses internal pointers to bytes in the file. It uses
-// these to work like memory pointers.
+// NewBTreeOnDisk opens the b-tree stored in file if it already exists
+// and creates a new, empty one otherwise. The structure uses internal
+// pointers to bytes in the file. It uses these to work like memory
+// pointers.
 func NewBTreeOnDisk(file string) (t *BTreeOnDisk, err error) {
+	_, err = os.Stat(file)
+	if os.IsNotExist(err) {
+		return CreateBTreeOnDisk(file, false)
+	} else if err != nil {
+		return nil, err
+	}
+	return OpenBTreeOnDisk(file)
+}
+
+// CreateBTreeOnDisk creates a new, empty b-tree in file and writes its
+// header and root node. If the file already exists an error is returned unless
+// overwrite is true, in which case the existing contents are discarded.
+func CreateBTreeOnDisk(file string, overwrite bool) (t *BTreeOnDisk, err error) {
+	return CreateBTreeOnDiskWithOptions(file, overwrite, nil)
+}
+
+// CreateBTreeOnDiskWithOptions works like CreateBTreeOnDisk but creates
+// the tree with the given options. The page size is recorded in the
+// header so the tree keeps it when it is opened again.
+func CreateBTreeOnDiskWithOptions(file string, overwrite bool, opts *Options) (t *BTreeOnDisk, err error) {
+	pageSize, err := opts.pageSize()
+	if err != nil {
+		return nil, err
+	}
+	cacheSize, err := opts.cacheSize()
+	if err != nil {
+		return nil, err
+	}
+	maxKeySize, valueSize, err := opts.entrySize(pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(file, flags, 0666)
+	if err != nil {
+		return nil, err
+	}
+
 	t = new(BTreeOnDisk)
 	t.File = file
+	t.header = newFileHeader(pageSize, maxKeySize, valueSize)
+	t.pageSize = pageSize
+	t.maxKeySize = maxKeySize
+	t.valueSize = valueSize
+	t.compare = opts.compare()
+	t.file = f
+	t.cache = newPageCache(f, cacheSize)
+	t.sync = opts == nil || !opts.NoSync
+	t.size = int64(pageSize)
 
-	_, err = os.Stat(file)
-	if os.IsNotExist(err) {
-		n, err := NewNode(t)
+	//Any log left behind belongs to the tree that was in the file before
+	if opts != nil && opts.CopyOnWrite {
+		err = os.Remove(file + walSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, firstError(err, f.Close())
+		}
+		t.header.Flags |= headerFlagCopyOnWrite
+		t.cow = newCowState(t.header)
+		t.header.RootAddress = t.allocatePage()
+	} else {
+		t.wal, err = createWriteAheadLog(file+walSuffix, t.sync)
 		if err != nil {
-			return nil, err
+			return nil, firstError(err, f.Close())
 		}
+		t.versions = newPageVersions()
+	}
 
-		err = n.Write()
+	err = t.update(func() error {
+		err := t.writeHeader()
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		return t, nil
+		n, err := NewNode(t.nodes())
+		if err != nil {
+			return err
+		}
+		n.Address = t.header.RootAddress
+		return n.Write()
+	})
+	if err != nil {
+		return nil, firstError(err, t.closeFiles())
 	}
 
-	err = os.Remove(file)
+	return t, nil
+}
+
+// OpenBTreeOnDisk opens an existing b-tree stored in file. Operations
+// left in the write-ahead log are replayed first. The header of the file
+// is then validated, the root node is checked to be readable and the
+// cache of available addresses is loaded from the free list in the file.
+func OpenBTreeOnDisk(file string) (t *BTreeOnDisk, err error) {
+	return OpenBTreeOnDiskWithOptions(file, nil)
+}
+
+// OpenBTreeOnDiskWithOptions works like OpenBTreeOnDisk but opens the
+// tree with the given options. The page size, maximum key size, inline
+// value size and copy-on-write mode are always taken from the header of
+// the file, the key order has to be given again if it is not the
+// default.
+func OpenBTreeOnDiskWithOptions(file string, opts *Options) (t *BTreeOnDisk, err error) {
+	cacheSize, err := opts.cacheSize()
 	if err != nil {
 		return nil, err
 	}
+
+	err = recoverWriteAheadLog(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to recover %v from its write-ahead log: %v", file, err)
+	}
+
+	h, err := readFileHeader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(file, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, firstError(err, f.Close())
+	}
+
+	t = new(BTreeOnDisk)
+	t.File = file
+	t.header = h
+	t.pageSize = int(h.PageSize)
+	t.maxKeySize = int(h.MaxKeySize)
+	t.valueSize = int(h.ValueSize)
+	t.compare = opts.compare()
+	t.file = f
+	t.cache = newPageCache(f, cacheSize)
+	t.sync = opts == nil || !opts.NoSync
+	t.size = stat.Size()
+
+	if h.Flags&headerFlagCopyOnWrite != 0 {
+		t.cow = newCowState(h)
+	} else {
+		t.wal, err = createWriteAheadLog(file+walSuffix, t.sync)
+		if err != nil {
+			return nil, firstError(err, f.Close())
+		}
+		t.versions = newPageVersions()
+	}
+
+	_, err = t.nodes().Root()
+	if err != nil {
+		err = fmt.Errorf("unable to read the root node of %v: %v", file, err)
+		return nil, firstError(err, t.closeFiles())
+	}
+
+	if t.cow != nil {
+		err = t.loadFreeListPages()
+	} else {
+		err = t.loadFreeList(t.size)
+	}
+	if err != nil {
+		err = fmt.Errorf("unable to load the free list of %v: %v", file, err)
+		return nil, firstError(err, t.closeFiles())
+	}
+
 	return t, nil
 }
 
-// WriteNode writes the specified node to disk. It takes a single
-// parameter node. It uses the address inside the n *Node parameter
-// and confirms that it is a valid pointer.
-func (t *BTreeOnDisk) WriteNode(n *Node) error {
-	if !IsValidAddress(n.Address) {
-		return fmt.Errorf("Invalid address. Cannot write node at %v", n.Address)
+// Flush writes every page changed since the last flush to the file,
+// syncs it to disk and empties the write-ahead log. A tree can not be
+// flushed while a read-write transaction is open.
+func (t *BTreeOnDisk) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.flush()
+}
+
+func (t *BTreeOnDisk) flush() error {
+	err := t.checkOpen()
+	if err != nil {
+		return err
+	} else if t.writer != nil {
+		return fmt.Errorf("the b-tree can not be flushed while a read-write transaction is open")
 	}
 
-	data, err := n.ToBinary()
+	err = t.commit()
 	if err != nil {
 		return err
 	}
+	return t.checkpoint()
+}
 
-	f, err := os.OpenFile(t.File, os.O_RDWR, 0666)
-	if os.IsNotExist(err) {
-		f, err = os.Create(t.File)
+// Close flushes the tree and closes its file. The tree can not be used
+// after it is closed. Every transaction has to be finished first.
+func (t *BTreeOnDisk) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.readers > 0 {
+		return fmt.Errorf("the b-tree has %v read-only transactions open", t.readers)
 	}
-	defer f.Close()
 
+	err := t.flush()
 	if err != nil {
 		return err
 	}
+	return t.closeFiles()
+}
 
-	_, err = f.WriteAt(data, n.Address)
+// closeFiles closes the tree file and the write-ahead log without
+// flushing anything.
+func (t *BTreeOnDisk) closeFiles() error {
+	err := t.file.Close()
+	if t.wal != nil {
+		err = firstError(t.wal.close(), err)
+	}
+	t.file = nil
+	t.cache = nil
+	t.wal = nil
 	return err
 }
 
-// ReadNode reads the node from disk. The parameter takes a positive
-// integer and returns an error if the address is invalid. The function
-// returns two parameters n *Node which is the node and err of type
-// error.
-func (t *BTreeOnDisk) ReadNode(address int64) (n *Node, err error) {
-	if !IsValidAddress(address) {
-		return nil, fmt.Errorf("Invalid address. Cannot read node at %v", address)
+// update runs fn as a single operation. Every page written by fn is
+// logged as one record in the write-ahead log once fn returns, so either
+// all of them or none of them survive a crash. Operations started by fn
+// are part of the same operation, as are all the operations of a
+// read-write transaction, which is logged when it is committed.
+func (t *BTreeOnDisk) update(fn func() error) error {
+	err := t.checkOpen()
+	if err != nil {
+		return err
+	} else if atomic.LoadInt32(&t.opDepth) == 0 {
+		err = t.checkWritable()
+		if err != nil {
+			return err
+		}
 	}
 
-	f, err := os.Open(t.File)
-	if os.IsNotExist(err) {
-		return nil, err
+	atomic.AddInt32(&t.opDepth, 1)
+	err = fn()
+	if atomic.AddInt32(&t.opDepth, -1) > 0 || t.writer != nil {
+		return err
+	}
+	return firstError(err, t.commit())
+}
+
+// parallel runs fn as an operation that runs in parallel with the others
+// started by parallel, holding the lock of the tree for reading only. fn
+// latches the nodes it works on. The pages written by the operations in
+// progress are logged as one record once all of them are done, which
+// every one of them waits for, so a crash never leaves half of one of
+// them in the file. In copy-on-write mode fn runs on its own through
+// update instead, as its changes are switched over to as a whole.
+func (t *BTreeOnDisk) parallel(fn func() error) error {
+	if t.cow != nil {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.update(fn)
 	}
-	defer f.Close()
 
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	err := t.checkOpen()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	err = t.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	t.commitMu.RLock()
+	atomic.AddInt32(&t.opDepth, 1)
+	err = fn()
+	atomic.AddInt32(&t.opDepth, -1)
+	t.commitMu.RUnlock()
+
+	//The first one to get here logs the pages of all of them
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+	return firstError(err, t.commit())
+}
 
-	data := make([]byte, 752)
+// checkWritable returns an error if the tree can not be changed outside
+// of an operation that is already in progress because of an open
+// transaction.
+func (t *BTreeOnDisk) checkWritable() error {
+	if t.readers > 0 {
+		return fmt.Errorf("the b-tree can not be changed while %v read-only transactions are open", t.readers)
+	} else if t.writer != nil && !t.inTx {
+		return fmt.Errorf("the b-tree can only be changed through the open read-write transaction")
+	}
+	return nil
+}
 
-	_, err = f.Seek(address, 0)
+// commit writes the pages changed since the last commit to the
+// write-ahead log. After that they are free to be written to the file.
+func (t *BTreeOnDisk) commit() error {
+	if t.cow != nil {
+		return t.commitCopyOnWrite()
+	}
+
+	pages := t.cache.pendingPages()
+	if len(pages) == 0 {
+		return nil
+	}
+
+	err := t.wal.append(pages)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	t.cache.markLogged()
+
+	if t.wal.size >= walCheckpointSize {
+		return t.checkpoint()
 	}
+	return nil
+}
+
+// checkpoint writes every logged page to the file and empties the
+// write-ahead log as its records are no longer needed.
+func (t *BTreeOnDisk) checkpoint() error {
+	err := t.cache.flush()
+	if err != nil || t.wal == nil {
+		return err
+	}
+	return t.wal.reset()
+}
 
-	_, err = f.Read(data)
+// checkOpen returns an error if the file of the tree is not open.
+func (t *BTreeOnDisk) checkOpen() error {
+	if t.file == nil {
+		return fmt.Errorf("the b-tree in %v is not open", t.File)
+	}
+	return nil
+}
+
+// writeHeader writes the header of the tree to the start of the file
+// through the page cache. In copy-on-write mode the header is only
+// written when an operation commits.
+func (t *BTreeOnDisk) writeHeader() error {
+	err := t.checkOpen()
+	if err != nil || t.cow != nil {
+		return err
+	}
+
+	data, err := t.header.ToBinary()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	return t.cache.write(0, data)
+}
+
+// PageSize returns the number of bytes in a node page of the b-tree.
+func (t *BTreeOnDisk) PageSize() int {
+	if t.pageSize == 0 {
+		return DefaultPageSize
+	}
+	return t.pageSize
+}
+
+// MaxKeySize returns the length in bytes of the longest key the b-tree
+// accepts.
+func (t *BTreeOnDisk) MaxKeySize() int {
+	if t.maxKeySize == 0 {
+		return DefaultMaxKeySize
+	}
+	return t.maxKeySize
+}
+
+// InlineValueSize returns the length in bytes of the longest value the
+// b-tree stores next to its key.
+func (t *BTreeOnDisk) InlineValueSize() int {
+	return t.valueSize
+}
+
+// readOverflowPage reads a page of the value of an entry, for the
+// cursors of the tree.
+func (t *BTreeOnDisk) readOverflowPage(addr int64) (data []byte, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if s := t.committed(); s != nil {
+		return s.nodes().readOverflowPage(addr)
+	}
+	return t.readPage(addr)
+}
+
+// Compare compares two keys in the order of the b-tree.
+func (t *BTreeOnDisk) Compare(a []byte, b []byte) int {
+	if t.compare == nil {
+		return bytes.Compare(a, b)
 	}
+	return t.compare(a, b)
+}
+
+// KeyCount returns the number of indexes stored in the b-tree. Inserts
+// that are running at the same time are counted once they are done.
+func (t *BTreeOnDisk) KeyCount() uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.readHeader().KeyCount
+}
 
-	buf := bytes.NewBuffer(data)
-	bn := new(binaryNode)
+// Height returns the number of levels in the b-tree. A tree that only
+// has a root node has a height of one.
+func (t *BTreeOnDisk) Height() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return int(t.readHeader().Height)
+}
+
+// WriteNode writes the specified node to disk. It takes a single
+// parameter node. It uses the address inside the n *Node parameter
+// and confirms that it is a valid pointer.
+func (t *BTreeOnDisk) WriteNode(n *Node) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.writeNode(n)
+}
 
-	err = binary.Read(buf, binary.LittleEndian, bn)
+func (t *BTreeOnDisk) writeNode(n *Node) error {
+	return t.update(func() error {
+		data, err := n.ToBinary()
+		if err != nil {
+			return err
+		} else if t.cow != nil {
+			return t.writeDirtyNode(n.Address, data)
+		}
+		return t.writePage(n.Address, data)
+	})
+}
+
+// ReadNode reads the node from disk. The parameter takes a positive
+// integer and returns an error if the address is invalid. The function
+// returns two parameters n *Node which is the node and err of type
+// error.
+func (t *BTreeOnDisk) ReadNode(address int64) (n *Node, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if s := t.committed(); s != nil {
+		return s.readNode(address, s)
+	}
+
+	unlatch := latchNode(t.nodes(), address, false)
+	defer unlatch()
+	return t.readNode(address, t)
+}
+
+// readNode reads the node at address and binds it to owner, which is
+// either the tree or its unlocked view.
+func (t *BTreeOnDisk) readNode(address int64, owner BTree) (n *Node, err error) {
+	if t.cow != nil {
+		if data, ok := t.cow.dirty[address]; ok {
+			return nodeFromBinary(data, address, owner)
+		}
+	}
+
+	data, err := t.readPage(address)
 	if err != nil {
 		return nil, err
 	}
-
-	n = new(Node)
-	n.Pointers = bn.Pointers
-	n.Data = bn.Data
-	n.Address = address
-	n.tree = t
-	return n, nil
+	return nodeFromBinary(data, address, owner)
 }
 
-// RemoveNode removes a node from a b-tree structure by writing all of
-// the bytes in the section to zero. Then it adds the address of the
-// removed node to the cache of available addresses.
-func (t *BTreeOnDisk) RemoveNode(addr int64) (err error) {
-	if !IsValidAddress(addr) {
-		return fmt.Errorf("the provided address of %v is invalid", addr)
+// writePage writes a page of bytes at the given address through the
+// page cache. The first page holds the header and can only be written by
+// writeHeader. The bytes the page had before are saved if a snapshot
+// still reads them. A node is written holding its latch so that
+// snapshots do not read it half saved, see readVersion.
+func (t *BTreeOnDisk) writePage(address int64, data []byte) error {
+	if !IsValidAddress(address, t.PageSize()) || address == 0 {
+		return fmt.Errorf("Invalid address. Cannot write node at %v", address)
 	}
 
-	f, err := os.Open(t.File)
+	err := t.checkOpen()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	info, err := f.Stat()
+	size := atomic.LoadInt64(&t.size)
+	if t.versions != nil && address < size {
+		err = t.versions.preserve(address, func() ([]byte, error) {
+			return t.readPage(address)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = t.cache.write(address, data)
 	if err != nil {
 		return err
 	}
 
-	treeSize := info.Size()
-	if addr > treeSize {
-		return fmt.Errorf("The provided address is larger than the tree")
+	//While operations run in parallel only takeNodeAddress writes past
+	//the end, holding headerMu
+	if end := address + int64(t.PageSize()); end > size {
+		atomic.StoreInt64(&t.size, end)
+	}
+	return nil
+}
+
+// readPage reads the page of bytes at the given address through the page
+// cache. The bytes are shared with the cache and must not be modified.
+func (t *BTreeOnDisk) readPage(address int64) (data []byte, err error) {
+	if !IsValidAddress(address, t.PageSize()) || address == 0 {
+		return nil, fmt.Errorf("Invalid address. Cannot read node at %v", address)
 	}
 
-	blankNode, err := t.NewNode()
+	err = t.checkOpen()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	blankNode.Address = addr
-	t.AvailableAddresses = append(t.AvailableAddresses, addr)
-	return blankNode.Write()
+	return t.cache.read(address, t.PageSize())
+}
+
+// RemoveNode removes a node from a b-tree structure by marking its page
+// as free and putting it at the head of the free list stored in the
+// file. The address is also added to the cache of available addresses.
+func (t *BTreeOnDisk) RemoveNode(addr int64) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.removeNode(addr)
+}
+
+func (t *BTreeOnDisk) removeNode(addr int64) (err error) {
+	return t.update(func() error {
+		//An insert running in parallel hands back the overflow pages of
+		//its entry if it fails
+		t.headerMu.Lock()
+		defer t.headerMu.Unlock()
+
+		if !IsValidAddress(addr, t.PageSize()) || addr == 0 || addr == t.header.RootAddress {
+			return fmt.Errorf("the provided address of %v is invalid", addr)
+		}
+
+		if addr >= t.size {
+			return fmt.Errorf("The provided address is larger than the tree")
+		}
+
+		if t.addressIsAvailable(addr) {
+			return fmt.Errorf("the node at %v has already been removed", addr)
+		} else if t.cow != nil {
+			return t.removePage(addr)
+		}
+
+		return t.pushFreePage(addr)
+	})
 }
 
 // NewNode calls the standalone NewNode function and gives it the
 // calling binary tree.
 func (t *BTreeOnDisk) NewNode() (n *Node, err error) {
-	addr, err := t.NextNodeAddress()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	addr, err := t.nextNodeAddress()
 	if err != nil {
 		return nil, err
 	}
-	n, err = NewNode(t)
+	return t.newNode(addr, t)
+}
+
+// newNode creates a node at addr and binds it to owner, which is either
+// the tree or its unlocked view.
+func (t *BTreeOnDisk) newNode(addr int64, owner BTree) (n *Node, err error) {
+	n, err = NewNode(owner)
 	n.Address = addr
 	return n, err
 }
@@ -165,78 +660,535 @@ func (t *BTreeOnDisk) NewNode() (n *Node, err error) {
 // AddressIsAvailable checks the input address in the node and returns true
 // if the node at the specific address is empty and therefore available.
 func (t *BTreeOnDisk) AddressIsAvailable(addr int64) (available bool, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	t.headerMu.Lock()
+	defer t.headerMu.Unlock()
+	return t.addressIsAvailable(addr), nil
+}
+
+func (t *BTreeOnDisk) addressIsAvailable(addr int64) bool {
 	for _, e := range t.AvailableAddresses {
 		if e == addr {
-			return true, nil
+			return true
 		}
 	}
-	return false, nil
+	return false
 }
 
 // NextNodeAddress gets the next available address for a node for insertion.
-// This is after the last node or in a spot of a deleted node.
+// This is the head of the free list or, if the list is empty, after the
+// last node. An address taken from the free list is removed from it.
 func (t *BTreeOnDisk) NextNodeAddress() (int64, error) {
-	if len(t.AvailableAddresses) > 0 {
-		val := t.AvailableAddresses[0]
-		t.AvailableAddresses = t.AvailableAddresses[1:]
-		return val, nil
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.nextNodeAddress()
+}
+
+func (t *BTreeOnDisk) nextNodeAddress() (int64, error) {
+	if t.cow != nil {
+		err := t.checkOpen()
+		if err != nil {
+			return -1, err
+		}
+		return t.allocatePage(), nil
 	}
 
-	stat, err := os.Stat(t.File)
-	if os.IsNotExist(err) {
-		return 0, nil
-	} else if err != nil {
-		return -1, err
+	if len(t.AvailableAddresses) > 0 {
+		var addr int64
+		err := t.update(func() (err error) {
+			addr, err = t.popFreePage()
+			return err
+		})
+		return addr, err
 	}
 
-	addr := stat.Size()
-	if IsValidAddress(addr) {
+	addr := t.size
+	if IsValidAddress(addr, t.PageSize()) {
 		return addr, nil
 	}
 	return -1, fmt.Errorf("the address %v was invalid and indicates a corrupt b-tree structure", addr)
 }
 
+// takeNodeAddress is nextNodeAddress for the operations of the tree. An
+// address after the last page is taken by writing an empty page to it,
+// so operations running in parallel are never given the same address.
+// The page is overwritten before the operation is logged.
+func (t *BTreeOnDisk) takeNodeAddress() (addr int64, err error) {
+	t.headerMu.Lock()
+	defer t.headerMu.Unlock()
+
+	addr, err = t.nextNodeAddress()
+	if err != nil || t.cow != nil || addr < t.size {
+		return addr, err
+	}
+	return addr, t.update(func() error {
+		return t.writePage(addr, make([]byte, t.PageSize()))
+	})
+}
+
+// UpdateAvailableAddresess scans every page of the file for pages that
+// are marked as free but are missing from the free list and adds them to
+// it. These are left behind when an address is handed out by
+// NextNodeAddress but a node is never written to it. Opening a tree does
+// not need this scan as the free list is stored in the file. In
+// copy-on-write mode the free pages are found by a scan of the tree
+// instead.
 func (t *BTreeOnDisk) UpdateAvailableAddresess() (err error) {
-	stat, err := os.Stat(t.File)
-	if os.IsNotExist(err) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.update(func() error {
+		if t.cow != nil {
+			return t.findFreePages()
+		}
+
+		size := t.size
+		pageSize := int64(t.PageSize())
+		for i := pageSize; i < size; i = i + pageSize { //Iterate through every node after the header
+			if i == t.header.RootAddress {
+				continue
+			}
+
+			_, err := t.readFreePage(i)
+			if err != nil {
+				continue //Not a free page
+			}
+
+			if !t.addressIsAvailable(i) {
+				err = t.pushFreePage(i)
+				if err != nil {
+					return err
+				}
+			}
+		}
 		return nil
+	})
+}
+
+// Root reads the root node of the b-tree from the address recorded in
+// the header.
+func (t *BTreeOnDisk) Root() (n *Node, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if s := t.committed(); s != nil {
+		return s.readNode(s.header.RootAddress, s)
+	}
+
+	unlatch := latchNode(t.nodes(), t.header.RootAddress, false)
+	defer unlatch()
+	return t.readNode(t.header.RootAddress, t)
+}
+
+// QueryEntry finds the entry with the given key in the b-tree.
+func (t *BTreeOnDisk) QueryEntry(key []byte) (entry *Entry, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return queryEntry(t.readNodes(), key)
+}
+
+// QueryIndex is QueryEntry for a uint64 key.
+func (t *BTreeOnDisk) QueryIndex(key uint64) (index *Index, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return queryIndex(t.readNodes(), key)
+}
+
+// RangeEntries returns the entries with keys from lo to hi in the order
+// and with the bounds and limit given by opts. A nil lo or hi leaves that
+// end of the range open and a nil opts returns every entry in the range
+// in ascending order.
+func (t *BTreeOnDisk) RangeEntries(lo []byte, hi []byte, opts *RangeOptions) (entries []Entry, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return collectEntries(t.readNodes(), lo, hi, opts)
+}
+
+// RangeEntriesFunc streams the entries that RangeEntries would return to
+// fn one at a time instead of collecting them. The walk stops early if
+// fn returns false. The tree is locked for reading while fn runs, so fn
+// must not call any of its methods.
+func (t *BTreeOnDisk) RangeEntriesFunc(lo []byte, hi []byte, opts *RangeOptions, fn func(entry *Entry) bool) (err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return rangeEntries(t.readNodes(), lo, hi, opts, fn)
+}
+
+// Range is RangeEntries for uint64 keys. It returns an error if a key in
+// the range is not a uint64 key.
+func (t *BTreeOnDisk) Range(lo uint64, hi uint64, opts *RangeOptions) (indexes []Index, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return collectRange(t.readNodes(), lo, hi, opts)
+}
+
+// RangeFunc is RangeEntriesFunc for uint64 keys.
+func (t *BTreeOnDisk) RangeFunc(lo uint64, hi uint64, opts *RangeOptions, fn func(index *Index) bool) (err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return rangeIndexes(t.readNodes(), lo, hi, opts, fn)
+}
+
+// Rank returns the number of keys in the b-tree before key, which does
+// not have to be in the b-tree itself. It only descends the tree once.
+func (t *BTreeOnDisk) Rank(key uint64) (rank uint64, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return rankIndex(t.readNodes(), key)
+}
+
+// Select returns the index at position i of the b-tree in key order,
+// counting from zero, so Select(Rank(key)) is the index of key. It only
+// descends the tree once.
+func (t *BTreeOnDisk) Select(i uint64) (index *Index, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return selectIndex(t.readNodes(), i)
+}
+
+// CountRange returns the number of keys from lo to hi, both included,
+// without walking them.
+func (t *BTreeOnDisk) CountRange(lo uint64, hi uint64) (count uint64, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return countRange(t.readNodes(), lo, hi)
+}
+
+// InsertEntry inserts the entry into the b-tree and updates the key count
+// and height in the header. Inserts into different subtrees run in
+// parallel, see BTreeOnDisk. The insert is logged together with the
+// ones that run at the same time.
+func (t *BTreeOnDisk) InsertEntry(entry *Entry) (err error) {
+	return t.parallel(func() error {
+		return t.insertEntry(entry)
+	})
+}
+
+// InsertIndex is InsertEntry for an index with a uint64 key.
+func (t *BTreeOnDisk) InsertIndex(index *Index) (err error) {
+	return t.parallel(func() error {
+		return t.insertEntry(index.entry())
+	})
+}
+
+func (t *BTreeOnDisk) insert(entry *Entry) (err error) {
+	return t.update(func() error {
+		return t.insertEntry(entry)
+	})
+}
+
+// insertEntry inserts the entry holding the latches of the nodes it
+// works on and then updates the header, which the inserts running in
+// parallel change one at a time.
+func (t *BTreeOnDisk) insertEntry(entry *Entry) (err error) {
+	entry, err = storedEntry(t, entry)
+	if err != nil {
+		return err
+	}
+	err = writeOverflow(t.nodes(), entry)
+	if err != nil {
+		return err
+	}
+
+	n, unlatch, err := readRootLatched(t.nodes(), true)
+	if err != nil {
+		return firstError(err, freeOverflow(t.nodes(), entry))
+	}
+	grows := n.nodeIsFull()
+	err = n.insertLatched(entry, unlatch)
+	if err != nil {
+		err = firstError(err, freeOverflow(t.nodes(), entry))
+	}
+
+	t.headerMu.Lock()
+	defer t.headerMu.Unlock()
+	if err == nil {
+		t.header.KeyCount++
+	}
+	if grows && !n.nodeIsFull() { //The root was split
+		t.header.Height++
 	} else if err != nil {
 		return err
 	}
+	return firstError(err, t.writeHeader())
+}
 
-	size := stat.Size()
+// InsertBatch inserts the indexes in key order, descending the tree once
+// for every leaf they go into and writing the leaf once for all of them.
+// An index that can not be inserted, such as one with a key that is
+// already in the b-tree, does not stop the batch. Those indexes are
+// reported together in a *BatchError. The batch is logged as a single
+// operation.
+func (t *BTreeOnDisk) InsertBatch(indexes []Index) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.insertBatch(indexes)
+}
 
-	var i int64
-	for i = 0; i < size; i = i + 752 { //Iterate through every node
-		n, err := t.ReadNode(i)
-		if err != nil {
+func (t *BTreeOnDisk) insertBatch(indexes []Index) (err error) {
+	return t.update(func() error {
+		inserted, err := insertBatch(t.nodes(), indexes)
+		t.header.KeyCount += uint64(inserted)
+
+		height, herr := measureHeight(t.nodes())
+		if herr != nil {
+			return firstError(herr, err)
+		}
+		t.header.Height = uint32(height)
+		return firstError(t.writeHeader(), err)
+	})
+}
+
+// Update changes the pointer of key in place. Only the node that holds
+// the key is written. An error is returned if the key is not in the
+// b-tree. Updates run in parallel like inserts.
+func (t *BTreeOnDisk) Update(key uint64, pointer int64) (err error) {
+	return t.parallel(func() error {
+		return updateIndex(t.nodes(), key, pointer)
+	})
+}
+
+func (t *BTreeOnDisk) updateIndex(key uint64, pointer int64) (err error) {
+	return t.update(func() error {
+		return updateIndex(t.nodes(), key, pointer)
+	})
+}
+
+// Upsert changes the pointer of the key of index in place like Update,
+// or inserts the index if its key is not in the b-tree yet.
+func (t *BTreeOnDisk) Upsert(index *Index) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.upsert(index)
+}
+
+func (t *BTreeOnDisk) upsert(index *Index) (err error) {
+	return t.update(func() error {
+		found, err := updateEntry(t.nodes(), Uint64Key(index.Key), setPointer(index.Pointer))
+		if found || err != nil {
 			return err
 		}
+		return t.insert(index.entry())
+	})
+}
+
+// CompareAndSwap changes the pointer of key to new if it is old and
+// reports whether it did, atomically with respect to the other changes
+// of the b-tree. Only the node that holds the key is written, and only if
+// the pointer is changed. An error is returned if the key is not in the
+// b-tree. Compare-and-swaps run in parallel like inserts.
+func (t *BTreeOnDisk) CompareAndSwap(key uint64, old int64, new int64) (swapped bool, err error) {
+	err = t.parallel(func() (err error) {
+		swapped, err = compareAndSwap(t.nodes(), key, old, new)
+		return err
+	})
+	return swapped, err
+}
+
+func (t *BTreeOnDisk) compareAndSwap(key uint64, old int64, new int64) (swapped bool, err error) {
+	err = t.update(func() error {
+		swapped, err = compareAndSwap(t.nodes(), key, old, new)
+		return err
+	})
+	return swapped, err
+}
+
+// RemoveEntry removes the entry with the given key from the b-tree. Nodes
+// that are emptied along the way are merged away and their addresses are
+// made available for reuse. The key count and height in the header are
+// updated to match. The removal is logged as a single operation.
+func (t *BTreeOnDisk) RemoveEntry(key []byte) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.remove(key)
+}
+
+// Put inserts key into the b-tree with value stored next to it in its
+// node. A value longer than InlineValueSize bytes is stored in a chain
+// of overflow pages instead and the node only keeps where it is. An
+// error is returned if the key is already in the b-tree.
+func (t *BTreeOnDisk) Put(key []byte, value []byte) (err error) {
+	return t.InsertEntry(&Entry{Key: key, Value: value})
+}
+
+// Get returns the value stored with key by Put.
+func (t *BTreeOnDisk) Get(key []byte) (value []byte, err error) {
+	return entryValue(t.QueryEntry(key))
+}
+
+// RemoveIndex is RemoveEntry for a uint64 key.
+func (t *BTreeOnDisk) RemoveIndex(key uint64) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.remove(Uint64Key(key))
+}
 
-		isAvailable, err := t.AddressIsAvailable(i)
+func (t *BTreeOnDisk) remove(key []byte) (err error) {
+	return t.update(func() error {
+		n, err := t.nodes().Root()
 		if err != nil {
-			return fmt.Errorf("unable to check for available address")
+			return err
 		}
 
-		if n.IsEmpty() && !isAvailable {
-			t.AvailableAddresses = append(t.AvailableAddresses, i)
+		//Only a root with a single entry can be merged away
+		shrinks := !n.isLeaf() && n.size() == 1
+		err = removeEntry(t.nodes(), key)
+		if err == nil {
+			t.header.KeyCount--
 		}
-	}
-	return nil
+		if shrinks {
+			height, herr := measureHeight(t.nodes())
+			if herr != nil {
+				return firstError(err, herr)
+			}
+			t.header.Height = uint32(height)
+		} else if err != nil {
+			return err
+		}
+		return firstError(err, t.writeHeader())
+	})
 }
 
-func (t *BTreeOnDisk) QueryIndex(key uint64) (index *Index, err error) {
-	n, err := t.ReadNode(0)
-	if !n.IsEmpty() {
-		return n.query(key)
-	}
-	return nil, fmt.Errorf("the b-tree is empty")
+// The methods of the unlocked view bind the nodes they return to it.
+
+func (d *diskNodes) latch(addr int64) *sync.RWMutex {
+	return d.latches.latch(addr)
 }
 
-func (t *BTreeOnDisk) InsertIndex(index *Index) (err error) {
-	n, err := t.ReadNode(0)
+func (d *diskNodes) rootAddress() int64 {
+	return d.header.RootAddress
+}
+
+func (d *diskNodes) InsertEntry(entry *Entry) (err error) {
+	return d.tree().insert(entry)
+}
+
+func (d *diskNodes) QueryEntry(key []byte) (entry *Entry, err error) {
+	return queryEntry(d, key)
+}
+
+func (d *diskNodes) RangeEntries(lo []byte, hi []byte, opts *RangeOptions) (entries []Entry, err error) {
+	return collectEntries(d, lo, hi, opts)
+}
+
+func (d *diskNodes) RangeEntriesFunc(lo []byte, hi []byte, opts *RangeOptions, fn func(entry *Entry) bool) (err error) {
+	return rangeEntries(d, lo, hi, opts, fn)
+}
+
+func (d *diskNodes) RemoveEntry(key []byte) (err error) {
+	return d.tree().remove(key)
+}
+
+func (d *diskNodes) Put(key []byte, value []byte) (err error) {
+	return d.InsertEntry(&Entry{Key: key, Value: value})
+}
+
+func (d *diskNodes) Get(key []byte) (value []byte, err error) {
+	return entryValue(d.QueryEntry(key))
+}
+
+func (d *diskNodes) InsertIndex(index *Index) (err error) {
+	return d.tree().insert(index.entry())
+}
+
+func (d *diskNodes) InsertBatch(indexes []Index) (err error) {
+	return d.tree().insertBatch(indexes)
+}
+
+func (d *diskNodes) Update(key uint64, pointer int64) (err error) {
+	return d.tree().updateIndex(key, pointer)
+}
+
+func (d *diskNodes) Upsert(index *Index) (err error) {
+	return d.tree().upsert(index)
+}
+
+func (d *diskNodes) CompareAndSwap(key uint64, old int64, new int64) (swapped bool, err error) {
+	return d.tree().compareAndSwap(key, old, new)
+}
+
+func (d *diskNodes) QueryIndex(key uint64) (index *Index, err error) {
+	return queryIndex(d, key)
+}
+
+func (d *diskNodes) Range(lo uint64, hi uint64, opts *RangeOptions) (indexes []Index, err error) {
+	return collectRange(d, lo, hi, opts)
+}
+
+func (d *diskNodes) RangeFunc(lo uint64, hi uint64, opts *RangeOptions, fn func(index *Index) bool) (err error) {
+	return rangeIndexes(d, lo, hi, opts, fn)
+}
+
+func (d *diskNodes) Rank(key uint64) (rank uint64, err error) {
+	return rankIndex(d, key)
+}
+
+func (d *diskNodes) Select(i uint64) (index *Index, err error) {
+	return selectIndex(d, i)
+}
+
+func (d *diskNodes) CountRange(lo uint64, hi uint64) (count uint64, err error) {
+	return countRange(d, lo, hi)
+}
+
+func (d *diskNodes) RemoveIndex(key uint64) (err error) {
+	return d.tree().remove(Uint64Key(key))
+}
+
+func (d *diskNodes) WriteNode(n *Node) error {
+	return d.tree().writeNode(n)
+}
+
+func (d *diskNodes) NewNode() (n *Node, err error) {
+	addr, err := d.tree().takeNodeAddress()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return n.insert(index)
+	return d.tree().newNode(addr, d)
+}
+
+func (d *diskNodes) ReadNode(address int64) (n *Node, err error) {
+	return d.tree().readNode(address, d)
+}
+
+func (d *diskNodes) Root() (n *Node, err error) {
+	return d.tree().readNode(d.header.RootAddress, d)
+}
+
+func (d *diskNodes) RemoveNode(address int64) (err error) {
+	return d.tree().removeNode(address)
+}
+
+func (d *diskNodes) PageSize() int {
+	return d.tree().PageSize()
+}
+
+func (d *diskNodes) MaxKeySize() int {
+	return d.tree().MaxKeySize()
+}
+
+func (d *diskNodes) InlineValueSize() int {
+	return d.tree().InlineValueSize()
+}
+
+func (d *diskNodes) newOverflowPage() (addr int64, err error) {
+	return d.tree().takeNodeAddress()
+}
+
+// writeOverflowPage writes the page straight to its address, also in
+// copy-on-write mode. The page has just been handed out, so the last
+// committed tree does not use it.
+func (d *diskNodes) writeOverflowPage(addr int64, data []byte) error {
+	return d.tree().update(func() error {
+		return d.tree().writePage(addr, data)
+	})
+}
+
+func (d *diskNodes) readOverflowPage(addr int64) (data []byte, err error) {
+	return d.tree().readPage(addr)
+}
+
+func (d *diskNodes) Compare(a []byte, b []byte) int {
+	return d.tree().Compare(a, b)
 }
@@ -1,17 +1,16 @@
 package btree
 
 import (
-	"math/rand"
 	"os"
 	"path"
 	"testing"
-	"time"
 )
 
 func TestNewBTreeOnDisk(t *testing.T) {
 	dir := os.TempDir()
 	f := path.Join(dir, "test-new-btree.bin")
 	//f := "btree.bin"
+	removeFileIfExists(f)
 	tree, err := NewBTreeOnDisk(f)
 	if tree.File != f {
 		t.Errorf("The file %v is invalid", tree.File)
@@ -20,11 +19,274 @@ func TestNewBTreeOnDisk(t *testing.T) {
 	}
 }
 
+func TestCreateBTreeOnDiskExistingFile(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-create-existing.bin")
+	//f := "test-create-existing.bin"
+
+	_, err := CreateBTreeOnDisk(f, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = CreateBTreeOnDisk(f, false)
+	if err == nil {
+		t.Error("creating a b-tree over an existing file without overwrite did not return an error")
+	}
+}
+
+func TestOpenBTreeOnDisk(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-open-btree.bin")
+	//f := "test-open-btree.bin"
+
+	tree, err := CreateBTreeOnDisk(f, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	keys := []uint64{45, 12, 78, 3, 91}
+	for _, key := range keys {
+		err = tree.InsertIndex(NewIndex(key, int64(key)*10))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	spare, err := tree.NewNode()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = spare.Write()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = tree.RemoveNode(spare.Address)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, key := range keys {
+		index, err := tree.QueryIndex(key)
+		if err != nil {
+			t.Error(err)
+		} else if index.Pointer != int64(key)*10 {
+			t.Errorf("the reopened tree returned a pointer of %v for key %v, expected %v", index.Pointer, key, key*10)
+		}
+	}
+
+	if len(tree.AvailableAddresses) != 1 || tree.AvailableAddresses[0] != spare.Address {
+		t.Errorf("the reopened tree has available addresses of %v, expected [%v]", tree.AvailableAddresses, spare.Address)
+	}
+}
+
+func TestOpenBTreeOnDiskInvalidFile(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-open-invalid.bin")
+	//f := "test-open-invalid.bin"
+
+	err := os.WriteFile(f, []byte("this is not a b-tree"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = OpenBTreeOnDisk(f)
+	if err == nil {
+		t.Error("opening a file that is not a b-tree did not return an error")
+	}
+}
+
+func TestOpenBTreeOnDiskHeader(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-open-header.bin")
+	//f := "test-open-header.bin"
+
+	tree, err := CreateBTreeOnDisk(f, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if tree.KeyCount() != 0 || tree.Height() != 1 {
+		t.Errorf("a new tree has a key count of %v and a height of %v, expected 0 and 1", tree.KeyCount(), tree.Height())
+	}
+
+	for key := uint64(1); key <= 300; key++ {
+		err = tree.InsertIndex(NewIndex(key, 1))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	err = tree.InsertIndex(NewIndex(50, 1))
+	if err == nil {
+		t.Error("inserting a duplicate key did not return an error")
+	}
+
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if tree.KeyCount() != 300 || tree.Height() != 2 {
+		t.Errorf("the reopened tree has a key count of %v and a height of %v, expected 300 and 2", tree.KeyCount(), tree.Height())
+	}
+
+	for key := uint64(1); key <= 300; key++ {
+		err = tree.RemoveIndex(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if tree.KeyCount() != 0 || tree.Height() != 1 {
+		t.Errorf("the emptied tree has a key count of %v and a height of %v, expected 0 and 1", tree.KeyCount(), tree.Height())
+	}
+}
+
+func TestOpenBTreeOnDiskPageSize(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-open-page-size.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{PageSize: 4096})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	keys := randomKeys(2000)
+	for _, key := range keys {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	stat, err := os.Stat(f)
+	if err != nil {
+		t.Error(err)
+		return
+	} else if stat.Size()%4096 != 0 {
+		t.Errorf("the file size of %v is not a whole number of 4096 byte pages", stat.Size())
+	}
+
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	} else if tree.PageSize() != 4096 {
+		t.Errorf("the reopened tree has a page size of %v, expected 4096", tree.PageSize())
+	} else if tree.Height() != 2 {
+		t.Errorf("the tree has a height of %v with 2000 keys in 4096 byte pages, expected 2", tree.Height())
+	}
+
+	for _, key := range keys {
+		index, err := tree.QueryIndex(key)
+		if err != nil {
+			t.Error(err)
+		} else if index.Pointer != int64(key) {
+			t.Errorf("the reopened tree returned a pointer of %v for key %v", index.Pointer, key)
+		}
+	}
+}
+
+func TestOpenBTreeOnDiskBadHeader(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-open-bad-header.bin")
+	//f := "test-open-bad-header.bin"
+
+	err := os.WriteFile(f, make([]byte, 1504), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = OpenBTreeOnDisk(f)
+	if err == nil {
+		t.Error("opening a file without the b-tree magic number did not return an error")
+	}
+
+	tree, err := CreateBTreeOnDisk(f, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tree.header.Version = headerVersion + 1
+	err = tree.writeHeader()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = OpenBTreeOnDisk(f)
+	if err == nil {
+		t.Error("opening a file with an unknown format version did not return an error")
+	}
+
+	tree, err = CreateBTreeOnDisk(f, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tree.header.PageSize = MinPageSize - 1
+	err = tree.writeHeader()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = OpenBTreeOnDisk(f)
+	if err == nil {
+		t.Error("opening a file with an unsupported page size did not return an error")
+	}
+}
+
 func TestWriteNode(t *testing.T) {
 	dir := os.TempDir()
 	f := path.Join(dir, "test-btree-write.bin")
 	//f = "btree-write.bin"
-	dtree, err := NewBTreeOnDisk(f)
+	dtree, err := CreateBTreeOnDisk(f, true)
 	if err != nil {
 		t.Error(err)
 		return
@@ -37,7 +299,8 @@ func TestWriteNode(t *testing.T) {
 	}
 	n.Pointers[0] = 1
 	n.Pointers[1] = 2
-	n.Data[0] = Index{Key: 34, Pointer: 423}
+	n.Data[0] = entry(34, 423)
+	n.count = 1
 
 	err = n.Write()
 	if err != nil {
@@ -51,7 +314,7 @@ func TestRemoveNode(t *testing.T) {
 	//f := "test-remove-node.bin"
 
 	//Create test data in the tree
-	tree, err := NewBTreeOnDisk(f)
+	tree, err := CreateBTreeOnDisk(f, true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -60,23 +323,21 @@ func TestRemoveNode(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	n.Data[0] = Index{
-		Key:     1,
-		Pointer: 214,
-	}
+	n.Data[0] = entry(1, 214)
+	n.count = 1
 
 	err = n.Write()
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = tree.RemoveNode(0)
+	err = tree.RemoveNode(n.Address)
 	if err != nil {
 		t.Error(err)
 	}
 
-	if tree.AvailableAddresses[0] != 0 {
-		t.Error(err)
+	if tree.AvailableAddresses[0] != n.Address {
+		t.Errorf("the removed address of %v was not made available", n.Address)
 	}
 }
 
@@ -85,7 +346,7 @@ func TestReadNode(t *testing.T) {
 	//f := "test-read-node.bin"
 
 	//Create test data in the tree
-	tree, err := NewBTreeOnDisk(f)
+	tree, err := CreateBTreeOnDisk(f, true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -94,23 +355,24 @@ func TestReadNode(t *testing.T) {
 		t.Error(err)
 	}
 
-	n.Data[0] = Index{Key: 2, Pointer: 345}
+	n.Data[0] = entry(2, 345)
+	n.count = 1
 	n.Pointers[0] = 1
 	n.Pointers[1] = 2
 
-	n.Address = 0
+	n.Address = DefaultPageSize
 	err = n.Write()
 	if err != nil {
 		t.Error(err)
 	}
 
 	//Read and check input
-	rn, err := tree.ReadNode(0)
+	rn, err := tree.ReadNode(DefaultPageSize)
 	if err != nil {
 		t.Error(err)
-	} else if rn.Address != 0 {
-		t.Errorf("Invalid address %v given by the read function. Expected 0", rn.Address)
-	} else if rn.Data[0].Key != 2 && rn.Data[0].Pointer != 345 {
+	} else if rn.Address != DefaultPageSize {
+		t.Errorf("Invalid address %v given by the read function. Expected %v", rn.Address, DefaultPageSize)
+	} else if keyOf(rn.Data[0]) != 2 && rn.Data[0].Pointer != 345 {
 		t.Errorf("Invalid data %v given by the read function at index 0. Expected Key: 2 and Pointer 345", rn.Data[0])
 	} else if rn.Pointers[0] != 1 {
 		t.Errorf("Invalid pointer %v given by the read function. Expected 1", rn.Pointers[0])
@@ -124,7 +386,7 @@ func TestNextNodeAddress(t *testing.T) {
 	//f := "test-next-node-address.bin"
 
 	//Create test data in the tree
-	tree, err := NewBTreeOnDisk(f)
+	tree, err := CreateBTreeOnDisk(f, true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -143,8 +405,8 @@ func TestNextNodeAddress(t *testing.T) {
 		t.Error(err)
 	}
 
-	if addr != 752 {
-		t.Errorf("The address of %v is invalid. Expected 572", addr)
+	if addr != 3*DefaultPageSize {
+		t.Errorf("The address of %v is invalid. Expected %v", addr, 3*DefaultPageSize)
 	}
 }
 
@@ -152,15 +414,15 @@ func TestNextNodeAddressNewNodes(t *testing.T) {
 	f := path.Join(os.TempDir(), "test-next-node-address-new-node.bin")
 	//f := "test-next-node-address-new-node.bin"
 
-	tree, err := NewBTreeOnDisk(f)
+	tree, err := CreateBTreeOnDisk(f, true)
 	if err != nil {
 		t.Error(err)
 	}
 	n1, err := tree.NewNode()
 	if err != nil {
 		t.Error(err)
-	} else if n1.Address != 0 {
-		t.Errorf("Invalid address on first node. Expected 0 and got %v", n1.Address)
+	} else if n1.Address != 2*DefaultPageSize {
+		t.Errorf("Invalid address on first node. Expected %v and got %v", 2*DefaultPageSize, n1.Address)
 	}
 	err = n1.Write()
 	if err != nil {
@@ -170,8 +432,8 @@ func TestNextNodeAddressNewNodes(t *testing.T) {
 	n2, err := tree.NewNode()
 	if err != nil {
 		t.Error(err)
-	} else if n2.Address != 752 {
-		t.Errorf("Invalid address on first node. Expected 752 and got %v", n2.Address)
+	} else if n2.Address != 3*DefaultPageSize {
+		t.Errorf("Invalid address on second node. Expected %v and got %v", 3*DefaultPageSize, n2.Address)
 	}
 	err = n1.Write()
 	if err != nil {
@@ -199,7 +461,7 @@ func TestUpdateAvailableAddress(t *testing.T) {
 	//f := "test-update-available-addresess.bin"
 
 	//Create test data in the tree
-	tree, err := NewBTreeOnDisk(f)
+	tree, err := CreateBTreeOnDisk(f, true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -209,10 +471,8 @@ func TestUpdateAvailableAddress(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	nodes[0].Data[0] = Index{
-		Key:     23,
-		Pointer: 564,
-	}
+	nodes[0].Data[0] = entry(23, 564)
+	nodes[0].count = 1
 	nodes[0].Pointers[0] = 234
 	nodes[0].Pointers[0] = 345
 
@@ -220,10 +480,8 @@ func TestUpdateAvailableAddress(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	nodes[1].Data[0] = Index{
-		Key:     67,
-		Pointer: 563,
-	}
+	nodes[1].Data[0] = entry(67, 563)
+	nodes[1].count = 1
 	nodes[1].Pointers[0] = 23324
 	nodes[1].Pointers[0] = 3543
 
@@ -231,10 +489,8 @@ func TestUpdateAvailableAddress(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	nodes[2].Data[0] = Index{
-		Key:     23,
-		Pointer: 564,
-	}
+	nodes[2].Data[0] = entry(23, 564)
+	nodes[2].count = 1
 	nodes[2].Pointers[0] = 234
 	nodes[2].Pointers[0] = 345
 
@@ -262,114 +518,254 @@ func TestUpdateAvailableAddress(t *testing.T) {
 		t.Error(err)
 	}
 
-	if tree.AvailableAddresses[0] != 752 {
+	if tree.AvailableAddresses[0] != 3*DefaultPageSize {
 		t.Error("the UpdateAvailableAddress function has not found the empty node.")
 	}
 }
 
-func TestQueryIndex(t *testing.T) {
-	f := path.Join(os.TempDir(), "test-query-index.bin")
-	//f := "test-query-index.bin"
+func removeFileIfExists(fileName string) {
+	_, err := os.Stat(fileName)
+	if !os.IsNotExist(err) {
+		os.Remove(fileName)
+	}
+}
 
-	//Create test data in the tree
-	tree, err := NewBTreeOnDisk(f)
+func TestUpdateAvailableAddressLeakedPage(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-update-available-leaked.bin")
+
+	tree, err := CreateBTreeOnDisk(f, true)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	n1, err := tree.NewNode()
+	n, err := tree.NewNode()
 	if err != nil {
 		t.Error(err)
 		return
 	}
-	n1.Pointers[0] = 0
-	n1.Data[0] = Index{Key: 25, Pointer: 21}
-	n1.Pointers[1] = 0
-	n1.Data[1] = Index{Key: 34, Pointer: 22}
-	n1.Pointers[2] = 752
-	n1.Data[2] = Index{Key: 78, Pointer: 23}
-	n1.Pointers[3] = 0
-	err = n1.Write()
+	err = n.Write()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = tree.RemoveNode(n.Address)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	n2, err := tree.NewNode()
+	//Take the address off the free list without writing a node to it
+	addr, err := tree.NextNodeAddress()
 	if err != nil {
 		t.Error(err)
 		return
+	} else if addr != n.Address {
+		t.Errorf("the next node address was %v, expected the freed address %v", addr, n.Address)
 	}
-	n2.Pointers[0] = 0
-	n2.Data[0] = Index{Key: 35, Pointer: 24}
-	n2.Pointers[1] = 0
-	n2.Data[1] = Index{Key: 51, Pointer: 25}
-	n2.Pointers[2] = 0
-	n2.Data[2] = Index{Key: 62, Pointer: 26}
-	n2.Pointers[3] = 1504
-	err = n2.Write()
+
+	err = tree.UpdateAvailableAddresess()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(tree.AvailableAddresses) != 1 || tree.AvailableAddresses[0] != addr {
+		t.Errorf("the leaked page was not added back to the free list, available addresses are %v", tree.AvailableAddresses)
+	}
+}
+
+func TestFreeListReopen(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-free-list-reopen.bin")
+
+	tree, err := CreateBTreeOnDisk(f, true)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	n3, err := tree.NewNode()
+	keys := randomKeys(2000)
+	for _, key := range keys {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for _, key := range keys[:1500] {
+		err = tree.RemoveIndex(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	freed := append([]int64(nil), tree.AvailableAddresses...)
+	if len(freed) == 0 {
+		t.Error("no pages were freed after removing most of the keys")
+		return
+	}
+
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	stat, err := os.Stat(f)
 	if err != nil {
 		t.Error(err)
 		return
 	}
-	n3.Pointers[0] = 0
-	n3.Data[0] = Index{Key: 63, Pointer: 24}
-	n3.Pointers[1] = 0
-	n3.Data[1] = Index{Key: 64, Pointer: 25}
-	n3.Pointers[2] = 0
-	n3.Data[2] = Index{Key: 70, Pointer: 26} //The target value
-	n3.Pointers[3] = 0
-	err = n3.Write()
+	size := stat.Size()
+
+	tree, err = OpenBTreeOnDisk(f)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	index, err := tree.QueryIndex(70)
-	if index.Key != 70 {
-		t.Errorf("the query function returned the wrong key of %v. Expected 70", index.Key)
-	} else if index.Pointer != 26 {
-		t.Errorf("the query function returned the wrong pointer of %v. Expected 26", index.Pointer)
+	if len(tree.AvailableAddresses) != len(freed) {
+		t.Errorf("the reopened tree has %v free pages, expected %v", len(tree.AvailableAddresses), len(freed))
+		return
+	}
+	for i, addr := range freed {
+		if tree.AvailableAddresses[i] != addr {
+			t.Errorf("the free page at position %v is %v after reopening, expected %v", i, tree.AvailableAddresses[i], addr)
+		}
+	}
+
+	//Inserting the keys again should reuse the freed pages before growing
+	//the file
+	for _, key := range keys[:1500] {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	freeLeft := len(tree.AvailableAddresses)
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	stat, err = os.Stat(f)
+	if err != nil {
+		t.Error(err)
+	} else if freeLeft > 0 && stat.Size() != size {
+		t.Errorf("the file grew from %v to %v bytes while free pages were left", size, stat.Size())
 	}
 }
 
-func TestInsertTreeOnDiskIndex(t *testing.T) {
-	f := path.Join(os.TempDir(), "test-insert-index.bin")
-	//f := "test-insert-index.bin"
+func TestFlushAndClose(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-flush-close.bin")
 
-	removeFileIfExists(f)
+	tree, err := CreateBTreeOnDisk(f, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
 
-	//Create test data in the tree
-	tree, err := NewBTreeOnDisk(f)
+	keys := randomKeys(500)
+	for _, key := range keys {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err = tree.Flush()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	//A second handle sees everything that was flushed
+	other, err := OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if other.KeyCount() != uint64(len(keys)) {
+		t.Errorf("the flushed tree has a key count of %v, expected %v", other.KeyCount(), len(keys))
+	}
+	for _, key := range keys {
+		_, err = other.QueryIndex(key)
+		if err != nil {
+			t.Errorf("the key %v was not flushed: %v", key, err)
+			break
+		}
+	}
+	err = other.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.Close()
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	for i := 0; i < 100; i++ {
-		rand.Seed(time.Now().UTC().UnixNano())
-		key := uint64(rand.Uint32())<<32 + uint64(rand.Uint32())
+	_, err = tree.QueryIndex(keys[0])
+	if err == nil {
+		t.Error("querying a closed tree did not return an error")
+	}
+	err = tree.InsertIndex(NewIndex(1, 1))
+	if err == nil {
+		t.Error("inserting into a closed tree did not return an error")
+	}
+	err = tree.Flush()
+	if err == nil {
+		t.Error("flushing a closed tree did not return an error")
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-cache-size.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CacheSize: 8})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
 
-		index := Index{Key: key, Pointer: 45}
-		err = tree.InsertIndex(&index)
+	keys := randomKeys(2000)
+	for _, key := range keys {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
 		if err != nil {
 			t.Error(err)
 			return
 		}
 	}
 
-}
+	if tree.cache.lru.Len() > 8 {
+		t.Errorf("the cache holds %v pages, expected at most 8", tree.cache.lru.Len())
+	}
 
-func removeFileIfExists(fileName string) {
-	_, err := os.Stat(fileName)
-	if !os.IsNotExist(err) {
-		os.Remove(fileName)
+	//Once the path to a key is cached querying it again does not read the file
+	_, err = tree.QueryIndex(keys[0])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	misses := tree.cache.misses
+	for i := 0; i < 10; i++ {
+		_, err = tree.QueryIndex(keys[0])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if tree.cache.misses != misses {
+		t.Errorf("querying a cached key read %v pages from the file", tree.cache.misses-misses)
+	}
+
+	_, err = CreateBTreeOnDiskWithOptions(f, true, &Options{CacheSize: -1})
+	if err == nil {
+		t.Error("creating a tree with a negative cache size did not return an error")
 	}
 }
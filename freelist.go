@@ -0,0 +1,106 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// freePageMagic marks a page of a BTreeOnDisk file as free. It is far
+// larger than any node address so it can never be mistaken for the first
+// pointer of a node.
+const freePageMagic = 0x45455246_45474150 //"PAGEFREE"
+
+// freePage is the layout of a page on the free list. The free pages form
+// a linked list that starts at the free list head in the file header.
+type freePage struct {
+	Magic uint64
+	Next  int64
+}
+
+// ToBinary encodes the free page into a whole page of bytes.
+func (p *freePage) ToBinary(pageSize int) (result []byte, err error) {
+	buf := new(bytes.Buffer)
+	err = binary.Write(buf, binary.LittleEndian, p)
+	if err != nil {
+		return result, err
+	}
+
+	result = make([]byte, pageSize)
+	copy(result, buf.Bytes())
+	return result, nil
+}
+
+// readFreePage decodes the page at addr and returns an error if it is not
+// marked as free.
+func (t *BTreeOnDisk) readFreePage(addr int64) (p *freePage, err error) {
+	data, err := t.readPage(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p = new(freePage)
+	err = binary.Read(bytes.NewReader(data), binary.LittleEndian, p)
+	if err != nil {
+		return nil, err
+	} else if p.Magic != freePageMagic {
+		return nil, fmt.Errorf("the page at %v is not a free page", addr)
+	}
+	return p, nil
+}
+
+// pushFreePage marks the page at addr as free and puts it at the head of
+// the free list.
+func (t *BTreeOnDisk) pushFreePage(addr int64) (err error) {
+	p := freePage{Magic: freePageMagic, Next: t.header.FreeListHead}
+	data, err := p.ToBinary(t.PageSize())
+	if err != nil {
+		return err
+	}
+
+	err = t.writePage(addr, data)
+	if err != nil {
+		return err
+	}
+
+	t.header.FreeListHead = addr
+	t.AvailableAddresses = append([]int64{addr}, t.AvailableAddresses...)
+	return t.writeHeader()
+}
+
+// popFreePage takes the page at the head of the free list off it. The
+// caller is expected to overwrite the page with a node.
+func (t *BTreeOnDisk) popFreePage() (addr int64, err error) {
+	addr = t.AvailableAddresses[0]
+	t.AvailableAddresses = t.AvailableAddresses[1:]
+
+	t.header.FreeListHead = 0
+	if len(t.AvailableAddresses) > 0 {
+		t.header.FreeListHead = t.AvailableAddresses[0]
+	}
+	return addr, t.writeHeader()
+}
+
+// loadFreeList follows the free list from the head in the file header
+// and rebuilds the cache of available addresses from it.
+func (t *BTreeOnDisk) loadFreeList(fileSize int64) (err error) {
+	t.AvailableAddresses = nil
+
+	addr := t.header.FreeListHead
+	for addr != 0 {
+		if !IsValidAddress(addr, t.PageSize()) || addr >= fileSize {
+			return fmt.Errorf("the free list points to the invalid address %v", addr)
+		} else if int64(len(t.AvailableAddresses)) > fileSize/int64(t.PageSize()) {
+			return fmt.Errorf("the free list contains a loop")
+		}
+
+		p, err := t.readFreePage(addr)
+		if err != nil {
+			return err
+		}
+
+		t.AvailableAddresses = append(t.AvailableAddresses, addr)
+		addr = p.Next
+	}
+	return nil
+}
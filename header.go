@@ -0,0 +1,122 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// headerMagic marks the start of every b-tree file.
+var headerMagic = [8]byte{'G', 'O', 'B', 'T', 'R', 'E', 'E', 0}
+
+// headerVersion is the version of the file format written by this package.
+// Version 2 stores keys of any length in the nodes, version 3 a value with
+// every key and version 4 the number of entries under every subnode
+// pointer.
+const headerVersion = 4
+
+// headerFlagCopyOnWrite marks a tree that is updated in copy-on-write mode.
+const headerFlagCopyOnWrite = 1 << 0
+
+// fileHeader is the first page of a b-tree file. It identifies the file
+// as a b-tree and records where the tree starts and how big it is. The
+// header takes up a whole node sized page so that nodes stay aligned.
+type fileHeader struct {
+	Magic        [8]byte
+	Version      uint32
+	PageSize     uint32
+	KeyCount     uint64
+	Height       uint32
+	RootAddress  int64
+	FreeListHead int64
+	Flags        uint32
+	MaxKeySize   uint32
+	ValueSize    uint32 //The inline value size
+}
+
+// newFileHeader returns the header of a new, empty tree with the given
+// page size, maximum key size and inline value size. The root node takes
+// up the page after the header.
+func newFileHeader(pageSize int, maxKeySize int, inlineValueSize int) fileHeader {
+	return fileHeader{
+		Magic:       headerMagic,
+		Version:     headerVersion,
+		PageSize:    uint32(pageSize),
+		MaxKeySize:  uint32(maxKeySize),
+		ValueSize:   uint32(inlineValueSize),
+		Height:      1,
+		RootAddress: int64(pageSize),
+	}
+}
+
+// ToBinary encodes the header into a page of bytes padded out to the
+// page size.
+func (h *fileHeader) ToBinary() (result []byte, err error) {
+	buf := new(bytes.Buffer)
+	err = binary.Write(buf, binary.LittleEndian, h)
+	if err != nil {
+		return result, err
+	}
+
+	result = make([]byte, h.PageSize)
+	copy(result, buf.Bytes())
+	return result, nil
+}
+
+// readFileHeader reads the header at the start of file and checks that
+// it describes a b-tree this package is able to open.
+func readFileHeader(file string) (h fileHeader, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return h, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return h, err
+	}
+
+	data := make([]byte, binary.Size(h))
+	_, err = f.ReadAt(data, 0)
+	if err != nil {
+		return h, fmt.Errorf("unable to read the header of %v: %v", file, err)
+	}
+
+	err = binary.Read(bytes.NewReader(data), binary.LittleEndian, &h)
+	if err != nil {
+		return h, err
+	}
+
+	err = h.validate(stat.Size())
+	if err != nil {
+		return h, fmt.Errorf("the file %v is not a valid b-tree: %v", file, err)
+	}
+	return h, nil
+}
+
+// validate checks the header against the format this package writes and
+// the size of the file it was read from.
+func (h *fileHeader) validate(fileSize int64) error {
+	if h.Magic != headerMagic {
+		return fmt.Errorf("the header does not start with the b-tree magic number")
+	} else if h.Version != headerVersion {
+		return fmt.Errorf("the file format version %v is not supported, expected version %v", h.Version, headerVersion)
+	} else if h.PageSize < MinPageSize || h.PageSize > MaxPageSize {
+		return fmt.Errorf("the page size of %v is not between %v and %v", h.PageSize, MinPageSize, MaxPageSize)
+	} else if err := checkEntrySize(int(h.PageSize), int(h.MaxKeySize), int(h.ValueSize)); err != nil {
+		return err
+	} else if fileSize%int64(h.PageSize) != 0 {
+		return fmt.Errorf("the file size of %v is not a whole number of pages", fileSize)
+	} else if h.Height == 0 {
+		return fmt.Errorf("the tree height is zero")
+	} else if h.RootAddress == 0 || !IsValidAddress(h.RootAddress, int(h.PageSize)) || h.RootAddress >= fileSize {
+		return fmt.Errorf("the root address of %v is invalid", h.RootAddress)
+	} else if h.FreeListHead != 0 && (!IsValidAddress(h.FreeListHead, int(h.PageSize)) || h.FreeListHead >= fileSize) {
+		return fmt.Errorf("the free list address of %v is invalid", h.FreeListHead)
+	} else if h.Flags&^headerFlagCopyOnWrite != 0 {
+		return fmt.Errorf("the flags %#x are not supported", h.Flags)
+	}
+	return nil
+}
@@ -1,5 +1,42 @@
 package btree
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Entry is a key and the pointer and value stored with it in the b-tree.
+// Keys are compared byte by byte, a key that is the start of a longer key
+// comes before it. A key can be up to the MaxKeySize of the tree long.
+// Values up to the InlineValueSize of the tree are stored in the node
+// next to their key, longer ones in overflow pages.
+type Entry struct {
+	Key     []byte
+	Pointer int64
+	Value   []byte
+
+	overflow overflowRef //Set instead of Value while the value is in overflow pages
+}
+
+// NewEntry creates a new key/pointer entry for the b-tree structure
+func NewEntry(key []byte, pointer int64) *Entry {
+	return &Entry{
+		Key:     key,
+		Pointer: pointer,
+	}
+}
+
+// index converts the entry into an Index, which only works if its key is
+// a uint64 key.
+func (e *Entry) index() (index *Index, err error) {
+	if len(e.Key) != uint64KeySize {
+		return nil, fmt.Errorf("the key %x is not a uint64 key", e.Key)
+	}
+	return NewIndex(binary.BigEndian.Uint64(e.Key), e.Pointer), nil
+}
+
+// Index is the entry of a tree that is used with uint64 keys. Its key is
+// stored as the eight bytes of Uint64Key.
 type Index struct {
 	Key     uint64
 	Pointer int64
@@ -14,9 +51,18 @@ func NewIndex(key uint64, pointer int64) *Index {
 	return &i
 }
 
-func (i *Index) isEmptyOrDefault() bool {
-	if i.Key == 0 && i.Pointer == 0 {
-		return true
-	}
-	return false
+// entry converts the index into the entry it is stored as.
+func (i *Index) entry() *Entry {
+	return NewEntry(Uint64Key(i.Key), i.Pointer)
+}
+
+// uint64KeySize is the length of a uint64 key.
+const uint64KeySize = 8
+
+// Uint64Key returns the key a uint64 is stored under. The bytes are big
+// endian so that the keys sort in the same order as the numbers.
+func Uint64Key(key uint64) []byte {
+	b := make([]byte, uint64KeySize)
+	binary.BigEndian.PutUint64(b, key)
+	return b
 }
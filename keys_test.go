@@ -0,0 +1,213 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+// randomStrings returns count different keys of random lengths up to max
+// bytes. Some of them are the start of others.
+func randomStrings(count int, max int) [][]byte {
+	seen := make(map[string]bool)
+	var keys [][]byte
+	for len(keys) < count {
+		key := make([]byte, rand.Intn(max)+1)
+		for i := range key {
+			key[i] = byte('a' + rand.Intn(4))
+		}
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func sortedStrings(keys [][]byte) [][]byte {
+	sorted := append([][]byte(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	return sorted
+}
+
+func TestByteKeys(t *testing.T) {
+	forEachBackendWithOptions(t, "test-byte-keys.bin", &Options{MaxKeySize: 24}, func(t *testing.T, tree BTree) {
+		keys := randomStrings(1000, 24)
+		keys = append(keys, []byte{})
+		for i, key := range keys {
+			err := tree.InsertEntry(NewEntry(key, int64(i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		_, err := checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+		for i, key := range keys {
+			entry, err := tree.QueryEntry(key)
+			if err != nil {
+				t.Errorf("the key %q: %v", key, err)
+			} else if entry.Pointer != int64(i) || !bytes.Equal(entry.Key, key) {
+				t.Errorf("the key %q returned %q with a pointer of %v, expected %v", key, entry.Key, entry.Pointer, i)
+			}
+		}
+
+		entries, err := tree.RangeEntries(nil, nil, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		sorted := sortedStrings(keys)
+		if len(entries) != len(sorted) {
+			t.Errorf("the range over every key returned %v entries, expected %v", len(entries), len(sorted))
+			return
+		}
+		for i, entry := range entries {
+			if !bytes.Equal(entry.Key, sorted[i]) {
+				t.Errorf("the range returned %q at position %v, expected %q", entry.Key, i, sorted[i])
+				return
+			}
+		}
+
+		for _, key := range keys[:len(keys)/2] {
+			err = tree.RemoveEntry(key)
+			if err != nil {
+				t.Errorf("removing the key %q: %v", key, err)
+			}
+		}
+		for i, key := range keys {
+			_, err = tree.QueryEntry(key)
+			if i < len(keys)/2 && err == nil {
+				t.Errorf("the removed key %q was found", key)
+			} else if i >= len(keys)/2 && err != nil {
+				t.Errorf("the key %q: %v", key, err)
+			}
+		}
+		_, err = checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestByteKeysTooLong(t *testing.T) {
+	forEachBackendWithOptions(t, "test-byte-keys-long.bin", &Options{MaxKeySize: 16}, func(t *testing.T, tree BTree) {
+		if tree.MaxKeySize() != 16 {
+			t.Errorf("the tree has a maximum key size of %v, expected 16", tree.MaxKeySize())
+		}
+
+		err := tree.InsertEntry(NewEntry(bytes.Repeat([]byte("k"), 16), 1))
+		if err != nil {
+			t.Error(err)
+		}
+		err = tree.InsertEntry(NewEntry(bytes.Repeat([]byte("k"), 17), 2))
+		if err == nil {
+			t.Error("a key longer than the maximum key size was inserted")
+		}
+	})
+
+	for _, opts := range []*Options{
+		{MaxKeySize: -1},
+		{MaxKeySize: DefaultPageSize},
+		{PageSize: MinPageSize, MaxKeySize: MinPageSize / 2},
+	} {
+		_, err := NewBTreeInMemWithOptions(0, opts)
+		if err == nil {
+			t.Errorf("a tree was created with a maximum key size of %v in %v byte pages", opts.MaxKeySize, opts.PageSize)
+		}
+	}
+}
+
+func TestRangeEntriesBounds(t *testing.T) {
+	forEachBackendWithOptions(t, "test-range-entries.bin", &Options{MaxKeySize: 8}, func(t *testing.T, tree BTree) {
+		for i, key := range []string{"a", "ab", "abc", "b", "ba", "c"} {
+			err := tree.InsertEntry(NewEntry([]byte(key), int64(i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		tests := []struct {
+			lo       []byte
+			hi       []byte
+			opts     *RangeOptions
+			expected string
+		}{
+			{nil, nil, nil, "a ab abc b ba c"},
+			{[]byte("ab"), nil, nil, "ab abc b ba c"},
+			{nil, []byte("b"), nil, "a ab abc b"},
+			{[]byte("ab"), []byte("b"), &RangeOptions{ExcludeLo: true, ExcludeHi: true}, "abc"},
+			{[]byte("aa"), []byte("bz"), &RangeOptions{Reverse: true, Limit: 3}, "ba b abc"},
+			{[]byte("b"), []byte("a"), nil, ""},
+		}
+		for _, test := range tests {
+			var keys []string
+			err := tree.RangeEntriesFunc(test.lo, test.hi, test.opts, func(entry *Entry) bool {
+				keys = append(keys, string(entry.Key))
+				return true
+			})
+			if err != nil {
+				t.Error(err)
+			} else if got := fmt.Sprint(keys); got != "["+test.expected+"]" {
+				t.Errorf("the range %q to %q with %+v returned %v, expected [%v]", test.lo, test.hi, test.opts, got, test.expected)
+			}
+		}
+
+		//The uint64 range can not return keys that are not uint64 keys
+		_, err := tree.Range(0, maxInt64, nil)
+		if err == nil {
+			t.Error("a uint64 range returned keys that are not uint64 keys")
+		}
+	})
+}
+
+func TestOpenBTreeOnDiskMaxKeySize(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-open-max-key-size.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{MaxKeySize: 40})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	keys := randomStrings(500, 40)
+	for i, key := range keys {
+		err = tree.InsertEntry(NewEntry(key, int64(i)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+	if tree.MaxKeySize() != 40 {
+		t.Errorf("the reopened tree has a maximum key size of %v, expected 40", tree.MaxKeySize())
+	}
+	for i, key := range keys {
+		entry, err := tree.QueryEntry(key)
+		if err != nil {
+			t.Errorf("the key %q: %v", key, err)
+		} else if entry.Pointer != int64(i) {
+			t.Errorf("the reopened tree returned a pointer of %v for the key %q, expected %v", entry.Pointer, key, i)
+		}
+	}
+}
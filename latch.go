@@ -0,0 +1,90 @@
+package btree
+
+import "sync"
+
+// latcher is implemented by trees that let several operations read and
+// change their nodes at the same time. Every node has a latch. The
+// operations take the latches from the root down and let go of the latch
+// of a node as soon as they hold the latch of the next node and know that
+// nothing below it can change the node any more. Inserts can do so
+// straight away because full nodes are split on the way down, so they
+// only ever hold the latches of a node and its child and inserts into
+// different subtrees run in parallel. A node counts the new entry before
+// it is let go, an insert that then finds its key in the tree takes the
+// counts back, see uncountLatched. Batches of inserts and the inserts
+// that take their counts back hold the latches of their whole path
+// instead, see insertRunLatched.
+//
+// Trees that do not implement latcher only let one operation change them
+// at a time and their nodes are not latched. A BTreeOnDisk latches its
+// nodes but only runs operations in parallel outside of copy-on-write
+// mode, see BTreeOnDisk.parallel.
+type latcher interface {
+	latch(addr int64) *sync.RWMutex
+	rootAddress() int64
+}
+
+// countWriter is implemented by trees that can write the count under a
+// single pointer of a node without writing the rest of the node. Every
+// insert raises a count in the root, so it holds the latch of the root
+// for as short as it can, see Node.writeCount.
+type countWriter interface {
+	writeCount(n *Node, x int) error
+}
+
+// latchTable holds the latches of the nodes of a tree. A latch is made
+// the first time its node is latched and kept for as long as the tree.
+type latchTable struct {
+	latches sync.Map //int64 to *sync.RWMutex
+}
+
+func (l *latchTable) latch(addr int64) *sync.RWMutex {
+	if m, ok := l.latches.Load(addr); ok {
+		return m.(*sync.RWMutex)
+	}
+	m, _ := l.latches.LoadOrStore(addr, new(sync.RWMutex))
+	return m.(*sync.RWMutex)
+}
+
+// noLatch is the function that releases the latch of a node in a tree
+// that does not latch its nodes.
+func noLatch() {}
+
+// latchNode takes the latch of the node at addr, exclusively if
+// exclusive is true, and returns the function that releases it.
+func latchNode(t BTree, addr int64, exclusive bool) (unlatch func()) {
+	l, ok := t.(latcher)
+	if !ok {
+		return noLatch
+	}
+
+	m := l.latch(addr)
+	if exclusive {
+		m.Lock()
+		return m.Unlock
+	}
+	m.RLock()
+	return m.RUnlock
+}
+
+// readLatched latches the node at addr and then reads it, so the node
+// can not change until unlatch is called.
+func readLatched(t BTree, addr int64, exclusive bool) (n *Node, unlatch func(), err error) {
+	unlatch = latchNode(t, addr, exclusive)
+	n, err = t.ReadNode(addr)
+	if err != nil {
+		unlatch()
+		return nil, nil, err
+	}
+	return n, unlatch, nil
+}
+
+// readRootLatched is readLatched for the root of the tree.
+func readRootLatched(t BTree, exclusive bool) (n *Node, unlatch func(), err error) {
+	l, ok := t.(latcher)
+	if !ok {
+		n, err = t.Root()
+		return n, noLatch, err
+	}
+	return readLatched(t, l.rootAddress(), exclusive)
+}
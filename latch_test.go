@@ -0,0 +1,170 @@
+package btree
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// nodeLatch returns the latch of the node at addr of a tree of either
+// backend.
+func nodeLatch(tree BTree, addr int64) *sync.RWMutex {
+	switch tree := tree.(type) {
+	case *BTreeInMemory:
+		return tree.latches.latch(addr)
+	case *BTreeOnDisk:
+		return tree.latches.latch(addr)
+	}
+	return nil
+}
+
+// waitForKey waits for key to show up in the tree and reports whether it
+// did within five seconds.
+func waitForKey(tree BTree, key uint64) bool {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		_, err := tree.QueryIndex(key)
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLatchIndependentSubtrees(t *testing.T) {
+	//Small pages so that a few hundred keys make for a deep tree
+	forEachBackendWithOptions(t, "test-latch-subtrees.bin", &Options{PageSize: 752}, func(t *testing.T, tree BTree) {
+		for key := uint64(1); key <= 300; key += 3 {
+			err := tree.InsertIndex(NewIndex(key, int64(key)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		root, err := tree.Root()
+		if err != nil {
+			t.Fatal(err)
+		} else if root.isLeaf() {
+			t.Fatal("the tree did not grow past its root")
+		}
+		first := root.Pointers[0]
+		if keyOf(root.Data[0]) < 2 || keyOf(root.Data[root.size()-1]) > 296 {
+			t.Fatalf("the keys 2 and 296 are not in the first and last subtrees of the root %v", root.Data)
+		}
+
+		insert := func(key uint64) chan error {
+			done := make(chan error, 1)
+			go func() {
+				done <- tree.InsertIndex(NewIndex(key, int64(key)))
+			}()
+			return done
+		}
+
+		//Hold the latch of the first subtree as if another insert was in it
+		latch := nodeLatch(tree, first)
+		latch.Lock()
+
+		//An insert into the last subtree does not wait for it
+		select {
+		case err = <-insert(296):
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("an insert into another subtree waited for the latched one")
+		}
+
+		//An insert into the latched subtree does
+		blocked := insert(2)
+		select {
+		case err := <-blocked:
+			t.Error("an insert into the latched subtree did not wait for the latch")
+			blocked <- err
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		latch.Unlock()
+		err = <-blocked
+		if err != nil {
+			t.Error(err)
+		}
+
+		for _, key := range []uint64{2, 296} {
+			_, err = tree.QueryIndex(key)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestLatchWaitingInsertReleasesRoot(t *testing.T) {
+	//Small pages so that a few hundred keys make for a deep tree
+	forEachBackendWithOptions(t, "test-latch-release-root.bin", &Options{PageSize: 752}, func(t *testing.T, tree BTree) {
+		for key := uint64(1); key <= 3000; key += 3 {
+			err := tree.InsertIndex(NewIndex(key, int64(key)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		root, err := tree.Root()
+		if err != nil {
+			t.Fatal(err)
+		}
+		child, err := tree.ReadNode(root.Pointers[0])
+		if err != nil {
+			t.Fatal(err)
+		} else if child.isLeaf() {
+			t.Fatal("the tree did not grow past two levels")
+		} else if keyOf(root.Data[root.size()-1]) > 2996 {
+			t.Fatalf("the key 2996 is not in the last subtree of the root %v", root.Data)
+		}
+
+		insert := func(key uint64) chan error {
+			done := make(chan error, 1)
+			go func() {
+				done <- tree.InsertIndex(NewIndex(key, int64(key)))
+			}()
+			return done
+		}
+
+		//Hold the latch of the first leaf so an insert into it waits there
+		latch := nodeLatch(tree, child.Pointers[0])
+		latch.Lock()
+		blocked := insert(2)
+		select {
+		case err := <-blocked:
+			t.Error("an insert into the latched leaf did not wait for the latch")
+			blocked <- err
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		//The waiting insert only holds the latch of the parent of the leaf,
+		//so an insert into another subtree of the root does not wait for
+		//it. An insert into a BTreeOnDisk only returns once it is logged
+		//together with the waiting one, so it is looked up instead.
+		other := insert(2996)
+		if !waitForKey(tree, 2996) {
+			t.Error("an insert into another subtree waited for the insert into the latched leaf")
+		}
+
+		latch.Unlock()
+		for _, done := range []chan error{blocked, other} {
+			err = <-done
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		for _, key := range []uint64{2, 2996} {
+			_, err = tree.QueryIndex(key)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		_, err = checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -3,29 +3,688 @@ package btree
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
 )
 
+// memHeaderSize is the number of bytes at the start of an in-memory tree
+// that hold its size before the first node.
+const memHeaderSize = 8
+
 // BTreeInMemory is a structure that references a b-tree structure that
-// resides in memory instead of on disk.
+// resides in memory instead of on disk. The nodes are kept in a single
+// block of bytes laid out the same way as the nodes of a BTreeOnDisk
+// file, addresses are offsets into that block after its header.
+//
+// A BTreeInMemory is safe for concurrent use by multiple goroutines in
+// the same way as a BTreeOnDisk, except that inserts run in parallel with
+// each other and with reads. They latch the nodes they work on, see
+// latcher. Removes still run on their own.
+//
+// Nodes are changed in place, so the bytes of a page are saved before it
+// is written for as long as a snapshot still reads them, see
+// pageVersions. Pages inside the block are written holding the latch of
+// their node, which keeps others from reading them meanwhile, so inserts
+// only hold blockMu for writing while the block grows.
 type BTreeInMemory struct {
-	data []byte
+	mu                 sync.RWMutex //Held for writing by everything but reads and inserts
+	latches            latchTable
+	blockMu            sync.RWMutex //Held for writing while data grows or a free address is taken, for reading while a page is read or written in place
+	data               []byte
+	pageSize           int
+	maxKeySize         int
+	valueSize          int //The inline value size
+	compare            func(a []byte, b []byte) int
+	keyCount           uint64 //Changed atomically by the inserts running in parallel
+	versions           *pageVersions
+	AvailableAddresses []int64
+}
+
+// memNodes is the unlocked view of a BTreeInMemory, see diskNodes.
+type memNodes BTreeInMemory
+
+func (t *BTreeInMemory) nodes() *memNodes {
+	return (*memNodes)(t)
 }
 
+func (m *memNodes) tree() *BTreeInMemory {
+	return (*BTreeInMemory)(m)
+}
+
+// NewBTreeInMem creates a new, empty b-tree in memory. The size is the
+// number of nodes to reserve room for up front, the tree grows past it
+// as needed.
 func NewBTreeInMem(size uint64) (*BTreeInMemory, error) {
+	return NewBTreeInMemWithOptions(size, nil)
+}
+
+// NewBTreeInMemWithOptions works like NewBTreeInMem but creates the tree
+// with the given options.
+func NewBTreeInMemWithOptions(size uint64, opts *Options) (*BTreeInMemory, error) {
+	pageSize, err := opts.pageSize()
+	if err != nil {
+		return nil, err
+	}
+	maxKeySize, valueSize, err := opts.entrySize(pageSize)
+	if err != nil {
+		return nil, err
+	}
+
 	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.LittleEndian, size)
+	err = binary.Write(buf, binary.LittleEndian, size)
 	if err != nil {
 		return nil, err
 	}
 
 	tree := new(BTreeInMemory)
+	tree.pageSize = pageSize
+	tree.maxKeySize = maxKeySize
+	tree.valueSize = valueSize
+	tree.compare = opts.compare()
+	tree.versions = newPageVersions()
+	tree.data = make([]byte, 0, memHeaderSize+size*uint64(pageSize))
 	tree.data = appendRangeBytes(tree.data, buf.Bytes())
+
+	n, err := NewNode(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	err = n.Write()
+	if err != nil {
+		return nil, err
+	}
 	return tree, nil
 }
 
+// WriteNode writes the specified node into the tree's block of memory,
+// growing the block if the node is the next one after the last node.
+func (t *BTreeInMemory) WriteNode(n *Node) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.writeNode(n)
+}
+
+func (t *BTreeInMemory) writeNode(n *Node) error {
+	if !IsValidAddress(n.Address, t.PageSize()) {
+		return fmt.Errorf("Invalid address. Cannot write node at %v", n.Address)
+	}
+
+	data, err := n.ToBinary()
+	if err != nil {
+		return err
+	}
+	return t.writePage(n.Address, data)
+}
+
+// writePage writes a page of bytes at address, growing the block if the
+// page is the next one after the last page. The bytes the page had
+// before are saved if a snapshot still reads them.
+func (t *BTreeInMemory) writePage(address int64, data []byte) error {
+	write := func(page []byte) { copy(page, data) }
+
+	t.blockMu.RLock()
+	if t.hasPage(address) {
+		defer t.blockMu.RUnlock()
+		return t.changePage(address, write)
+	}
+	t.blockMu.RUnlock()
+
+	t.blockMu.Lock()
+	defer t.blockMu.Unlock()
+
+	offset := memHeaderSize + address
+	end := int64(len(t.data))
+	if offset > end {
+		return fmt.Errorf("cannot write the node at %v past the end of the tree", address)
+	} else if offset == end {
+		t.data = appendRangeBytes(t.data, data)
+		return nil
+	}
+	return t.changePage(address, write)
+}
+
+// hasPage returns true if the block holds the whole page at address.
+// blockMu has to be held.
+func (t *BTreeInMemory) hasPage(address int64) bool {
+	return address >= 0 && memHeaderSize+address+int64(t.PageSize()) <= int64(len(t.data))
+}
+
+// changePage saves the bytes of the page at address if a snapshot still
+// reads them and then hands the page to change, which changes it in
+// place. blockMu has to be held and the page has to be in the block.
+func (t *BTreeInMemory) changePage(address int64, change func(page []byte)) error {
+	err := t.versions.preserve(address, func() ([]byte, error) {
+		return t.page(address)
+	})
+	if err != nil {
+		return err
+	}
+
+	offset := memHeaderSize + address
+	change(t.data[offset : offset+int64(t.PageSize())])
+	return nil
+}
+
+// ReadNode reads the node at the given address out of the tree's block
+// of memory. The node is a copy, changes to it are only seen by the tree
+// once it is written back.
+func (t *BTreeInMemory) ReadNode(address int64) (n *Node, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	unlatch := latchNode(t.nodes(), address, false)
+	defer unlatch()
+	return t.readNode(address, t)
+}
+
+// readNode reads the node at address and binds it to owner, which is
+// either the tree or its unlocked view.
+func (t *BTreeInMemory) readNode(address int64, owner BTree) (n *Node, err error) {
+	if !IsValidAddress(address, t.PageSize()) {
+		return nil, fmt.Errorf("Invalid address. Cannot read node at %v", address)
+	}
+
+	t.blockMu.RLock()
+	data, err := t.page(address)
+	t.blockMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return nodeFromBinary(data, address, owner)
+}
+
+// page returns a copy of the bytes of the page at address. blockMu has
+// to be held.
+func (t *BTreeInMemory) page(address int64) (data []byte, err error) {
+	offset := memHeaderSize + address
+	end := offset + int64(t.PageSize())
+	if end > int64(len(t.data)) {
+		return nil, fmt.Errorf("there is no node at %v in the tree", address)
+	}
+	return append([]byte(nil), t.data[offset:end]...), nil
+}
+
+// RemoveNode removes a node from the b-tree by setting all of its bytes
+// to zero and adds its address to the cache of available addresses. Like
+// BTreeOnDisk it refuses to remove the root or a node that was already
+// removed.
+func (t *BTreeInMemory) RemoveNode(addr int64) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.removeNode(addr)
+}
+
+func (t *BTreeInMemory) removeNode(addr int64) (err error) {
+	if !IsValidAddress(addr, t.PageSize()) || addr == 0 {
+		return fmt.Errorf("the provided address of %v is invalid", addr)
+	}
+
+	//Inserts running in parallel grow the block while a failed one frees
+	//its overflow pages
+	t.blockMu.RLock()
+	end := int64(len(t.data))
+	available := t.addressIsAvailable(addr)
+	t.blockMu.RUnlock()
+	if memHeaderSize+addr >= end {
+		return fmt.Errorf("The provided address is larger than the tree")
+	} else if available {
+		return fmt.Errorf("the node at %v has already been removed", addr)
+	}
+
+	blankNode, err := NewNode(t)
+	if err != nil {
+		return err
+	}
+	blankNode.Address = addr
+	err = t.writeNode(blankNode)
+	if err != nil {
+		return err
+	}
+
+	t.blockMu.Lock()
+	t.AvailableAddresses = append(t.AvailableAddresses, addr)
+	t.blockMu.Unlock()
+	return nil
+}
+
+// addressIsAvailable returns true if the node at addr was removed and its
+// address not handed out again. blockMu has to be held.
+func (t *BTreeInMemory) addressIsAvailable(addr int64) bool {
+	for _, e := range t.AvailableAddresses {
+		if e == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// NewNode calls the standalone NewNode function and gives it the
+// calling binary tree.
+func (t *BTreeInMemory) NewNode() (n *Node, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.newNode(t)
+}
+
+// newNode creates a node at the next available address and binds it to
+// owner, which is either the tree or its unlocked view.
+func (t *BTreeInMemory) newNode(owner BTree) (n *Node, err error) {
+	n, err = NewNode(owner)
+	if err != nil {
+		return nil, err
+	}
+	n.Address = t.nextNodeAddress()
+	return n, nil
+}
+
+// NextNodeAddress gets the next available address for a node for insertion.
+// This is after the last node or in a spot of a deleted node. A new page
+// is added to the end of the tree for an address after the last node, so
+// inserts running in parallel are never given the same address.
+func (t *BTreeInMemory) NextNodeAddress() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.nextNodeAddress()
+}
+
+func (t *BTreeInMemory) nextNodeAddress() int64 {
+	t.blockMu.Lock()
+	defer t.blockMu.Unlock()
+
+	if len(t.AvailableAddresses) > 0 {
+		val := t.AvailableAddresses[0]
+		t.AvailableAddresses = t.AvailableAddresses[1:]
+		return val
+	}
+
+	addr := int64(len(t.data)) - memHeaderSize
+	t.data = append(t.data, make([]byte, t.PageSize())...)
+	return addr
+}
+
+// PageSize returns the number of bytes in a node page of the b-tree.
+func (t *BTreeInMemory) PageSize() int {
+	if t.pageSize == 0 {
+		return DefaultPageSize
+	}
+	return t.pageSize
+}
+
+// MaxKeySize returns the length in bytes of the longest key the b-tree
+// accepts.
+func (t *BTreeInMemory) MaxKeySize() int {
+	if t.maxKeySize == 0 {
+		return DefaultMaxKeySize
+	}
+	return t.maxKeySize
+}
+
+// InlineValueSize returns the length in bytes of the longest value the
+// b-tree stores next to its key.
+func (t *BTreeInMemory) InlineValueSize() int {
+	return t.valueSize
+}
+
+// readOverflowPage reads a page of the value of an entry, for the
+// cursors of the tree.
+func (t *BTreeInMemory) readOverflowPage(addr int64) (data []byte, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.nodes().readOverflowPage(addr)
+}
+
+// Compare compares two keys in the order of the b-tree.
+func (t *BTreeInMemory) Compare(a []byte, b []byte) int {
+	if t.compare == nil {
+		return bytes.Compare(a, b)
+	}
+	return t.compare(a, b)
+}
+
+// Root reads the root node of the b-tree. The root always lives at the
+// first address, even when it is split.
+func (t *BTreeInMemory) Root() (n *Node, err error) {
+	return t.ReadNode(0)
+}
+
+// QueryEntry finds the entry with the given key in the b-tree.
+func (t *BTreeInMemory) QueryEntry(key []byte) (entry *Entry, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return queryEntry(t.nodes(), key)
+}
+
+// QueryIndex is QueryEntry for a uint64 key.
+func (t *BTreeInMemory) QueryIndex(key uint64) (index *Index, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return queryIndex(t.nodes(), key)
+}
+
+// RangeEntries returns the entries with keys from lo to hi in the order
+// and with the bounds and limit given by opts. A nil lo or hi leaves that
+// end of the range open and a nil opts returns every entry in the range
+// in ascending order.
+func (t *BTreeInMemory) RangeEntries(lo []byte, hi []byte, opts *RangeOptions) (entries []Entry, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return collectEntries(t.nodes(), lo, hi, opts)
+}
+
+// RangeEntriesFunc streams the entries that RangeEntries would return to
+// fn one at a time instead of collecting them. The walk stops early if
+// fn returns false. The tree is locked for reading while fn runs, so fn
+// must not call any of its methods.
+func (t *BTreeInMemory) RangeEntriesFunc(lo []byte, hi []byte, opts *RangeOptions, fn func(entry *Entry) bool) (err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return rangeEntries(t.nodes(), lo, hi, opts, fn)
+}
+
+// Range is RangeEntries for uint64 keys. It returns an error if a key in
+// the range is not a uint64 key.
+func (t *BTreeInMemory) Range(lo uint64, hi uint64, opts *RangeOptions) (indexes []Index, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return collectRange(t.nodes(), lo, hi, opts)
+}
+
+// RangeFunc is RangeEntriesFunc for uint64 keys.
+func (t *BTreeInMemory) RangeFunc(lo uint64, hi uint64, opts *RangeOptions, fn func(index *Index) bool) (err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return rangeIndexes(t.nodes(), lo, hi, opts, fn)
+}
+
+// Rank returns the number of keys in the b-tree before key, which does
+// not have to be in the b-tree itself. It only descends the tree once.
+// Inserts that are running at the same time are counted from the moment
+// they pass a node, which can be before their key can be found.
+func (t *BTreeInMemory) Rank(key uint64) (rank uint64, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return rankIndex(t.nodes(), key)
+}
+
+// Select returns the index at position i of the b-tree in key order,
+// counting from zero, so Select(Rank(key)) is the index of key. It only
+// descends the tree once.
+func (t *BTreeInMemory) Select(i uint64) (index *Index, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return selectIndex(t.nodes(), i)
+}
+
+// CountRange returns the number of keys from lo to hi, both included,
+// without walking them.
+func (t *BTreeInMemory) CountRange(lo uint64, hi uint64) (count uint64, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return countRange(t.nodes(), lo, hi)
+}
+
+// KeyCount returns the number of indexes stored in the b-tree.
+func (t *BTreeInMemory) KeyCount() uint64 {
+	return atomic.LoadUint64(&t.keyCount)
+}
+
+// InsertEntry inserts the entry into the b-tree. Inserts into different
+// subtrees run in parallel.
+func (t *BTreeInMemory) InsertEntry(entry *Entry) (err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.nodes().InsertEntry(entry)
+}
+
+// InsertIndex is InsertEntry for an index with a uint64 key.
+func (t *BTreeInMemory) InsertIndex(index *Index) (err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.nodes().InsertEntry(index.entry())
+}
+
+// InsertBatch inserts the indexes in key order, descending the tree once
+// for every leaf they go into and writing the leaf once for all of them.
+// An index that can not be inserted, such as one with a key that is
+// already in the b-tree, does not stop the batch. Those indexes are
+// reported together in a *BatchError. Batches and inserts into different
+// subtrees run in parallel.
+func (t *BTreeInMemory) InsertBatch(indexes []Index) (err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.nodes().InsertBatch(indexes)
+}
+
+// Update changes the pointer of key in place. Only the node that holds
+// the key is written. An error is returned if the key is not in the
+// b-tree.
+func (t *BTreeInMemory) Update(key uint64, pointer int64) (err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.nodes().Update(key, pointer)
+}
+
+// Upsert changes the pointer of the key of index in place like Update,
+// or inserts the index if its key is not in the b-tree yet.
+func (t *BTreeInMemory) Upsert(index *Index) (err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.nodes().Upsert(index)
+}
+
+// CompareAndSwap changes the pointer of key to new if it is old and
+// reports whether it did, atomically with respect to the other changes
+// of the b-tree. An error is returned if the key is not in the b-tree.
+func (t *BTreeInMemory) CompareAndSwap(key uint64, old int64, new int64) (swapped bool, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.nodes().CompareAndSwap(key, old, new)
+}
+
+// RemoveEntry removes the entry with the given key from the b-tree. Nodes
+// that are emptied along the way are merged away and their addresses are
+// made available for reuse.
+func (t *BTreeInMemory) RemoveEntry(key []byte) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.nodes().RemoveEntry(key)
+}
+
+// Put inserts key into the b-tree with value stored next to it in its
+// node. A value longer than InlineValueSize bytes is stored in a chain
+// of overflow pages instead and the node only keeps where it is. An
+// error is returned if the key is already in the b-tree.
+func (t *BTreeInMemory) Put(key []byte, value []byte) (err error) {
+	return t.InsertEntry(&Entry{Key: key, Value: value})
+}
+
+// Get returns the value stored with key by Put.
+func (t *BTreeInMemory) Get(key []byte) (value []byte, err error) {
+	return entryValue(t.QueryEntry(key))
+}
+
+// RemoveIndex is RemoveEntry for a uint64 key.
+func (t *BTreeInMemory) RemoveIndex(key uint64) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.nodes().RemoveEntry(Uint64Key(key))
+}
+
 func appendRangeBytes(d []byte, n []byte) []byte {
 	for _, b := range n {
 		d = append(d, b)
 	}
 	return d
 }
+
+// The methods of the unlocked view bind the nodes they return to it. Its
+// nodes are latched by the operations that run in parallel.
+
+func (m *memNodes) latch(addr int64) *sync.RWMutex {
+	return m.latches.latch(addr)
+}
+
+func (m *memNodes) rootAddress() int64 {
+	return 0
+}
+
+func (m *memNodes) writeCount(n *Node, x int) error {
+	m.blockMu.RLock()
+	defer m.blockMu.RUnlock()
+
+	if !m.tree().hasPage(n.Address) {
+		return fmt.Errorf("there is no node at %v in the tree", n.Address)
+	}
+	return m.tree().changePage(n.Address, func(page []byte) {
+		binary.LittleEndian.PutUint64(page[countOffset(len(n.Pointers), x):], n.Counts[x])
+	})
+}
+
+func (m *memNodes) InsertEntry(entry *Entry) (err error) {
+	err = insertEntry(m, entry)
+	if err == nil {
+		atomic.AddUint64(&m.keyCount, 1)
+	}
+	return err
+}
+
+func (m *memNodes) QueryEntry(key []byte) (entry *Entry, err error) {
+	return queryEntry(m, key)
+}
+
+func (m *memNodes) RangeEntries(lo []byte, hi []byte, opts *RangeOptions) (entries []Entry, err error) {
+	return collectEntries(m, lo, hi, opts)
+}
+
+func (m *memNodes) RangeEntriesFunc(lo []byte, hi []byte, opts *RangeOptions, fn func(entry *Entry) bool) (err error) {
+	return rangeEntries(m, lo, hi, opts, fn)
+}
+
+func (m *memNodes) RemoveEntry(key []byte) (err error) {
+	err = removeEntry(m, key)
+	if err == nil {
+		atomic.AddUint64(&m.keyCount, ^uint64(0))
+	}
+	return err
+}
+
+func (m *memNodes) Put(key []byte, value []byte) (err error) {
+	return m.InsertEntry(&Entry{Key: key, Value: value})
+}
+
+func (m *memNodes) Get(key []byte) (value []byte, err error) {
+	return entryValue(m.QueryEntry(key))
+}
+
+func (m *memNodes) InsertIndex(index *Index) (err error) {
+	return m.InsertEntry(index.entry())
+}
+
+func (m *memNodes) InsertBatch(indexes []Index) (err error) {
+	inserted, err := insertBatch(m, indexes)
+	atomic.AddUint64(&m.keyCount, uint64(inserted))
+	return err
+}
+
+func (m *memNodes) Update(key uint64, pointer int64) (err error) {
+	return updateIndex(m, key, pointer)
+}
+
+func (m *memNodes) Upsert(index *Index) (err error) {
+	inserted, err := upsertIndex(m, index)
+	if inserted {
+		atomic.AddUint64(&m.keyCount, 1)
+	}
+	return err
+}
+
+func (m *memNodes) CompareAndSwap(key uint64, old int64, new int64) (swapped bool, err error) {
+	return compareAndSwap(m, key, old, new)
+}
+
+func (m *memNodes) QueryIndex(key uint64) (index *Index, err error) {
+	return queryIndex(m, key)
+}
+
+func (m *memNodes) Range(lo uint64, hi uint64, opts *RangeOptions) (indexes []Index, err error) {
+	return collectRange(m, lo, hi, opts)
+}
+
+func (m *memNodes) RangeFunc(lo uint64, hi uint64, opts *RangeOptions, fn func(index *Index) bool) (err error) {
+	return rangeIndexes(m, lo, hi, opts, fn)
+}
+
+func (m *memNodes) Rank(key uint64) (rank uint64, err error) {
+	return rankIndex(m, key)
+}
+
+func (m *memNodes) Select(i uint64) (index *Index, err error) {
+	return selectIndex(m, i)
+}
+
+func (m *memNodes) CountRange(lo uint64, hi uint64) (count uint64, err error) {
+	return countRange(m, lo, hi)
+}
+
+func (m *memNodes) RemoveIndex(key uint64) (err error) {
+	return m.RemoveEntry(Uint64Key(key))
+}
+
+func (m *memNodes) WriteNode(n *Node) error {
+	return m.tree().writeNode(n)
+}
+
+func (m *memNodes) NewNode() (n *Node, err error) {
+	return m.tree().newNode(m)
+}
+
+func (m *memNodes) ReadNode(address int64) (n *Node, err error) {
+	return m.tree().readNode(address, m)
+}
+
+func (m *memNodes) Root() (n *Node, err error) {
+	return m.tree().readNode(0, m)
+}
+
+func (m *memNodes) RemoveNode(address int64) (err error) {
+	return m.tree().removeNode(address)
+}
+
+func (m *memNodes) PageSize() int {
+	return m.tree().PageSize()
+}
+
+func (m *memNodes) MaxKeySize() int {
+	return m.tree().MaxKeySize()
+}
+
+func (m *memNodes) InlineValueSize() int {
+	return m.tree().InlineValueSize()
+}
+
+func (m *memNodes) newOverflowPage() (addr int64, err error) {
+	return m.tree().nextNodeAddress(), nil
+}
+
+func (m *memNodes) writeOverflowPage(addr int64, data []byte) error {
+	if !IsValidAddress(addr, m.PageSize()) {
+		return fmt.Errorf("Invalid address. Cannot write an overflow page at %v", addr)
+	}
+	return m.tree().writePage(addr, data)
+}
+
+func (m *memNodes) readOverflowPage(addr int64) (data []byte, err error) {
+	if !IsValidAddress(addr, m.PageSize()) {
+		return nil, fmt.Errorf("Invalid address. Cannot read an overflow page at %v", addr)
+	}
+
+	m.blockMu.RLock()
+	defer m.blockMu.RUnlock()
+	return m.tree().page(addr)
+}
+
+func (m *memNodes) Compare(a []byte, b []byte) int {
+	return m.tree().Compare(a, b)
+}
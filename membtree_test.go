@@ -10,3 +10,140 @@ func TestNewBTreeInMem(t *testing.T) {
 		t.Errorf("Wrong first byte: %v", tree.data[0])
 	}
 }
+
+func TestBTreeInMemReadWriteNode(t *testing.T) {
+	tree, err := NewBTreeInMem(4)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	n, err := tree.NewNode()
+	if err != nil {
+		t.Error(err)
+		return
+	} else if n.Address != DefaultPageSize {
+		t.Errorf("the first new node was given the address %v, expected %v", n.Address, DefaultPageSize)
+	}
+
+	n.Data[0] = entry(2, 345)
+	n.count = 1
+	n.Pointers[0] = 1
+	err = n.Write()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rn, err := tree.ReadNode(DefaultPageSize)
+	if err != nil {
+		t.Error(err)
+	} else if keyOf(rn.Data[0]) != 2 || rn.Data[0].Pointer != 345 || rn.Pointers[0] != 1 {
+		t.Errorf("the node read back has data %v and pointer %v", rn.Data[0], rn.Pointers[0])
+	}
+
+	//Changes to a node that has been read are not seen until it is written
+	rn.Data[0] = entry(3, 345)
+	again, err := tree.ReadNode(DefaultPageSize)
+	if err != nil {
+		t.Error(err)
+	} else if keyOf(again.Data[0]) != 2 {
+		t.Errorf("an unwritten change to a node was seen by the tree")
+	}
+
+	_, err = tree.ReadNode(2 * DefaultPageSize)
+	if err == nil {
+		t.Error("reading past the last node did not return an error")
+	}
+
+	n.Address = 3 * DefaultPageSize
+	err = n.Write()
+	if err == nil {
+		t.Error("writing a node past the end of the tree did not return an error")
+	}
+}
+
+func TestBTreeInMemRemoveNode(t *testing.T) {
+	tree, err := NewBTreeInMem(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	n, err := tree.NewNode()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	n.Data[0] = entry(1, 214)
+	n.count = 1
+	err = n.Write()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = tree.RemoveNode(n.Address)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rn, err := tree.ReadNode(n.Address)
+	if err != nil {
+		t.Error(err)
+	} else if !rn.IsEmpty() {
+		t.Error("the removed node was not cleared")
+	}
+
+	next, err := tree.NewNode()
+	if err != nil {
+		t.Error(err)
+	} else if next.Address != n.Address {
+		t.Errorf("the removed address of %v was not reused, got %v", n.Address, next.Address)
+	}
+}
+
+func TestRemoveNodeTwice(t *testing.T) {
+	forEachBackend(t, "test-remove-node-twice.bin", func(t *testing.T, tree BTree) {
+		n, err := tree.NewNode()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		err = n.Write()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = tree.RemoveNode(n.Address)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		err = tree.RemoveNode(n.Address)
+		if err == nil {
+			t.Errorf("the node at %v was removed twice", n.Address)
+		}
+
+		root, err := tree.Root()
+		if err != nil {
+			t.Error(err)
+		} else if tree.RemoveNode(root.Address) == nil {
+			t.Error("the root was removed")
+		}
+
+		first, err := tree.NewNode()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		second, err := tree.NewNode()
+		if err != nil {
+			t.Error(err)
+		} else if first.Address == second.Address {
+			t.Errorf("the address %v was handed out twice", first.Address)
+		}
+	})
+}
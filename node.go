@@ -1,51 +1,225 @@
 package btree
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 )
 
 const maxInt64 = 18446744073709551615
 
+// DefaultPageSize is the number of bytes in a node page when a tree is
+// created without choosing one. A node of this size holds 101 keys of up
+// to DefaultMaxKeySize bytes without values. Every pointer takes 16 bytes
+// together with the count of the entries under it, so smaller pages make
+// for a small fanout. The page size is recorded in the file, trees
+// created with another page size are opened with theirs.
+const DefaultPageSize = 4096
+
+// MinPageSize and MaxPageSize are the smallest and largest page sizes a
+// tree can be created with.
+const (
+	MinPageSize = 160
+	MaxPageSize = 1 << 20
+)
+
 // Node is a structure that represents a node when in memory ouside the tree.
 // It is used for creating and editing nodes and is then written from there.
+// The number of pointers and data entries is set by the page size and the
+// maximum key size of the tree, there is always one more pointer than
+// there are entries. The entries in use come first, how many there are
+// is kept in the node, so every key and pointer, zero included, can be
+// stored. The rest of the entries are left zero.
+//
+// Counts holds the number of entries in the subtree under every pointer,
+// so that the position of a key in the tree can be found without walking
+// the entries before it. The counts of a leaf are all zero.
 type Node struct {
-	Pointers [32]int64
-	Data     [31]Index
+	Pointers []int64
+	Counts   []uint64
+	Data     []Entry
 
 	Address int64
 	tree    BTree
-}
-
-type binaryNode struct { //752 bytes
-	Pointers [32]int64
-	Data     [31]Index
+	count   int //The number of entries in use
 }
 
 // NewNode creates a new node using the specified b-tree structure
 func NewNode(t BTree) (*Node, error) {
-	n := new(Node)
+	n := newNodeOfOrder(nodeOrder(t.PageSize(), t.MaxKeySize(), t.InlineValueSize()))
 	n.tree = t
 	return n, nil
 }
 
+// nodeHeaderSize is the number of bytes at the start of a node page that
+// hold the number of entries in the node.
+const nodeHeaderSize = 4
+
+// slotSize is the number of bytes in the slot of an entry in a node page,
+// which holds the pointer of the entry and the offsets its key and value
+// end at.
+const slotSize = 16
+
+// slotOverflow is set in the value offset of a slot when the entry keeps
+// an overflowRef in place of its value.
+const slotOverflow = 1 << 31
+
+// nodeOrder returns the number of subnode pointers that fit in a node
+// page of the given size when every key can be up to maxKeySize bytes
+// long and every value up to valueSize bytes. The page starts with the
+// number of entries, followed by the pointers, the counts of entries
+// under them and a slot for every entry. The keys and values of the
+// entries come last, each key followed by its value. Every pointer takes
+// 8 bytes and its count another 8, every entry between two pointers a
+// slot and the room for its key and value. In a tree with values there
+// is always room for the overflowRef of a longer value.
+func nodeOrder(pageSize int, maxKeySize int, valueSize int) int {
+	if valueSize > 0 && valueSize < overflowRefSize {
+		valueSize = overflowRefSize
+	}
+	entrySize := slotSize + maxKeySize + valueSize
+	return (pageSize - nodeHeaderSize + entrySize) / (16 + entrySize)
+}
+
+func newNodeOfOrder(order int) *Node {
+	n := new(Node)
+	n.Pointers = make([]int64, order)
+	n.Counts = make([]uint64, order)
+	n.Data = make([]Entry, order-1)
+	return n
+}
+
+// countOffset returns where the count under pointer x sits in the page of
+// a node of the given order.
+func countOffset(order int, x int) int {
+	return nodeHeaderSize + 8*order + 8*x
+}
+
+// keysOffset returns where the keys and values start in the page of a
+// node of the given order.
+func keysOffset(order int) int {
+	return nodeHeaderSize + 16*order + slotSize*(order-1)
+}
+
 // ToBinary changes this node from a in memory native structure into
 // an array of binary bytes to be written to a file or stored in a
-// block of memory.
+// block of memory. The bytes are padded out to the page size of the tree.
 func (n *Node) ToBinary() (result []byte, err error) {
-	binNode := binaryNode{
-		Pointers: n.Pointers,
-		Data:     n.Data,
+	size := n.size()
+	keysAt := keysOffset(len(n.Pointers))
+	length := keysAt
+	for _, e := range n.Data[:size] {
+		length += len(e.Key) + len(e.Value)
+		if e.overflow.addr != 0 {
+			length += overflowRefSize
+		}
 	}
-	buf := new(bytes.Buffer)
 
-	err = binary.Write(buf, binary.LittleEndian, binNode)
-	if err != nil {
-		return result, err
+	if n.tree != nil {
+		if length > n.tree.PageSize() {
+			return nil, fmt.Errorf("the node at %v takes up %v bytes, more than a page of %v", n.Address, length, n.tree.PageSize())
+		}
+		length = n.tree.PageSize()
+	}
+
+	result = make([]byte, length)
+	binary.LittleEndian.PutUint32(result, uint32(size))
+	p := nodeHeaderSize
+	for _, ptr := range n.Pointers {
+		binary.LittleEndian.PutUint64(result[p:], uint64(ptr))
+		p += 8
+	}
+	for _, c := range n.Counts {
+		binary.LittleEndian.PutUint64(result[p:], c)
+		p += 8
 	}
 
-	return buf.Bytes(), nil
+	k := keysAt
+	for _, e := range n.Data[:size] {
+		k += copy(result[k:], e.Key)
+		binary.LittleEndian.PutUint64(result[p:], uint64(e.Pointer))
+		binary.LittleEndian.PutUint32(result[p+8:], uint32(k-keysAt))
+		valueEnd := uint32(0)
+		if e.overflow.addr != 0 {
+			binary.LittleEndian.PutUint64(result[k:], uint64(e.overflow.addr))
+			binary.LittleEndian.PutUint32(result[k+8:], e.overflow.size)
+			k += overflowRefSize
+			valueEnd = slotOverflow
+		} else {
+			k += copy(result[k:], e.Value)
+		}
+		binary.LittleEndian.PutUint32(result[p+12:], valueEnd|uint32(k-keysAt))
+		p += slotSize
+	}
+	return result, nil
+}
+
+// nodeFromBinary is the reverse of ToBinary. It decodes a node read from
+// the given address of the tree t. The size of the node is taken from
+// the length of data, which is a whole page. The keys and values are
+// copied out of data.
+func nodeFromBinary(data []byte, address int64, t BTree) (n *Node, err error) {
+	order := nodeOrder(len(data), t.MaxKeySize(), t.InlineValueSize())
+	keysAt := keysOffset(order)
+	if order < minNodeOrder || keysAt > len(data) {
+		return nil, fmt.Errorf("a page of %v bytes is too small for a node", len(data))
+	}
+
+	n = newNodeOfOrder(order)
+	size := int(binary.LittleEndian.Uint32(data))
+	if size > len(n.Data) {
+		return nil, fmt.Errorf("the page at %v is not a node, it claims to hold %v entries", address, size)
+	}
+
+	p := nodeHeaderSize
+	for i := range n.Pointers {
+		n.Pointers[i] = int64(binary.LittleEndian.Uint64(data[p:]))
+		p += 8
+	}
+	for i := range n.Counts {
+		n.Counts[i] = binary.LittleEndian.Uint64(data[p:])
+		p += 8
+	}
+
+	var keys []byte
+	if size > 0 {
+		end := int(binary.LittleEndian.Uint32(data[p+(size-1)*slotSize+12:]) &^ slotOverflow)
+		if end > len(data)-keysAt {
+			return nil, fmt.Errorf("the keys of the node at %v run past the end of its page", address)
+		}
+		keys = append([]byte{}, data[keysAt:keysAt+end]...)
+	}
+
+	start := 0
+	for i := 0; i < size; i++ {
+		keyEnd := int(binary.LittleEndian.Uint32(data[p+8:]))
+		valueEnd := binary.LittleEndian.Uint32(data[p+12:])
+		end := int(valueEnd &^ slotOverflow)
+		if keyEnd < start || end < keyEnd || end > len(keys) {
+			return nil, fmt.Errorf("the key of entry %v of the node at %v is out of place", i, address)
+		}
+		n.Data[i] = Entry{
+			Key:     keys[start:keyEnd:keyEnd],
+			Pointer: int64(binary.LittleEndian.Uint64(data[p:])),
+		}
+		if valueEnd&slotOverflow != 0 {
+			if end-keyEnd != overflowRefSize {
+				return nil, fmt.Errorf("the overflow reference of entry %v of the node at %v is %v bytes long", i, address, end-keyEnd)
+			}
+			n.Data[i].overflow = overflowRef{
+				addr: int64(binary.LittleEndian.Uint64(keys[keyEnd:])),
+				size: binary.LittleEndian.Uint32(keys[keyEnd+8:]),
+			}
+		} else if end > keyEnd {
+			n.Data[i].Value = keys[keyEnd:end:end]
+		}
+		start = end
+		p += slotSize
+	}
+
+	n.count = size
+	n.Address = address
+	n.tree = t
+	return n, nil
 }
 
 func (n *Node) Write() error {
@@ -55,124 +229,549 @@ func (n *Node) Write() error {
 	return fmt.Errorf("There was no tree attached to this node")
 }
 
-// IsEmpty returns true if the node is empty. For speed it only
-// checks if the first data entry in the node is zero. If by some
-// error any of the other parts of the data array end up with
-// values and the first remains zero the node will be effectively
-// empty.
+// writeCount writes the count under pointer x after it was changed and
+// nothing else of the node was. Trees that implement countWriter only
+// write the count, the others write the whole node.
+func (n *Node) writeCount(x int) error {
+	if w, ok := n.tree.(countWriter); ok {
+		return w.writeCount(n, x)
+	}
+	return n.Write()
+}
+
+// IsEmpty returns true if the node holds no entries and points to no
+// subnodes.
 func (n *Node) IsEmpty() bool {
 	for _, p := range n.Pointers {
 		if p != 0 {
 			return false
 		}
 	}
+	return n.count == 0
+}
 
-	for _, d := range n.Data {
-		if !d.isEmptyOrDefault() {
-			return false
+func (n *Node) query(key []byte) (entry *Entry, err error) {
+	return n.queryLatched(key, noLatch)
+}
+
+// queryLatched is query on a node whose latch is held, see latcher. The
+// latch is released with unlatch once the latch of the child the search
+// continues in is held.
+func (n *Node) queryLatched(key []byte, unlatch func()) (entry *Entry, err error) {
+	x, found := n.search(key)
+	if found {
+		d := n.Data[x]
+		unlatch()
+		return &d, nil
+	} else if n.Pointers[x] == 0 {
+		unlatch()
+		return nil, fmt.Errorf("The key was not found in the b-tree")
+	}
+
+	nn, childUnlatch, err := readLatched(n.tree, n.Pointers[x], false)
+	unlatch()
+	if err != nil {
+		return nil, err
+	}
+	return nn.queryLatched(key, childUnlatch)
+}
+
+// search finds the position of key in this node. If the key is not in
+// the node the position is that of the subnode pointer the key would be
+// found under.
+func (n *Node) search(key []byte) (x int, found bool) {
+	size := n.size()
+	c := -1
+	for x < size {
+		//The key searched for comes first, see keyOrder
+		c = n.tree.Compare(key, n.Data[x].Key)
+		if c <= 0 {
+			break
 		}
+		x++
 	}
+	return x, x < size && c == 0
+}
 
-	return true
+// remove deletes the entry with the given key from the subtree rooted at
+// this node. On the way down every child that is about to be entered is
+// topped up to at least minKeys+1 entries by borrowing from or merging
+// with a sibling so that removing from it does not leave it underfull.
+// The count of the child is lowered once the entry is gone from it.
+func (n *Node) remove(key []byte) (err error) {
+	x, found := n.search(key)
+	if found {
+		//Entries without a subnode on one side can be dropped together with that side
+		if n.Pointers[x] == 0 {
+			n.removeAt(x, x)
+			return n.Write()
+		} else if n.Pointers[x+1] == 0 {
+			n.removeAt(x, x+1)
+			return n.Write()
+		}
+		return n.removeFromInternal(x)
+	}
+
+	if n.Pointers[x] == 0 {
+		return fmt.Errorf("the key %x was not found in the b-tree", key)
+	}
+
+	child, err := n.fillChild(x)
+	if err != nil {
+		return err
+	}
+	err = child.remove(key)
+	if err != nil || child == n { //A child that was absorbed counts for itself
+		return err
+	}
+	x, _ = n.search(key)
+	n.Counts[x]--
+	return n.Write()
 }
 
-func (n *Node) query(key uint64) (index *Index, err error) {
-	for i, d := range n.Data {
-		if key < d.Key {
-			nn, err := n.readLeftPtr(i)
-			if err != nil {
-				return nil, err
-			}
-			return nn.query(key)
-		} else if (n.Data[i+1].isEmptyOrDefault() || len(n.Data) == i+1) && key > d.Key {
-			nn, err := n.readRightPtr(i)
-			if err != nil {
-				return nil, err
-			}
-			return nn.query(key)
-		} else if key == d.Key {
-			return &d, nil
+// removeAt drops the entry at position x and the pointer at position p,
+// one of the two pointers next to it, together with its count.
+func (n *Node) removeAt(x int, p int) {
+	n.Data = removeEntryAt(n.Data, x)
+	n.Pointers = removeInt64at(n.Pointers, p)
+	n.Counts = removeUint64at(n.Counts, p)
+	n.count--
+}
+
+// removeFromInternal removes the entry at position x of an internal node.
+// The entry is replaced by its predecessor or successor when the child it
+// is taken from can spare one, otherwise the two children around it are
+// merged and the removal continues in the merged node.
+func (n *Node) removeFromInternal(x int) (err error) {
+	key := n.Data[x].Key
+
+	left, err := n.readLeftPtr(x)
+	if err != nil {
+		return err
+	}
+	right, err := n.readRightPtr(x)
+	if err != nil {
+		return err
+	}
+
+	if left.size() == 0 && right.size() == 0 {
+		//Both sides are empty leaves, drop one of them along with the entry
+		err = n.tree.RemoveNode(right.Address)
+		if err != nil {
+			return err
+		}
+		n.removeAt(x, x+1)
+		if n.size() == 0 {
+			return n.absorb(left)
+		}
+		return n.Write()
+	}
+
+	if (left.size() <= n.minKeys() && right.size() > n.minKeys()) || left.size() == 0 {
+		succ, err := right.minEntry()
+		if err != nil {
+			return err
+		}
+		n.Data[x] = *succ
+		n.Counts[x+1]--
+		err = n.Write()
+		if err != nil {
+			return err
+		}
+		return right.remove(succ.Key)
+	}
+
+	if left.size() <= n.minKeys() && left.isLeaf() == right.isLeaf() {
+		merged, err := n.mergeChildren(x, left, right)
+		if err != nil {
+			return err
+		}
+		err = merged.remove(key)
+		if err != nil || merged == n {
+			return err
+		}
+		n.Counts[x]--
+		return n.Write()
+	}
+
+	pred, err := left.maxEntry()
+	if err != nil {
+		return err
+	}
+	n.Data[x] = *pred
+	n.Counts[x]--
+	err = n.Write()
+	if err != nil {
+		return err
+	}
+	return left.remove(pred.Key)
+}
+
+// fillChild makes sure the child at position x has more than minKeys
+// entries before it is descended into and returns the node that now
+// covers the range of that child. A key is borrowed from the left or
+// right sibling if either can spare one, otherwise the child is merged
+// with one of them. Keys are only ever moved between two leaves or two
+// internal nodes.
+func (n *Node) fillChild(x int) (child *Node, err error) {
+	child, err = n.readLeftPtr(x)
+	if err != nil {
+		return nil, err
+	}
+	if child.size() > n.minKeys() {
+		return child, nil
+	}
+
+	var left, right *Node
+	if x > 0 {
+		left, err = n.readLeftPtr(x - 1)
+		if err != nil {
+			return nil, err
+		}
+		if left.size() > n.minKeys() && left.isLeaf() == child.isLeaf() {
+			return child, n.borrowFromLeft(x, left, child)
 		}
 	}
-	return nil, fmt.Errorf("The key was not found in the b-tree")
+	if x < n.size() {
+		right, err = n.readRightPtr(x)
+		if err != nil {
+			return nil, err
+		}
+		if right.size() > n.minKeys() && right.isLeaf() == child.isLeaf() {
+			return child, n.borrowFromRight(x, child, right)
+		}
+	}
+
+	if right != nil && child.isLeaf() == right.isLeaf() {
+		return n.mergeChildren(x, child, right)
+	} else if left != nil && left.isLeaf() == child.isLeaf() {
+		return n.mergeChildren(x-1, left, child)
+	}
+
+	//Neither sibling can be borrowed from or merged with, leave the child underfull
+	return child, nil
 }
 
-func (n *Node) remove(key uint64) (err error) {
-	for i, d := range n.Data {
-		if key < d.Key {
-			nn, err := n.readLeftPtr(i)
-			if err != nil {
-				return err
-			}
-			return nn.remove(key)
-		} else if (n.Data[i+1].isEmptyOrDefault() || len(n.Data) == i+1) && key > d.Key {
-			nn, err := n.readRightPtr(i)
-			if err != nil {
-				return err
-			}
-			return nn.remove(key)
-		} else if key == d.Key {
-			//TODO: Remove here
+// borrowFromLeft rotates the last entry of the left sibling up into this
+// node and moves the separating entry down to the front of the child.
+func (n *Node) borrowFromLeft(x int, left *Node, child *Node) (err error) {
+	ls := left.size()
+
+	child.Data = insertEntryAt(child.Data, 0, n.Data[x-1])
+	child.Pointers = insertInt64at(child.Pointers, 0, left.Pointers[ls])
+	child.Counts = insertUint64at(child.Counts, 0, left.Counts[ls])
+	n.Data[x-1] = left.Data[ls-1]
+	left.Data[ls-1] = Entry{}
+	left.Pointers[ls] = 0
+	left.Counts[ls] = 0
+	child.count++
+	left.count--
+	n.Counts[x-1] = left.subtreeSize()
+	n.Counts[x] = child.subtreeSize()
+
+	return writeNodes(left, child, n)
+}
+
+// borrowFromRight rotates the first entry of the right sibling up into
+// this node and moves the separating entry down to the end of the child.
+func (n *Node) borrowFromRight(x int, child *Node, right *Node) (err error) {
+	cs := child.size()
+
+	child.Data[cs] = n.Data[x]
+	child.Pointers[cs+1] = right.Pointers[0]
+	child.Counts[cs+1] = right.Counts[0]
+	n.Data[x] = right.Data[0]
+	right.Data = removeEntryAt(right.Data, 0)
+	right.Pointers = removeInt64at(right.Pointers, 0)
+	right.Counts = removeUint64at(right.Counts, 0)
+	child.count++
+	right.count--
+	n.Counts[x] = child.subtreeSize()
+	n.Counts[x+1] = right.subtreeSize()
+
+	return writeNodes(right, child, n)
+}
+
+// mergeChildren merges the children on either side of the entry at
+// position x together with that entry into the left child. The right
+// child's page is handed back to the tree. If that was the last entry in
+// this node, the node takes over the merged contents itself so that no
+// internal node is left without entries. On the root this is what makes
+// the tree lose a level.
+func (n *Node) mergeChildren(x int, left *Node, right *Node) (merged *Node, err error) {
+	ls := left.size()
+	rs := right.size()
+
+	left.Data[ls] = n.Data[x]
+	for i := 0; i < rs; i++ {
+		left.Data[ls+1+i] = right.Data[i]
+	}
+	for i := 0; i <= rs; i++ {
+		left.Pointers[ls+1+i] = right.Pointers[i]
+		left.Counts[ls+1+i] = right.Counts[i]
+	}
+	left.count += rs + 1
+
+	n.removeAt(x, x+1)
+	n.Counts[x] = left.subtreeSize()
+
+	err = n.tree.RemoveNode(right.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.size() == 0 {
+		return n, n.absorb(left)
+	}
+
+	err = writeNodes(left, n)
+	if err != nil {
+		return nil, err
+	}
+	return left, nil
+}
+
+// absorb replaces the contents of this node with those of its only
+// remaining child and hands the child's page back to the tree.
+func (n *Node) absorb(child *Node) (err error) {
+	copy(n.Data, child.Data)
+	copy(n.Pointers, child.Pointers)
+	copy(n.Counts, child.Counts)
+	n.count = child.count
+	err = n.Write()
+	if err != nil {
+		return err
+	}
+	return n.tree.RemoveNode(child.Address)
+}
+
+// minEntry returns the smallest entry in the subtree rooted at this node.
+func (n *Node) minEntry() (entry *Entry, err error) {
+	for {
+		if n.size() > 0 {
+			d := n.Data[0]
+			entry = &d
+		}
+		if n.Pointers[0] == 0 {
+			break
+		}
+		n, err = n.readLeftPtr(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if entry == nil {
+		return nil, fmt.Errorf("the subtree at %v is empty", n.Address)
+	}
+	return entry, nil
+}
+
+// maxEntry returns the largest entry in the subtree rooted at this node.
+func (n *Node) maxEntry() (entry *Entry, err error) {
+	for {
+		size := n.size()
+		if size > 0 {
+			d := n.Data[size-1]
+			entry = &d
+		}
+		if n.Pointers[size] == 0 {
+			break
+		}
+		n, err = n.readLeftPtr(size)
+		if err != nil {
+			return nil, err
 		}
 	}
-	return fmt.Errorf("The key was not found in the b-tree")
+
+	if entry == nil {
+		return nil, fmt.Errorf("the subtree at %v is empty", n.Address)
+	}
+	return entry, nil
 }
 
-func (n *Node) insert(i *Index) (err error) {
+// insert adds the entry to the subtree rooted at this node. Full nodes are
+// split before they are entered so there is always room to take the
+// median of a split child. The tree therefore only grows in height when
+// the node the insert starts from is split. Every node on the way down
+// counts the entry under the child it is inserted into. If the key turns
+// out to be in the tree already, those counts are taken back, see
+// uncountLatched.
+func (n *Node) insert(i *Entry) (err error) {
+	return n.insertLatched(i, noLatch)
+}
+
+// insertLatched is insert on the root whose exclusive latch is held, see
+// latcher. Once the insert has moved on to a child that is not full this
+// node can not change any more, so its latch is released with unlatch.
+func (n *Node) insertLatched(i *Entry, unlatch func()) (err error) {
+	return n.upsertLatched(i, nil, unlatch)
+}
+
+// upsertLatched is insertLatched that hands the entry with the key of i to
+// update if the key is already in the tree, instead of failing, and writes
+// the node of that entry. A nil update fails like insertLatched.
+func (n *Node) upsertLatched(i *Entry, update func(existing *Entry), unlatch func()) (err error) {
+	start := n.Address
+
 	//TODO: Increase insert performance
 	if n.nodeIsFull() {
+		//The new subnodes can only be reached through this node
 		next, err := n.splitIntoTwoSubnodes()
 		if err != nil {
+			unlatch()
 			return err
 		}
-		return next.insert(i)
-	} else if n.IsEmpty() {
-		n.Data[0] = *i
-		return n.Write()
+		n = next
 	}
 
-	for x, d := range n.Data {
-		if i.Key < d.Key {
-			//Insert or recurse if the data goes to the left of the current value
-			if n.Pointers[x] == 0 { //Insert into this node
-				n.insertThisNodeLeft(i, x)
-				return n.Write()
-			}
-			//Recurse
-			nn, err := n.readLeftPtr(x)
-			if err != nil {
-				return err
-			}
-			return nn.insert(i)
-		} else if (n.Data[x+1].isEmptyOrDefault() || len(n.Data) == x+1) && i.Key > d.Key {
-			//If the next value is empty or the end of the block, and the new value
-			// is greater than the current key, then insert or recurse
-			if n.Pointers[x+1] == 0 { //Insert into this node
-				n.insertThisNodeRight(i, x)
-				return n.Write()
-			}
-			//Recurse
-			nn, err := n.readRightPtr(x)
+	found, err := n.insertNonFull(i, update, unlatch)
+	if found {
+		//Every latch is released by now, take the latches from the top again
+		root, rootUnlatch, uerr := readLatched(n.tree, start, true)
+		if uerr == nil {
+			uerr = root.uncountLatched(i.Key, rootUnlatch)
+		}
+		err = firstError(err, uerr)
+	}
+	return err
+}
+
+// insertNonFull inserts the entry into the subtree of this node, which is
+// not full. found is true if the key was already in the subtree, in which
+// case the nodes on the way down have counted an entry too many.
+func (n *Node) insertNonFull(i *Entry, update func(existing *Entry), unlatch func()) (found bool, err error) {
+	x, found := n.search(i.Key)
+	if found {
+		return true, n.updateExisting(i, x, update, unlatch)
+	}
+
+	if n.Pointers[x] == 0 { //Insert into this node
+		n.insertThisNodeLeft(i, x)
+		err = n.Write()
+		unlatch()
+		return false, err
+	}
+
+	child, childUnlatch, err := readLatched(n.tree, n.Pointers[x], true)
+	if err != nil {
+		unlatch()
+		return false, err
+	}
+
+	if child.nodeIsFull() {
+		err = n.splitChild(x, child)
+		if err != nil {
+			childUnlatch()
+			unlatch()
+			return false, err
+		} else if n.tree.Compare(i.Key, n.Data[x].Key) == 0 {
+			childUnlatch()
+			return true, n.updateExisting(i, x, update, unlatch)
+		}
+
+		//The median of the child now sits at x, decide which half to continue in
+		if n.tree.Compare(i.Key, n.Data[x].Key) > 0 {
+			right, rightUnlatch, err := readLatched(n.tree, n.Pointers[x+1], true)
+			childUnlatch()
 			if err != nil {
-				return err
+				unlatch()
+				return false, err
 			}
-			return nn.insert(i)
-		} else if i.Key == d.Key {
-			return fmt.Errorf("the key of %v was already in the b-tree", i.Key)
+			child, childUnlatch = right, rightUnlatch
+			x++
 		}
 	}
 
-	return fmt.Errorf("there was an internal logic error inserting into this node, key of inserting index: %v, first data key in node: %v", i.Key, n.Data[0].Key)
+	n.Counts[x]++
+	err = n.writeCount(x)
+	unlatch()
+	if err != nil {
+		childUnlatch()
+		return false, err
+	}
+	return child.insertNonFull(i, update, childUnlatch)
 }
 
-func (n *Node) insertThisNodeLeft(i *Index, o int) {
-	n.Data = insertIndexAt(n.Data, o, *i)
-	n.Pointers = insertInt64at(n.Pointers, o, 0)
+// updateExisting hands the entry at x, which has the key of i, to update
+// and writes this node, or fails if update is nil.
+func (n *Node) updateExisting(i *Entry, x int, update func(existing *Entry), unlatch func()) error {
+	defer unlatch()
+	if update == nil {
+		return fmt.Errorf("the key %x was already in the b-tree", i.Key)
+	}
+	update(&n.Data[x])
+	return n.Write()
 }
 
-func (n *Node) insertThisNodeRight(i *Index, o int) {
-	n.Data = insertIndexAt(n.Data, o+1, *i)
-	n.Pointers = insertInt64at(n.Pointers, o+1, 0)
+// uncountLatched takes back the counts an insert raised on its way down to
+// key before it found key in the tree. It descends to key again and, like
+// insertRunLatched, holds the latches of the whole path so that the count
+// under every node on the path can be set to the entries in it on the way
+// back up. Splits since the insert may have moved key or recounted some of
+// the nodes already, but a node on the path always holds the right count
+// once it is done.
+func (n *Node) uncountLatched(key []byte, unlatch func()) (err error) {
+	defer unlatch()
+	_, err = n.recount(key)
+	return err
+}
+
+// recount sets the counts on the path from this node down to key to the
+// entries under them and returns the entries in the subtree of this node.
+func (n *Node) recount(key []byte) (size uint64, err error) {
+	x, found := n.search(key)
+	if found || n.Pointers[x] == 0 {
+		return n.subtreeSize(), nil
+	}
+
+	child, childUnlatch, err := readLatched(n.tree, n.Pointers[x], true)
+	if err != nil {
+		return 0, err
+	}
+	below, err := child.recount(key)
+	childUnlatch()
+	if err != nil {
+		return 0, err
+	} else if n.Counts[x] != below {
+		n.Counts[x] = below
+		err = n.Write()
+	}
+	return n.subtreeSize(), err
+}
+
+// updateLatched finds the entry with key in the subtree of this node,
+// whose exclusive latch is held, and hands it to update. Only the node
+// that holds the entry is written, and only if update returns true.
+// Nothing is split or merged on the way down, so the latch of every node
+// is released as soon as the latch of the next one is held. found is
+// false if the key is not in the subtree.
+func (n *Node) updateLatched(key []byte, update func(entry *Entry) (changed bool), unlatch func()) (found bool, err error) {
+	x, found := n.search(key)
+	if found {
+		defer unlatch()
+		if !update(&n.Data[x]) {
+			return true, nil
+		}
+		return true, n.Write()
+	} else if n.Pointers[x] == 0 {
+		unlatch()
+		return false, nil
+	}
+
+	child, childUnlatch, err := readLatched(n.tree, n.Pointers[x], true)
+	unlatch()
+	if err != nil {
+		return false, err
+	}
+	return child.updateLatched(key, update, childUnlatch)
+}
+
+func (n *Node) insertThisNodeLeft(i *Entry, o int) {
+	n.Data = insertEntryAt(n.Data, o, *i)
+	n.Pointers = insertInt64at(n.Pointers, o, 0)
+	n.Counts = insertUint64at(n.Counts, o, 0)
+	n.count++
 }
 
 // Only run on nodes that are full
@@ -191,25 +790,18 @@ func (n *Node) splitIntoTwoSubnodes() (new *Node, err error) {
 	for i, e := range n.Data[:median] {
 		leftNode.Data[i] = e
 		leftNode.Pointers[i] = n.Pointers[i]
+		leftNode.Counts[i] = n.Counts[i]
 	}
 	leftNode.Pointers[median] = n.Pointers[median]
+	leftNode.Counts[median] = n.Counts[median]
+	leftNode.count = median
 	err = leftNode.Write()
 	if err != nil {
 		return nil, err
 	}
 
 	//Copy the values to the right node
-	rightNode, err := n.tree.NewNode()
-	if err != nil {
-		return nil, err
-	}
-
-	rightNode.Pointers[0] = n.Pointers[median+1]
-	for i, e := range n.Data[median+1 : n.size()] {
-		rightNode.Data[i] = e
-		rightNode.Pointers[i+1] = n.Pointers[median+2+i]
-	}
-	err = rightNode.Write()
+	rightNode, err := n.splitOffUpperHalf(median)
 	if err != nil {
 		return nil, err
 	}
@@ -218,9 +810,12 @@ func (n *Node) splitIntoTwoSubnodes() (new *Node, err error) {
 	var medianVal = n.Data[median]
 	n.clear()
 	n.Data[0] = medianVal
+	n.count = 1
 
 	n.Pointers[0] = leftNode.Address
 	n.Pointers[1] = rightNode.Address
+	n.Counts[0] = leftNode.subtreeSize()
+	n.Counts[1] = rightNode.subtreeSize()
 
 	err = n.Write()
 	if err != nil {
@@ -230,6 +825,63 @@ func (n *Node) splitIntoTwoSubnodes() (new *Node, err error) {
 	return n, nil
 }
 
+// splitChild splits the full child at position x of this node. The child
+// keeps the lower half of its entries, the upper half is moved into a new
+// node and the median is pushed up into this node between the two.
+func (n *Node) splitChild(x int, child *Node) (err error) {
+	median, err := child.findMedianDataPoint()
+	if err != nil {
+		return err
+	}
+
+	rightNode, err := child.splitOffUpperHalf(median)
+	if err != nil {
+		return err
+	}
+
+	medianVal := child.Data[median]
+	for i := median; i < len(child.Data); i++ {
+		child.Data[i] = Entry{}
+		child.Pointers[i+1] = 0
+		child.Counts[i+1] = 0
+	}
+	child.count = median
+	err = child.Write()
+	if err != nil {
+		return err
+	}
+
+	n.Data = insertEntryAt(n.Data, x, medianVal)
+	n.Pointers = insertInt64at(n.Pointers, x+1, rightNode.Address)
+	n.Counts = insertUint64at(n.Counts, x+1, rightNode.subtreeSize())
+	n.Counts[x] = child.subtreeSize()
+	n.count++
+	return n.Write()
+}
+
+// splitOffUpperHalf copies the entries after the median and the pointers
+// around them into a new node and writes it. This node is left as is.
+func (n *Node) splitOffUpperHalf(median int) (rightNode *Node, err error) {
+	rightNode, err = n.tree.NewNode()
+	if err != nil {
+		return nil, err
+	}
+
+	rightNode.Pointers[0] = n.Pointers[median+1]
+	rightNode.Counts[0] = n.Counts[median+1]
+	for i, e := range n.Data[median+1 : n.size()] {
+		rightNode.Data[i] = e
+		rightNode.Pointers[i+1] = n.Pointers[median+2+i]
+		rightNode.Counts[i+1] = n.Counts[median+2+i]
+	}
+	rightNode.count = n.size() - median - 1
+	err = rightNode.Write()
+	if err != nil {
+		return nil, err
+	}
+	return rightNode, nil
+}
+
 func (n *Node) findMedianDataPoint() (medianIndex int, err error) {
 	size := n.size()
 	if size < 3 {
@@ -241,33 +893,48 @@ func (n *Node) findMedianDataPoint() (medianIndex int, err error) {
 	return medianIndex, nil
 }
 
+// minKeys is the fewest entries a node other than the root is allowed to
+// hold before it has to borrow from or merge with a sibling.
+func (n *Node) minKeys() int {
+	return (len(n.Data) - 1) / 2
+}
+
+// size returns the number of entries in use in the node.
 func (n *Node) size() int {
-	for i, el := range n.Data {
-		if el.Key == 0 {
-			return i
-		}
+	return n.count
+}
+
+// subtreeSize returns the number of entries in the subtree rooted at this
+// node, which is what its parent counts under the pointer to it.
+func (n *Node) subtreeSize() (size uint64) {
+	size = uint64(n.count)
+	for _, c := range n.Counts[:n.count+1] {
+		size += c
 	}
+	return size
+}
 
-	return len(n.Data)
+// isLeaf returns true if the node has no subnodes. Nodes either point to
+// a subnode on every side of their data or not at all so checking the
+// first pointer is enough.
+func (n *Node) isLeaf() bool {
+	return n.Pointers[0] == 0
 }
 
 func (n *Node) nodeIsFull() bool {
-	//Just check the last data point. If it is not zero then it is full
-	if n.Data[len(n.Data)-1].Key != 0 {
-		return true
-	}
-	return false
+	return n.count == len(n.Data)
 }
 
 func (n *Node) clear() {
 	for i := 0; i < len(n.Data); i++ {
-		n.Data[i].Key = 0
-		n.Data[i].Pointer = 0
+		n.Data[i] = Entry{}
 	}
 
 	for i := 0; i < len(n.Pointers); i++ {
 		n.Pointers[i] = 0
+		n.Counts[i] = 0
 	}
+	n.count = 0
 }
 
 func (n *Node) readLeftPtr(index int) (newNode *Node, err error) {
@@ -287,41 +954,57 @@ func (n *Node) readRightPtr(index int) (newNode *Node, err error) {
 }
 
 // IsValidAddress indicates if the given value is a valid node address
-// nodes are ussualy 752 bytes in lenght and therefore addresses occur
-// every 752 bytes.
-func IsValidAddress(addr int64) bool {
-	if addr >= 0 && addr%752 == 0 {
+// in a tree with the given page size. Nodes take up a whole page and
+// therefore addresses occur every pageSize bytes.
+func IsValidAddress(addr int64, pageSize int) bool {
+	if addr >= 0 && pageSize > 0 && addr%int64(pageSize) == 0 {
 		return true
 	}
 	return false
 }
 
-func insertInt64at(ara [32]int64, i int, val int64) [32]int64 {
+func writeNodes(nodes ...*Node) error {
+	for _, n := range nodes {
+		err := n.Write()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertInt64at(ara []int64, i int, val int64) []int64 {
 	copy(ara[i+1:], ara[i:])
 	ara[i] = val
 	return ara
 }
 
-func insertIndexAt(ara [31]Index, i int, val Index) [31]Index {
+func insertEntryAt(ara []Entry, i int, val Entry) []Entry {
 	copy(ara[i+1:], ara[i:])
 	ara[i] = val
 	return ara
 }
 
-func removeInt64at(ara [32]int64, i int) [32]int64 {
-	s := append(ara[:i], ara[i+1:]...)
-	newAra := new([32]int64)
-	for o, e := range s {
-		newAra[o] = e
-	}
-	return *newAra
+func insertUint64at(ara []uint64, i int, val uint64) []uint64 {
+	copy(ara[i+1:], ara[i:])
+	ara[i] = val
+	return ara
 }
 
-func removeIndexAt(ara [31]Index, i int) [31]Index {
-	s := append(ara[:i], ara[i+1:]...)
-	newAra := new([31]Index)
-	for o, e := range s {
-		newAra[o] = e
-	}
-	return *newAra
+func removeUint64at(ara []uint64, i int) []uint64 {
+	copy(ara[i:], ara[i+1:])
+	ara[len(ara)-1] = 0
+	return ara
+}
+
+func removeInt64at(ara []int64, i int) []int64 {
+	copy(ara[i:], ara[i+1:])
+	ara[len(ara)-1] = 0
+	return ara
+}
+
+func removeEntryAt(ara []Entry, i int) []Entry {
+	copy(ara[i:], ara[i+1:])
+	ara[len(ara)-1] = Entry{}
+	return ara
 }
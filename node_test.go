@@ -1,9 +1,8 @@
 package btree
 
 import (
+	"bytes"
 	"math/rand"
-	"os"
-	"path"
 	"testing"
 )
 
@@ -16,7 +15,7 @@ func TestNewNode(t *testing.T) {
 }
 
 func TestInsertInt64at(t *testing.T) {
-	ara := [32]int64{23, 45, 56, 78, 9}
+	ara := []int64{23, 45, 56, 78, 9, 0}
 	ara = insertInt64at(ara, 1, 67)
 	if ara[1] != 67 {
 		t.Error("Invalid value at the insertion point")
@@ -27,26 +26,27 @@ func TestInsertInt64at(t *testing.T) {
 	}
 }
 
-func TestInsertIndexAt(t *testing.T) {
-	ara := [31]Index{
-		Index{Key: 32, Pointer: 43},
-		Index{Key: 53, Pointer: 423},
-		Index{Key: 79, Pointer: 324},
-		Index{Key: 83, Pointer: 432},
-		Index{Key: 93, Pointer: 493},
-	}
-	ara = insertIndexAt(ara, 2, Index{Key: 5, Pointer: 32})
-	if ara[1].Key != 53 {
+func TestInsertEntryAt(t *testing.T) {
+	ara := []Entry{
+		entry(32, 43),
+		entry(53, 423),
+		entry(79, 324),
+		entry(83, 432),
+		entry(93, 493),
+		Entry{},
+	}
+	ara = insertEntryAt(ara, 2, entry(5, 32))
+	if keyOf(ara[1]) != 53 {
 		t.Error("invalid value right before insertion point")
-	} else if ara[2].Key != 5 {
+	} else if keyOf(ara[2]) != 5 {
 		t.Error("invalid value at the insertion point")
-	} else if ara[3].Key != 79 {
+	} else if keyOf(ara[3]) != 79 {
 		t.Error("invalid value right after the insertion point")
 	}
 }
 
 func TestRemoveInt64at(t *testing.T) {
-	var ara [32]int64
+	ara := make([]int64, 32)
 	ara[0] = 12
 	ara[1] = 59
 	ara[2] = 48
@@ -77,32 +77,32 @@ func TestRemoveInt64at(t *testing.T) {
 
 }
 
-func TestRemoveIndexAt(t *testing.T) {
-	var ara [31]Index
-	ara[0] = Index{Key: 12}
-	ara[1] = Index{Key: 59}
-	ara[2] = Index{Key: 48}
-	ara[3] = Index{Key: 45}
-	ara[4] = Index{Key: 392}
-	ara[5] = Index{Key: 323}
-
-	ara = removeIndexAt(ara, 2)
-	if ara[0].Key != 12 ||
-		ara[1].Key != 59 ||
-		ara[2].Key != 45 ||
-		ara[3].Key != 392 ||
-		ara[4].Key != 323 ||
-		ara[5].Key != 0 {
+func TestRemoveEntryAt(t *testing.T) {
+	ara := make([]Entry, 31)
+	ara[0] = entry(12, 0)
+	ara[1] = entry(59, 0)
+	ara[2] = entry(48, 0)
+	ara[3] = entry(45, 0)
+	ara[4] = entry(392, 0)
+	ara[5] = entry(323, 0)
+
+	ara = removeEntryAt(ara, 2)
+	if keyOf(ara[0]) != 12 ||
+		keyOf(ara[1]) != 59 ||
+		keyOf(ara[2]) != 45 ||
+		keyOf(ara[3]) != 392 ||
+		keyOf(ara[4]) != 323 ||
+		keyOf(ara[5]) != 0 {
 		t.Errorf("the array is not valid, first removal: %v", ara)
 		return
 	}
 
-	ara = removeIndexAt(ara, 0)
-	if ara[0].Key != 59 ||
-		ara[1].Key != 45 ||
-		ara[2].Key != 392 ||
-		ara[3].Key != 323 ||
-		ara[4].Key != 0 {
+	ara = removeEntryAt(ara, 0)
+	if keyOf(ara[0]) != 59 ||
+		keyOf(ara[1]) != 45 ||
+		keyOf(ara[2]) != 392 ||
+		keyOf(ara[3]) != 323 ||
+		keyOf(ara[4]) != 0 {
 		t.Errorf("the array is not valid, second removal: %v", ara)
 		return
 	}
@@ -110,39 +110,32 @@ func TestRemoveIndexAt(t *testing.T) {
 }
 
 func TestNodeSize(t *testing.T) {
-	dir := os.TempDir()
-	f := path.Join(dir, "test-node-size.bin")
-	//f = "test-node-size.bin"
-	tree, err := NewBTreeOnDisk(f)
-	if err != nil {
-		t.Error(err)
-		return
-	}
-
-	n, err := tree.NewNode()
-	if err != nil {
-		t.Error(err)
-		return
-	}
-
-	s := n.size()
-	if s != 0 {
-		t.Errorf("node size was supposed to be zero but was actually %v", s)
-	}
-
-	testKeys := []uint64{2, 4, 5, 8, 10, 67, 89}
-	for _, key := range testKeys {
-		err = n.insert(NewIndex(key, 1))
+	forEachBackend(t, "test-node-size.bin", func(t *testing.T, tree BTree) {
+		n, err := tree.NewNode()
 		if err != nil {
 			t.Error(err)
 			return
 		}
-	}
 
-	s = n.size()
-	if s != 7 {
-		t.Errorf("node size was supposed to be seven but was actually %v", s)
-	}
+		s := n.size()
+		if s != 0 {
+			t.Errorf("node size was supposed to be zero but was actually %v", s)
+		}
+
+		testKeys := []uint64{2, 4, 5, 8, 10, 67, 89}
+		for _, key := range testKeys {
+			err = n.insert(NewIndex(key, 1).entry())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		s = n.size()
+		if s != 7 {
+			t.Errorf("node size was supposed to be seven but was actually %v", s)
+		}
+	})
 }
 
 func TestToBinary(t *testing.T) {
@@ -153,27 +146,44 @@ func TestToBinary(t *testing.T) {
 		t.Error(err)
 	}
 
-	n.Data = [31]Index{
-		Index{Key: 2, Pointer: 23},
-		Index{Key: 3, Pointer: 67},
-		Index{Key: 4, Pointer: 78},
-		Index{Key: 6, Pointer: 89},
+	n.Data[0] = entry(2, 23)
+	n.Data[1] = entry(3, 67)
+	n.Data[2] = entry(4, 78)
+	n.Data[3] = entry(6, 89)
+	n.count = 4
+	copy(n.Pointers, []int64{1, 2, 3, 4, 5})
+
+	data, err := n.ToBinary()
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(data) != DefaultPageSize {
+		t.Errorf("the node was encoded into %v bytes, expected %v", len(data), DefaultPageSize)
 	}
-	n.Pointers = [32]int64{1, 2, 3, 4, 5}
 
-	_, err = n.ToBinary()
+	decoded, err := nodeFromBinary(data, 752, tree)
 	if err != nil {
 		t.Error(err)
+		return
+	}
+	for i := range n.Data {
+		if !bytes.Equal(decoded.Data[i].Key, n.Data[i].Key) || decoded.Data[i].Pointer != n.Data[i].Pointer {
+			t.Errorf("the entry at %v was decoded as %v, expected %v", i, decoded.Data[i], n.Data[i])
+		}
+	}
+	for i := range n.Pointers {
+		if decoded.Pointers[i] != n.Pointers[i] {
+			t.Errorf("the pointer at %v was decoded as %v, expected %v", i, decoded.Pointers[i], n.Pointers[i])
+		}
 	}
-	//TODO: Check binary data from this method
 }
 
 func TestIsValidAddress(t *testing.T) {
 	validAddrs := []int64{0, 752, 1504, 2256}
-	invalidAddrs := []int64{-1, -4, 10, 2, 5032, 3432}
+	invalidAddrs := []int64{-1, -4, 10, 2, 5032, 3432, 4096}
 
 	for _, addr := range validAddrs {
-		valid := IsValidAddress(addr)
+		valid := IsValidAddress(addr, 752)
 		if !valid {
 			t.Errorf("Valid node address of %v marked as invalid.", addr)
 			return
@@ -181,7 +191,7 @@ func TestIsValidAddress(t *testing.T) {
 	}
 
 	for _, addr := range invalidAddrs {
-		valid := IsValidAddress(addr)
+		valid := IsValidAddress(addr, 752)
 		if valid {
 			t.Errorf("Invalid node address of %v marked as valid.", addr)
 			return
@@ -209,7 +219,9 @@ func TestIsEmptyNode(t *testing.T) {
 		n.Pointers[0] = 0
 	}
 
-	n.Data[15] = Index{Key: 2, Pointer: 3253}
+	//Key 0 with a pointer of 0 is an entry like any other
+	n.Data[0] = entry(0, 0)
+	n.count = 1
 
 	if n.IsEmpty() {
 		t.Error("The node is supposed to have value and IsEmpty() returned that it does not!")
@@ -229,11 +241,9 @@ func TestNodeIsFull(t *testing.T) {
 
 	//Seed data
 	for i := 0; i < len(n.Data); i++ {
-		n.Data[i].Key = rand.Uint64()
-		for n.Data[i].Key == 0 {
-			n.Data[i].Key = rand.Uint64()
-		}
+		n.Data[i] = entry(rand.Uint64(), 1)
 	}
+	n.count = len(n.Data)
 
 	if !n.nodeIsFull() {
 		t.Error("node is full but reports as not full")
@@ -247,10 +257,11 @@ func TestFindMedianDataPoints(t *testing.T) {
 		t.Error(err)
 	}
 
-	n.Data[0] = Index{Key: 324, Pointer: 2}
-	n.Data[1] = Index{Key: 325, Pointer: 2}
-	n.Data[2] = Index{Key: 327, Pointer: 2}
-	n.Data[3] = Index{Key: 343, Pointer: 2}
+	n.Data[0] = entry(324, 2)
+	n.Data[1] = entry(325, 2)
+	n.Data[2] = entry(327, 2)
+	n.Data[3] = entry(343, 2)
+	n.count = 4
 
 	median, err := n.findMedianDataPoint()
 	if err != nil {
@@ -261,9 +272,10 @@ func TestFindMedianDataPoints(t *testing.T) {
 
 	//Check on an odd number of elements
 
-	n.Data[4] = Index{Key: 432, Pointer: 2}
-	n.Data[5] = Index{Key: 463, Pointer: 2}
-	n.Data[6] = Index{Key: 784, Pointer: 2}
+	n.Data[4] = entry(432, 2)
+	n.Data[5] = entry(463, 2)
+	n.Data[6] = entry(784, 2)
+	n.count = 7
 	median, err = n.findMedianDataPoint()
 	if err != nil {
 		t.Error(err)
@@ -273,159 +285,225 @@ func TestFindMedianDataPoints(t *testing.T) {
 }
 
 func TestSplitNode(t *testing.T) {
-	dir := os.TempDir()
-	f := path.Join(dir, "test-node-split.bin")
-	//f = "test-node-split.bin"
-	tree, err := NewBTreeOnDisk(f)
-	if err != nil {
-		t.Error(err)
-		return
-	}
-
-	n, err := tree.NewNode()
-	if err != nil {
-		t.Error(err)
-	}
+	forEachBackend(t, "test-node-split.bin", func(t *testing.T, tree BTree) {
+		n, err := tree.NewNode()
+		if err != nil {
+			t.Error(err)
+		}
 
-	n.Pointers[0] = 345
-	n.Data[0] = Index{Key: 324, Pointer: 2}
-	n.Pointers[1] = 7438
-	n.Data[1] = Index{Key: 325, Pointer: 3}
-	n.Pointers[2] = 3243
-	n.Data[2] = Index{Key: 327, Pointer: 4}
-	n.Pointers[3] = 4737
-	n.Data[3] = Index{Key: 343, Pointer: 5}
-	n.Pointers[4] = 435
-	n.Data[4] = Index{Key: 352, Pointer: 6}
-	n.Pointers[5] = 3490
-
-	err = n.Write()
-	if err != nil {
-		t.Error(err)
-	}
+		n.Pointers[0] = 345
+		n.Data[0] = entry(324, 2)
+		n.Pointers[1] = 7438
+		n.Data[1] = entry(325, 3)
+		n.Pointers[2] = 3243
+		n.Data[2] = entry(327, 4)
+		n.Pointers[3] = 4737
+		n.Data[3] = entry(343, 5)
+		n.Pointers[4] = 435
+		n.Data[4] = entry(352, 6)
+		n.count = 5
+		n.Pointers[5] = 3490
+
+		err = n.Write()
+		if err != nil {
+			t.Error(err)
+		}
 
-	n, err = n.splitIntoTwoSubnodes()
-	if err != nil {
-		t.Error(err)
-	}
+		n, err = n.splitIntoTwoSubnodes()
+		if err != nil {
+			t.Error(err)
+		}
 
-	if n.Data[0].Key != 327 {
-		t.Errorf("The computed top key is not right. Expected 327, got %v", n.Data[0].Key)
-	}
+		if keyOf(n.Data[0]) != 327 {
+			t.Errorf("The computed top key is not right. Expected 327, got %v", keyOf(n.Data[0]))
+		}
 
-	leftNode, err := n.readLeftPtr(0)
-	if err != nil {
-		t.Error(err)
-	} else if leftNode.Data[0].Key != 324 ||
-		leftNode.Pointers[0] != 345 {
-		t.Errorf("the left key has invalid data at index 0, expected data key to be 324 and left pointer to be 345, was actually %v and %v", leftNode.Data[0].Key, leftNode.Pointers[0])
-	} else if leftNode.Data[1].Key != 325 ||
-		leftNode.Pointers[1] != 7438 {
-		t.Errorf("the left key has invalid data at index 1, expected data key to be 325 and left pointer to be 7438, was actually %v and %v", leftNode.Data[1].Key, leftNode.Pointers[1])
-	} else if leftNode.Pointers[2] != 3243 {
-		t.Errorf("the left key has an invalid right pointer at index 1, expected 3243, got %v", leftNode.Pointers[2])
-	}
+		leftNode, err := n.readLeftPtr(0)
+		if err != nil {
+			t.Error(err)
+		} else if keyOf(leftNode.Data[0]) != 324 ||
+			leftNode.Pointers[0] != 345 {
+			t.Errorf("the left key has invalid data at index 0, expected data key to be 324 and left pointer to be 345, was actually %v and %v", keyOf(leftNode.Data[0]), leftNode.Pointers[0])
+		} else if keyOf(leftNode.Data[1]) != 325 ||
+			leftNode.Pointers[1] != 7438 {
+			t.Errorf("the left key has invalid data at index 1, expected data key to be 325 and left pointer to be 7438, was actually %v and %v", keyOf(leftNode.Data[1]), leftNode.Pointers[1])
+		} else if leftNode.Pointers[2] != 3243 {
+			t.Errorf("the left key has an invalid right pointer at index 1, expected 3243, got %v", leftNode.Pointers[2])
+		}
 
-	rightNode, err := n.readRightPtr(0)
-	if err != nil {
-		t.Error(err)
-	} else if rightNode.Data[0].Key != 343 ||
-		rightNode.Pointers[0] != 4737 {
-		t.Errorf("the left key has invalid data at index 0, expected data key to be 343 and left pointer to be 4737, was actually %v and %v", rightNode.Data[0].Key, rightNode.Pointers[0])
-	} else if rightNode.Data[1].Key != 352 ||
-		rightNode.Pointers[1] != 435 {
-		t.Errorf("the left key has invalid data at index 1, expected data key to be 352 and left pointer to be 435, was actually %v and %v", rightNode.Data[1].Key, rightNode.Pointers[1])
-	} else if rightNode.Pointers[2] != 3490 {
-		t.Errorf("the left key has an invalid right pointer at index 1, expected 3490, got %v", rightNode.Pointers[2])
-	}
+		rightNode, err := n.readRightPtr(0)
+		if err != nil {
+			t.Error(err)
+		} else if keyOf(rightNode.Data[0]) != 343 ||
+			rightNode.Pointers[0] != 4737 {
+			t.Errorf("the left key has invalid data at index 0, expected data key to be 343 and left pointer to be 4737, was actually %v and %v", keyOf(rightNode.Data[0]), rightNode.Pointers[0])
+		} else if keyOf(rightNode.Data[1]) != 352 ||
+			rightNode.Pointers[1] != 435 {
+			t.Errorf("the left key has invalid data at index 1, expected data key to be 352 and left pointer to be 435, was actually %v and %v", keyOf(rightNode.Data[1]), rightNode.Pointers[1])
+		} else if rightNode.Pointers[2] != 3490 {
+			t.Errorf("the left key has an invalid right pointer at index 1, expected 3490, got %v", rightNode.Pointers[2])
+		}
+	})
 }
 
 func TestQuery(t *testing.T) {
-	dir := os.TempDir()
-	f := path.Join(dir, "test-node-query.bin")
-	//f = "test-node-query.bin"
-	tree, err := NewBTreeOnDisk(f)
-	if err != nil {
-		t.Error(err)
-		return
-	}
+	forEachBackend(t, "test-node-query.bin", func(t *testing.T, tree BTree) {
+		n2, err := tree.NewNode()
+		if err != nil {
+			t.Error(err)
+		}
+		n2.Data[0] = entry(10, 78)
+		n2.Data[1] = entry(12, 93)
+		n2.count = 2
 
-	n, err := tree.NewNode()
-	if err != nil {
-		t.Error(err)
-	}
+		err = n2.Write()
+		if err != nil {
+			t.Error(err)
+		}
 
-	n.Pointers[0] = 752
-	n.Data[0] = Index{Key: 23, Pointer: 98}
-	n.Pointers[1] = 32423
+		n, err := tree.Root()
+		if err != nil {
+			t.Error(err)
+		}
 
-	err = n.Write()
-	if err != nil {
-		t.Error(err)
-	}
+		n.Pointers[0] = n2.Address
+		n.Data[0] = entry(23, 98)
+		n.count = 1
+		n.Pointers[1] = 32423
 
-	n2, err := tree.NewNode()
-	if err != nil {
-		t.Error(err)
-	}
-	n2.Data[0] = Index{Key: 10, Pointer: 78}
-	n2.Data[1] = Index{Key: 12, Pointer: 93}
-
-	err = n2.Write()
-	if err != nil {
-		t.Error(err)
-	}
+		err = n.Write()
+		if err != nil {
+			t.Error(err)
+		}
 
-	i, err := n.query(12)
-	if err != nil {
-		t.Error(err)
-	} else if i.Pointer != 93 {
-		t.Errorf("the returned index should have a pointer of 93 but had %v", i.Pointer)
-	}
+		i, err := n.query(Uint64Key(12))
+		if err != nil {
+			t.Error(err)
+		} else if i.Pointer != 93 {
+			t.Errorf("the returned index should have a pointer of 93 but had %v", i.Pointer)
+		}
+	})
 }
 
 func TestInsertIndex(t *testing.T) {
-	dir := os.TempDir()
-	f := path.Join(dir, "test-node-insert-index.bin")
-	//f = "test-node-insert-index.bin"
-	tree, err := NewBTreeOnDisk(f)
-	if err != nil {
-		t.Error(err)
-		return
-	}
+	forEachBackend(t, "test-node-insert-index.bin", func(t *testing.T, tree BTree) {
+		n, err := tree.NewNode()
+		if err != nil {
+			t.Error(err)
+		}
 
-	n, err := tree.NewNode()
-	if err != nil {
-		t.Error(err)
-	}
+		i1 := Index{Key: 30, Pointer: 78}
+		err = n.insert(i1.entry())
+		if err != nil {
+			t.Error(err)
+		} else if keyOf(n.Data[0]) != i1.Key && n.Data[0].Pointer != i1.Pointer {
+			t.Errorf("invalid insert of the first index. Expected key of %v and pointer of %v, got key of %v and pointer of %v", i1.Key, i1.Pointer, keyOf(n.Data[0]), n.Data[0].Pointer)
+		}
 
-	i1 := Index{Key: 30, Pointer: 78}
-	err = n.insert(&i1)
-	if err != nil {
-		t.Error(err)
-	} else if n.Data[0].Key != i1.Key && n.Data[0].Pointer != i1.Pointer {
-		t.Errorf("invalid insert of the first index. Expected key of %v and pointer of %v, got key of %v and pointer of %v", i1.Key, i1.Pointer, n.Data[0].Key, n.Data[0].Pointer)
-	}
+		i2 := Index{Key: 45, Pointer: 89}
+		err = n.insert(i2.entry())
+		if err != nil {
+			t.Error(err)
+		} else if keyOf(n.Data[0]) != i1.Key && n.Data[0].Pointer != i1.Pointer {
+			t.Errorf("invalid insert of the first index. Expected key of %v and pointer of %v, got key of %v and pointer of %v", i1.Key, i1.Pointer, keyOf(n.Data[0]), n.Data[0].Pointer)
+		} else if keyOf(n.Data[1]) != i2.Key && n.Data[1].Pointer != i2.Pointer {
+			t.Errorf("invalid insert of the second index. Expected key of %v and pointer of %v, got key of %v and pointer of %v", i2.Key, i2.Pointer, keyOf(n.Data[1]), n.Data[1].Pointer)
+		}
 
-	i2 := Index{Key: 45, Pointer: 89}
-	err = n.insert(&i2)
-	if err != nil {
-		t.Error(err)
-	} else if n.Data[0].Key != i1.Key && n.Data[0].Pointer != i1.Pointer {
-		t.Errorf("invalid insert of the first index. Expected key of %v and pointer of %v, got key of %v and pointer of %v", i1.Key, i1.Pointer, n.Data[0].Key, n.Data[0].Pointer)
-	} else if n.Data[1].Key != i2.Key && n.Data[1].Pointer != i2.Pointer {
-		t.Errorf("invalid insert of the second index. Expected key of %v and pointer of %v, got key of %v and pointer of %v", i2.Key, i2.Pointer, n.Data[1].Key, n.Data[1].Pointer)
-	}
+		i3 := Index{Key: 5, Pointer: 67}
+		err = n.insert(i3.entry())
+		if err != nil {
+			t.Error(err)
+		} else if keyOf(n.Data[0]) != i3.Key && n.Data[0].Pointer != i3.Pointer {
+			t.Errorf("invalid insert of the first index. Expected key of %v and pointer of %v, got key of %v and pointer of %v", i3.Key, i3.Pointer, keyOf(n.Data[0]), n.Data[0].Pointer)
+		} else if keyOf(n.Data[1]) != i1.Key && n.Data[1].Pointer != i1.Pointer {
+			t.Errorf("invalid insert of the second index. Expected key of %v and pointer of %v, got key of %v and pointer of %v", i1.Key, i1.Pointer, keyOf(n.Data[1]), n.Data[1].Pointer)
+		} else if keyOf(n.Data[2]) != i2.Key && n.Data[2].Pointer != i2.Pointer {
+			t.Errorf("invalid insert of the third index. Expected key of %v and pointer of %v, got key of %v and pointer of %v", i2.Key, i2.Pointer, keyOf(n.Data[2]), n.Data[2].Pointer)
+		}
+	})
+}
 
-	i3 := Index{Key: 5, Pointer: 67}
-	err = n.insert(&i3)
-	if err != nil {
-		t.Error(err)
-	} else if n.Data[0].Key != i3.Key && n.Data[0].Pointer != i3.Pointer {
-		t.Errorf("invalid insert of the first index. Expected key of %v and pointer of %v, got key of %v and pointer of %v", i3.Key, i3.Pointer, n.Data[0].Key, n.Data[0].Pointer)
-	} else if n.Data[1].Key != i1.Key && n.Data[1].Pointer != i1.Pointer {
-		t.Errorf("invalid insert of the second index. Expected key of %v and pointer of %v, got key of %v and pointer of %v", i1.Key, i1.Pointer, n.Data[1].Key, n.Data[1].Pointer)
-	} else if n.Data[2].Key != i2.Key && n.Data[2].Pointer != i2.Pointer {
-		t.Errorf("invalid insert of the third index. Expected key of %v and pointer of %v, got key of %v and pointer of %v", i2.Key, i2.Pointer, n.Data[2].Key, n.Data[2].Pointer)
-	}
+func TestRemove(t *testing.T) {
+	forEachBackend(t, "test-node-remove.bin", func(t *testing.T, tree BTree) {
+		left, err := tree.NewNode()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		//The left node gets the fewest keys a node can have, the right one
+		//has one to spare
+		minKeys := left.minKeys()
+		for i := 0; i < minKeys; i++ {
+			left.Data[i] = entry(uint64(i+1), 1)
+		}
+		left.count = minKeys
+		err = left.Write()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		right, err := tree.NewNode()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for i := 0; i < minKeys+1; i++ {
+			right.Data[i] = entry(uint64(i+51), 1)
+		}
+		right.count = minKeys + 1
+		err = right.Write()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		root, err := tree.Root()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		root.Data[0] = entry(50, 1)
+		root.count = 1
+		root.Pointers[0] = left.Address
+		root.Pointers[1] = right.Address
+		err = root.Write()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		//The left node is at its minimum so it has to borrow from the right node
+		err = root.remove(Uint64Key(3))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if keyOf(root.Data[0]) != 51 {
+			t.Errorf("expected the separating key to be 51 after borrowing, got %v", keyOf(root.Data[0]))
+		}
+		left, err = root.readLeftPtr(0)
+		if err != nil {
+			t.Error(err)
+		} else if left.size() != minKeys || keyOf(left.Data[minKeys-1]) != 50 {
+			t.Errorf("the left node was not topped up from the right node, got %v", left.Data)
+		}
+
+		//Both children are now at their minimum so they have to be merged
+		err = root.remove(Uint64Key(4))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !root.isLeaf() || root.size() != 2*minKeys {
+			t.Errorf("expected the root to take over the merged leaf with %v keys, got %v keys", 2*minKeys, root.size())
+		}
+		freed := availableAddresses(tree)
+		if len(freed) != 2 ||
+			!(freed[0] == right.Address && freed[1] == left.Address) &&
+				!(freed[0] == left.Address && freed[1] == right.Address) {
+			t.Errorf("expected the nodes at %v and %v to be freed, available addresses are %v", right.Address, left.Address, availableAddresses(tree))
+		}
+	})
 }
@@ -0,0 +1,176 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// overflowPageMagic marks a page that holds part of a value that was too
+// long to be stored in a node.
+const overflowPageMagic = 0x574f4c46_5245564f //"OVERFLOW"
+
+// overflowPageHeaderSize is the number of bytes at the start of an
+// overflow page, before the part of the value it holds.
+const overflowPageHeaderSize = 16
+
+// overflowPage is the header of a page in the chain of overflow pages of
+// a value. Every page holds as much of the value as fits after the
+// header, the last page has no next page.
+type overflowPage struct {
+	Magic uint64
+	Next  int64
+}
+
+// overflowRef is where an entry keeps its value when the value is longer
+// than the inline value size of the tree. It takes the place of the value
+// in the node and is read back when the entry is looked up.
+type overflowRef struct {
+	addr int64  //The first page of the chain, zero if the value is in the node
+	size uint32 //The length of the value
+}
+
+// overflowRefSize is the number of bytes an overflowRef takes in a node.
+const overflowRefSize = 12
+
+// maxValueSize is the length of the longest value a tree can store.
+const maxValueSize = math.MaxUint32
+
+// overflowReader is implemented by the trees whose entries can keep their
+// values in overflow pages, overflowWriter by the ones that can also add
+// them. Pages are handed out like the pages of nodes and given back with
+// RemoveNode.
+type overflowReader interface {
+	readOverflowPage(addr int64) (data []byte, err error)
+}
+
+type overflowWriter interface {
+	overflowReader
+	newOverflowPage() (addr int64, err error)
+	writeOverflowPage(addr int64, data []byte) error
+}
+
+// writeOverflow moves the value of entry to a new chain of overflow pages
+// if it is too long to be stored in a node of t. The pages are written
+// from the last one to the first so that every page is written as soon
+// as it is handed out and knows the page after it.
+func writeOverflow(t BTree, entry *Entry) error {
+	if len(entry.Value) <= t.InlineValueSize() {
+		return nil
+	}
+	w, ok := t.(overflowWriter)
+	if !ok {
+		return fmt.Errorf("the b-tree can not store a value of %v bytes in overflow pages", len(entry.Value))
+	}
+
+	chunk := t.PageSize() - overflowPageHeaderSize
+	var next int64
+	for end := len(entry.Value); end > 0; {
+		start := (end - 1) / chunk * chunk
+
+		addr, err := w.newOverflowPage()
+		if err != nil {
+			return err
+		}
+
+		data := make([]byte, t.PageSize())
+		binary.LittleEndian.PutUint64(data, overflowPageMagic)
+		binary.LittleEndian.PutUint64(data[8:], uint64(next))
+		copy(data[overflowPageHeaderSize:], entry.Value[start:end])
+		err = w.writeOverflowPage(addr, data)
+		if err != nil {
+			return err
+		}
+
+		next = addr
+		end = start
+	}
+
+	entry.overflow = overflowRef{addr: next, size: uint32(len(entry.Value))}
+	entry.Value = nil
+	return nil
+}
+
+// readOverflowPage reads the overflow page at addr and returns the
+// address of the next page of the chain and the part of the value the
+// page holds.
+func readOverflowPage(r overflowReader, addr int64) (next int64, part []byte, err error) {
+	data, err := r.readOverflowPage(addr)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var p overflowPage
+	err = binary.Read(bytes.NewReader(data), binary.LittleEndian, &p)
+	if err != nil {
+		return 0, nil, err
+	} else if p.Magic != overflowPageMagic {
+		return 0, nil, fmt.Errorf("the page at %v is not an overflow page", addr)
+	}
+	return p.Next, data[overflowPageHeaderSize:], nil
+}
+
+// loadValue reads the value of an entry that keeps it in overflow pages
+// into its Value.
+func loadValue(t BTree, entry *Entry) error {
+	if entry.overflow.addr == 0 {
+		return nil
+	}
+	r, ok := t.(overflowReader)
+	if !ok {
+		return fmt.Errorf("the b-tree can not read the overflow pages of the key %x", entry.Key)
+	}
+
+	value := make([]byte, 0, entry.overflow.size)
+	for addr := entry.overflow.addr; len(value) < cap(value); {
+		if addr == 0 {
+			return fmt.Errorf("the overflow pages of the key %x end after %v of %v bytes", entry.Key, len(value), cap(value))
+		}
+
+		next, part, err := readOverflowPage(r, addr)
+		if err != nil {
+			return err
+		}
+		if len(part) > cap(value)-len(value) {
+			part = part[:cap(value)-len(value)]
+		}
+		value = append(value, part...)
+		addr = next
+	}
+
+	entry.Value = value
+	entry.overflow = overflowRef{}
+	return nil
+}
+
+// freeOverflow hands the overflow pages of an entry back to the tree.
+func freeOverflow(t BTree, entry *Entry) error {
+	return overflowPages(t, entry, t.RemoveNode)
+}
+
+// overflowPages calls fn with the address of every overflow page of an
+// entry. The page after it is found before fn is called, so fn is free to
+// hand the page back.
+func overflowPages(t BTree, entry *Entry, fn func(addr int64) error) error {
+	if entry.overflow.addr == 0 {
+		return nil
+	}
+	r, ok := t.(overflowReader)
+	if !ok {
+		return fmt.Errorf("the b-tree can not read the overflow pages of the key %x", entry.Key)
+	}
+
+	for addr := entry.overflow.addr; addr != 0; {
+		next, _, err := readOverflowPage(r, addr)
+		if err != nil {
+			return err
+		}
+		err = fn(addr)
+		if err != nil {
+			return err
+		}
+		addr = next
+	}
+	return nil
+}
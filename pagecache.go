@@ -0,0 +1,245 @@
+package btree
+
+import (
+	"container/list"
+	"os"
+	"sort"
+	"sync"
+)
+
+// DefaultCacheSize is the number of pages a BTreeOnDisk keeps in memory
+// when it is created or opened without choosing a cache size.
+const DefaultCacheSize = 256
+
+// pageCache is a least recently used cache in front of the pages of a
+// file. Pages written to the cache are marked as dirty and only reach the
+// file when they are evicted or when the cache is flushed. Until they are
+// marked as logged dirty pages are also pending, pending pages are never
+// written to the file so the cache can go over its capacity while an
+// operation is in progress. The state a page was in before it became
+// pending is kept so that the pending pages can be rolled back.
+//
+// Several goroutines holding the read lock of the tree can read from the
+// cache at once, and inserts running in parallel write to it, so every
+// method takes the lock of the cache.
+type pageCache struct {
+	mu       sync.Mutex
+	file     *os.File
+	capacity int
+	pages    map[int64]*list.Element
+	lru      *list.List //The most recently used page is at the front
+	pending  map[int64]*cachedPage
+	undo     map[int64]*cachedPage //nil for pending pages that were not cached
+
+	hits   uint64
+	misses uint64
+}
+
+type cachedPage struct {
+	addr    int64
+	data    []byte
+	dirty   bool
+	pending bool
+}
+
+func newPageCache(file *os.File, capacity int) *pageCache {
+	return &pageCache{
+		file:     file,
+		capacity: capacity,
+		pages:    make(map[int64]*list.Element),
+		lru:      list.New(),
+		pending:  make(map[int64]*cachedPage),
+		undo:     make(map[int64]*cachedPage),
+	}
+}
+
+// read returns the page of the given size at addr, reading it from the
+// file if it is not cached. The returned bytes are shared with the cache
+// and must not be modified.
+func (c *pageCache) read(addr int64, size int) (data []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.pages[addr]; ok {
+		c.hits++
+		c.lru.MoveToFront(e)
+		return e.Value.(*cachedPage).data, nil
+	}
+
+	c.misses++
+	data = make([]byte, size)
+	_, err = c.file.ReadAt(data, addr)
+	if err != nil {
+		return nil, err
+	}
+	return data, c.add(&cachedPage{addr: addr, data: data})
+}
+
+// readCommitted is read for the page at addr as it was before it became
+// pending. A pending page that was not cached then is read from the
+// file, which pending pages never reach.
+func (c *pageCache) readCommitted(addr int64, size int) (data []byte, err error) {
+	c.mu.Lock()
+	_, pending := c.pending[addr]
+	before := c.undo[addr]
+	c.mu.Unlock()
+
+	if !pending {
+		return c.read(addr, size)
+	} else if before != nil {
+		return before.data, nil
+	}
+	data = make([]byte, size)
+	_, err = c.file.ReadAt(data, addr)
+	return data, err
+}
+
+// write puts the page at addr into the cache and marks it as dirty and
+// pending. The cache keeps data so it must not be modified afterwards.
+func (c *pageCache) write(addr int64, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.pages[addr]; ok {
+		p := e.Value.(*cachedPage)
+		if !p.pending {
+			c.undo[addr] = &cachedPage{addr: addr, data: p.data, dirty: p.dirty}
+		}
+		p.data = data
+		p.dirty = true
+		p.pending = true
+		c.pending[addr] = p
+		c.lru.MoveToFront(e)
+		return nil
+	}
+
+	p := &cachedPage{addr: addr, data: data, dirty: true, pending: true}
+	c.pending[addr] = p
+	c.undo[addr] = nil
+	return c.add(p)
+}
+
+// pendingPages returns the pages written since they were last marked as
+// logged in address order.
+func (c *pageCache) pendingPages() (pages []walPage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range c.pending {
+		pages = append(pages, walPage{Address: p.addr, Data: p.data})
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Address < pages[j].Address })
+	return pages
+}
+
+// markLogged clears the pending pages once they are in the write-ahead
+// log. From then on they can be written to the file.
+func (c *pageCache) markLogged() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for addr, p := range c.pending {
+		p.pending = false
+		delete(c.pending, addr)
+		delete(c.undo, addr)
+	}
+}
+
+// rollback puts every pending page back into the state it was in before
+// it was first written. Pages that were not cached then are dropped so
+// they are read from the file again.
+func (c *pageCache) rollback() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for addr, p := range c.pending {
+		if before := c.undo[addr]; before != nil {
+			p.data = before.data
+			p.dirty = before.dirty
+			p.pending = false
+		} else {
+			c.lru.Remove(c.pages[addr])
+			delete(c.pages, addr)
+		}
+		delete(c.pending, addr)
+		delete(c.undo, addr)
+	}
+	return c.evict()
+}
+
+// add puts a page that is not cached yet at the front of the cache and
+// evicts the least recently used pages that are not pending until the
+// cache is back within its capacity. Dirty pages are written to the file
+// as they are evicted. add and evict are called with the lock held.
+func (c *pageCache) add(p *cachedPage) error {
+	c.pages[p.addr] = c.lru.PushFront(p)
+	return c.evict()
+}
+
+func (c *pageCache) evict() error {
+	e := c.lru.Back()
+	for c.lru.Len() > c.capacity && e != nil {
+		prev := e.Prev()
+		old := e.Value.(*cachedPage)
+		if old.pending {
+			e = prev
+			continue
+		} else if old.dirty {
+			_, err := c.file.WriteAt(old.data, old.addr)
+			if err != nil {
+				return err
+			}
+		}
+		c.lru.Remove(e)
+		delete(c.pages, old.addr)
+		e = prev
+	}
+	return nil
+}
+
+// flush writes every dirty page that is not pending to the file in
+// address order and syncs the file to disk. The pages stay in the cache.
+func (c *pageCache) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.writeDirty()
+	if err != nil {
+		return err
+	}
+
+	err = c.file.Sync()
+	if err != nil {
+		return err
+	}
+	return c.evict()
+}
+
+// flushPages is flush without syncing the file.
+func (c *pageCache) flushPages() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeDirty()
+}
+
+// writeDirty writes the dirty pages that are not pending to the file. It
+// is called with the lock held.
+func (c *pageCache) writeDirty() error {
+	var dirty []*cachedPage
+	for _, e := range c.pages {
+		p := e.Value.(*cachedPage)
+		if p.dirty && !p.pending {
+			dirty = append(dirty, p)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].addr < dirty[j].addr })
+
+	for _, p := range dirty {
+		_, err := c.file.WriteAt(p.data, p.addr)
+		if err != nil {
+			return err
+		}
+		p.dirty = false
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package btree
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPageCacheEviction(t *testing.T) {
+	f, err := os.Create(path.Join(os.TempDir(), "test-page-cache-eviction.bin"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer f.Close()
+
+	c := newPageCache(f, 4)
+	for i := int64(0); i < 10; i++ {
+		err = c.write(i*16, bytes.Repeat([]byte{byte(i + 1)}, 16))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c.markLogged()
+	}
+
+	if c.lru.Len() != 4 || len(c.pages) != 4 {
+		t.Errorf("the cache holds %v pages, expected its capacity of 4", c.lru.Len())
+	}
+
+	//The evicted pages have been written to the file
+	data := make([]byte, 16)
+	_, err = f.ReadAt(data, 0)
+	if err != nil {
+		t.Error(err)
+	} else if data[0] != 1 {
+		t.Errorf("the first page was not written to the file when it was evicted, got %v", data)
+	}
+
+	for i := int64(0); i < 10; i++ {
+		data, err := c.read(i*16, 16)
+		if err != nil {
+			t.Error(err)
+		} else if data[0] != byte(i+1) {
+			t.Errorf("the page at %v holds %v, expected %v", i*16, data[0], i+1)
+		}
+	}
+}
+
+func TestPageCacheHits(t *testing.T) {
+	f, err := os.Create(path.Join(os.TempDir(), "test-page-cache-hits.bin"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer f.Close()
+
+	_, err = f.Write(make([]byte, 64))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	c := newPageCache(f, 2)
+	for i := 0; i < 3; i++ {
+		_, err = c.read(0, 16)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if c.misses != 1 || c.hits != 2 {
+		t.Errorf("reading a page three times had %v misses and %v hits, expected 1 and 2", c.misses, c.hits)
+	}
+
+	//Reading two other pages pushes the first one out
+	c.read(16, 16)
+	c.read(32, 16)
+	c.read(0, 16)
+	if c.misses != 4 {
+		t.Errorf("the least recently used page was not evicted, %v misses", c.misses)
+	}
+}
+
+func TestPageCacheFlush(t *testing.T) {
+	f, err := os.Create(path.Join(os.TempDir(), "test-page-cache-flush.bin"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer f.Close()
+
+	c := newPageCache(f, 8)
+	err = c.write(16, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	//Pending pages are not flushed until they are logged
+	err = c.flush()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Error(err)
+	} else if stat.Size() != 0 {
+		t.Errorf("a pending page was written to the file when the cache was flushed")
+	}
+
+	c.markLogged()
+	err = c.flush()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data := make([]byte, 16)
+	_, err = f.ReadAt(data, 16)
+	if err != nil {
+		t.Error(err)
+	} else if string(data) != "0123456789abcdef" {
+		t.Errorf("the flushed page holds %q", data)
+	} else if c.pages[16].Value.(*cachedPage).dirty {
+		t.Error("the page is still dirty after the cache was flushed")
+	}
+}
+
+func TestPageCachePending(t *testing.T) {
+	f, err := os.Create(path.Join(os.TempDir(), "test-page-cache-pending.bin"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer f.Close()
+
+	c := newPageCache(f, 2)
+	for i := int64(0); i < 5; i++ {
+		err = c.write(i*16, bytes.Repeat([]byte{byte(i + 1)}, 16))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	if c.lru.Len() != 5 {
+		t.Errorf("the cache holds %v pages, expected all 5 pending pages", c.lru.Len())
+	}
+	if pages := c.pendingPages(); len(pages) != 5 || pages[0].Address != 0 || pages[4].Address != 64 {
+		t.Errorf("the pending pages are %v, expected the 5 written pages in address order", pages)
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		t.Error(err)
+	} else if stat.Size() != 0 {
+		t.Error("a pending page was written to the file")
+	}
+
+	//Once logged the pages can be evicted again
+	c.markLogged()
+	err = c.write(80, make([]byte, 16))
+	if err != nil {
+		t.Error(err)
+	} else if c.lru.Len() != 2 {
+		t.Errorf("the cache holds %v pages after the pending pages were logged, expected its capacity of 2", c.lru.Len())
+	} else if _, ok := c.pages[80]; !ok {
+		t.Error("the new pending page was evicted")
+	}
+}
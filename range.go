@@ -0,0 +1,212 @@
+package btree
+
+// RangeOptions changes which of the indexes between two keys a range
+// query returns. The zero value includes both bounds, returns every
+// matching index and walks them in ascending key order.
+type RangeOptions struct {
+	ExcludeLo bool // Leave out the index with the lower bound as its key
+	ExcludeHi bool // Leave out the index with the upper bound as its key
+	Limit     int  // Stop after this many indexes, zero means no limit
+	Reverse   bool // Walk the indexes in descending key order
+}
+
+// rangeBounds are the bounds of a range query. A nil bound leaves that
+// end of the range open.
+type rangeBounds struct {
+	compare   func(a []byte, b []byte) int
+	lo        []byte
+	hi        []byte
+	excludeLo bool
+	excludeHi bool
+}
+
+// belowLo returns true if key comes before the range.
+func (b *rangeBounds) belowLo(key []byte) bool {
+	if b.lo == nil {
+		return false
+	}
+	c := b.compare(key, b.lo)
+	return c < 0 || c == 0 && b.excludeLo
+}
+
+// aboveHi returns true if key comes after the range.
+func (b *rangeBounds) aboveHi(key []byte) bool {
+	if b.hi == nil {
+		return false
+	}
+	c := b.compare(key, b.hi)
+	return c > 0 || c == 0 && b.excludeHi
+}
+
+// empty returns true if no key can fall in the range.
+func (b *rangeBounds) empty() bool {
+	if b.lo == nil || b.hi == nil {
+		return false
+	}
+	c := b.compare(b.lo, b.hi)
+	return c > 0 || c == 0 && (b.excludeLo || b.excludeHi)
+}
+
+// rangeEntries calls fn for every entry of the tree with a key between lo
+// and hi until fn returns false. A nil lo or hi leaves that end of the
+// range open. Only the subnodes whose keys can fall in the range are
+// read.
+func rangeEntries(t BTree, lo []byte, hi []byte, opts *RangeOptions, fn func(entry *Entry) bool) (err error) {
+	return walkEntries(t, lo, hi, opts, true, fn)
+}
+
+// walkEntries is rangeEntries that only reads the values kept in overflow
+// pages if load is true.
+func walkEntries(t BTree, lo []byte, hi []byte, opts *RangeOptions, load bool, fn func(entry *Entry) bool) (err error) {
+	if opts == nil {
+		opts = new(RangeOptions)
+	}
+
+	b := &rangeBounds{compare: t.Compare, lo: lo, hi: hi, excludeLo: opts.ExcludeLo, excludeHi: opts.ExcludeHi}
+	if b.empty() {
+		return nil
+	}
+
+	count := 0
+	var loadErr error
+	limited := func(entry *Entry) bool {
+		if load {
+			loadErr = loadValue(t, entry)
+			if loadErr != nil {
+				return false
+			}
+		}
+
+		count++
+		more := fn(entry)
+		return more && (opts.Limit <= 0 || count < opts.Limit)
+	}
+
+	root, unlatch, err := readRootLatched(t, false)
+	if err != nil {
+		return err
+	}
+	defer unlatch()
+
+	if opts.Reverse {
+		_, err = root.walkRangeReverse(b, limited)
+	} else {
+		_, err = root.walkRange(b, limited)
+	}
+	return firstError(err, loadErr)
+}
+
+func collectEntries(t BTree, lo []byte, hi []byte, opts *RangeOptions) (entries []Entry, err error) {
+	err = rangeEntries(t, lo, hi, opts, func(entry *Entry) bool {
+		entries = append(entries, *entry)
+		return true
+	})
+	return entries, err
+}
+
+// rangeIndexes is rangeEntries for uint64 keys. It returns an error if it
+// comes across a key in the range that is not a uint64 key. Values are
+// not read as an index has no room for them.
+func rangeIndexes(t BTree, lo uint64, hi uint64, opts *RangeOptions, fn func(index *Index) bool) (err error) {
+	var indexErr error
+	err = walkEntries(t, Uint64Key(lo), Uint64Key(hi), opts, false, func(entry *Entry) bool {
+		index, err := entry.index()
+		if err != nil {
+			indexErr = err
+			return false
+		}
+		return fn(index)
+	})
+	return firstError(err, indexErr)
+}
+
+func collectRange(t BTree, lo uint64, hi uint64, opts *RangeOptions) (indexes []Index, err error) {
+	err = rangeIndexes(t, lo, hi, opts, func(index *Index) bool {
+		indexes = append(indexes, *index)
+		return true
+	})
+	return indexes, err
+}
+
+// walkRange calls fn in ascending order for the entries in the subtree of
+// this node with keys within the bounds. It returns false once the walk
+// should stop, either because fn asked for it or because a key past the
+// upper bound was reached. The latches of the nodes on the way down to
+// the node being walked are held for reading.
+func (n *Node) walkRange(b *rangeBounds, fn func(entry *Entry) bool) (more bool, err error) {
+	x := 0
+	if b.lo != nil {
+		x, _ = n.search(b.lo)
+	}
+	size := n.size()
+
+	for i := x; i <= size; i++ {
+		if n.Pointers[i] != 0 {
+			child, unlatch, err := readLatched(n.tree, n.Pointers[i], false)
+			if err != nil {
+				return false, err
+			}
+
+			more, err = child.walkRange(b, fn)
+			unlatch()
+			if !more || err != nil {
+				return false, err
+			}
+		}
+
+		if i == size {
+			break
+		} else if b.aboveHi(n.Data[i].Key) {
+			return false, nil
+		} else if b.belowLo(n.Data[i].Key) {
+			continue
+		}
+
+		entry := n.Data[i]
+		if !fn(&entry) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// walkRangeReverse is walkRange in descending key order.
+func (n *Node) walkRangeReverse(b *rangeBounds, fn func(entry *Entry) bool) (more bool, err error) {
+	x := n.size()
+	if b.hi != nil {
+		var found bool
+		x, found = n.search(b.hi)
+		if found {
+			x++
+		}
+	}
+
+	for i := x; i >= 0; i-- {
+		if n.Pointers[i] != 0 {
+			child, unlatch, err := readLatched(n.tree, n.Pointers[i], false)
+			if err != nil {
+				return false, err
+			}
+
+			more, err = child.walkRangeReverse(b, fn)
+			unlatch()
+			if !more || err != nil {
+				return false, err
+			}
+		}
+
+		if i == 0 {
+			break
+		} else if b.belowLo(n.Data[i-1].Key) {
+			return false, nil
+		} else if b.aboveHi(n.Data[i-1].Key) {
+			continue
+		}
+
+		entry := n.Data[i-1]
+		if !fn(&entry) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,191 @@
+package btree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// countingTree counts the nodes read through it so tests can check how
+// much of a tree an operation touches.
+type countingTree struct {
+	BTree
+	reads int
+}
+
+func (c *countingTree) ReadNode(address int64) (n *Node, err error) {
+	c.reads++
+	n, err = c.BTree.ReadNode(address)
+	if n != nil {
+		n.tree = c
+	}
+	return n, err
+}
+
+func (c *countingTree) Root() (n *Node, err error) {
+	c.reads++
+	n, err = c.BTree.Root()
+	if n != nil {
+		n.tree = c
+	}
+	return n, err
+}
+
+func expectedRange(sorted []uint64, lo uint64, hi uint64, opts *RangeOptions) []uint64 {
+	var keys []uint64
+	for _, key := range sorted {
+		if key < lo || key > hi ||
+			(opts.ExcludeLo && key == lo) ||
+			(opts.ExcludeHi && key == hi) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	if opts.Reverse {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+	if opts.Limit > 0 && len(keys) > opts.Limit {
+		keys = keys[:opts.Limit]
+	}
+	return keys
+}
+
+func TestRange(t *testing.T) {
+	forEachBackend(t, "test-range.bin", func(t *testing.T, tree BTree) {
+		keys := randomKeys(2000)
+		insertKeys(t, tree, keys)
+		sorted := sortedKeys(keys)
+		max := sorted[len(sorted)-1]
+
+		for i := 0; i < 200; i++ {
+			lo := uint64(rand.Int63n(int64(max) + 10))
+			hi := lo + uint64(rand.Int63n(int64(max)/4))
+			if i%10 == 0 {
+				//Make sure the bounds themselves are in the tree
+				lo = sorted[rand.Intn(len(sorted)/2)]
+				hi = sorted[len(sorted)/2+rand.Intn(len(sorted)/2)]
+			}
+
+			opts := RangeOptions{
+				ExcludeLo: rand.Intn(2) == 0,
+				ExcludeHi: rand.Intn(2) == 0,
+				Reverse:   rand.Intn(2) == 0,
+			}
+			if rand.Intn(3) == 0 {
+				opts.Limit = rand.Intn(50) + 1
+			}
+
+			indexes, err := tree.Range(lo, hi, &opts)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			expected := expectedRange(sorted, lo, hi, &opts)
+			if len(indexes) != len(expected) {
+				t.Errorf("the range %v to %v with %+v returned %v indexes, expected %v", lo, hi, opts, len(indexes), len(expected))
+				return
+			}
+			for x, index := range indexes {
+				if index.Key != expected[x] || index.Pointer != int64(expected[x])*2 {
+					t.Errorf("the range %v to %v with %+v returned %v at position %v, expected key %v", lo, hi, opts, index, x, expected[x])
+					return
+				}
+			}
+		}
+	})
+}
+
+func TestRangeBounds(t *testing.T) {
+	forEachBackend(t, "test-range-bounds.bin", func(t *testing.T, tree BTree) {
+		insertKeys(t, tree, []uint64{0x10, 0x20, 0x30, maxInt64})
+
+		indexes, err := tree.Range(0x20, 0x10, nil)
+		if err != nil {
+			t.Error(err)
+		} else if len(indexes) != 0 {
+			t.Errorf("a range with the bounds the wrong way round returned %v", indexes)
+		}
+
+		indexes, err = tree.Range(0x20, 0x20, &RangeOptions{ExcludeLo: true})
+		if err != nil {
+			t.Error(err)
+		} else if len(indexes) != 0 {
+			t.Errorf("an empty exclusive range returned %v", indexes)
+		}
+
+		indexes, err = tree.Range(0, maxInt64, &RangeOptions{ExcludeHi: true})
+		if err != nil {
+			t.Error(err)
+		} else if len(indexes) != 3 || indexes[2].Key != 0x30 {
+			t.Errorf("a range over every key but the largest returned %v", indexes)
+		}
+
+		indexes, err = tree.Range(maxInt64, maxInt64, nil)
+		if err != nil {
+			t.Error(err)
+		} else if len(indexes) != 1 || indexes[0].Key != maxInt64 {
+			t.Errorf("a range over the largest possible key returned %v", indexes)
+		}
+	})
+}
+
+func TestRangeFuncStopsEarly(t *testing.T) {
+	forEachBackend(t, "test-range-func.bin", func(t *testing.T, tree BTree) {
+		keys := randomKeys(500)
+		insertKeys(t, tree, keys)
+		sorted := sortedKeys(keys)
+
+		var seen []uint64
+		err := tree.RangeFunc(0, maxInt64, nil, func(index *Index) bool {
+			seen = append(seen, index.Key)
+			return len(seen) < 5
+		})
+		if err != nil {
+			t.Error(err)
+		} else if len(seen) != 5 {
+			t.Errorf("the walk did not stop when asked to, it returned %v keys", len(seen))
+		} else {
+			for i, key := range seen {
+				if key != sorted[i] {
+					t.Errorf("the walk returned %v at position %v, expected %v", key, i, sorted[i])
+				}
+			}
+		}
+	})
+}
+
+func TestRangePrunesSubnodes(t *testing.T) {
+	forEachBackend(t, "test-range-prune.bin", func(t *testing.T, tree BTree) {
+		keys := randomKeys(5000)
+		insertKeys(t, tree, keys)
+		sorted := sortedKeys(keys)
+
+		height, err := checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		counter := &countingTree{BTree: tree}
+		lo := sorted[2500]
+		hi := sorted[2502]
+		var found []uint64
+		err = rangeIndexes(counter, lo, hi, nil, func(index *Index) bool {
+			found = append(found, index.Key)
+			return true
+		})
+		if err != nil {
+			t.Error(err)
+		} else if len(found) != 3 {
+			t.Errorf("the range %v to %v returned %v, expected three keys", lo, hi, found)
+		}
+
+		//A short range can at most cross into one extra path from the root
+		if counter.reads > 2*height {
+			t.Errorf("the range query read %v nodes in a tree of height %v", counter.reads, height)
+		}
+	})
+}
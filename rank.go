@@ -0,0 +1,122 @@
+package btree
+
+import "fmt"
+
+// rankKey returns the number of entries in the tree with keys before key,
+// or up to and including key if inclusive is true. The key does not have
+// to be in the tree. It takes a single descent from the root, adding up
+// the counts of the subtrees and the entries left of the path.
+func rankKey(t BTree, key []byte, inclusive bool) (rank uint64, err error) {
+	n, unlatch, err := readRootLatched(t, false)
+	if err != nil {
+		return 0, err
+	}
+	return n.rankLatched(key, inclusive, unlatch)
+}
+
+// rankLatched is rankKey for the subtree of a node whose latch is held,
+// see latcher.
+func (n *Node) rankLatched(key []byte, inclusive bool, unlatch func()) (rank uint64, err error) {
+	x, found := n.search(key)
+	rank = uint64(x)
+	for _, c := range n.Counts[:x] {
+		rank += c
+	}
+	if found {
+		unlatch()
+		rank += n.Counts[x]
+		if inclusive {
+			rank++
+		}
+		return rank, nil
+	} else if n.Pointers[x] == 0 {
+		unlatch()
+		return rank, nil
+	}
+
+	child, childUnlatch, err := readLatched(n.tree, n.Pointers[x], false)
+	unlatch()
+	if err != nil {
+		return 0, err
+	}
+	below, err := child.rankLatched(key, inclusive, childUnlatch)
+	return rank + below, err
+}
+
+// selectEntry returns the entry at position i of the tree in key order,
+// counting from zero. The counts lead straight to the node that holds it.
+// A value kept in overflow pages is left unread, see loadValue.
+func selectEntry(t BTree, i uint64) (entry *Entry, err error) {
+	n, unlatch, err := readRootLatched(t, false)
+	if err != nil {
+		return nil, err
+	}
+	entry, err = n.selectLatched(i, unlatch)
+	if err != nil {
+		return nil, err
+	} else if entry == nil {
+		return nil, fmt.Errorf("there is no entry at position %v, the b-tree holds fewer entries", i)
+	}
+	return entry, nil
+}
+
+// selectLatched is selectEntry for the subtree of a node whose latch is
+// held, see latcher. It returns a nil entry if the subtree holds no more
+// than i entries.
+func (n *Node) selectLatched(i uint64, unlatch func()) (entry *Entry, err error) {
+	size := n.size()
+	for x := 0; x <= size; x++ {
+		if i < n.Counts[x] {
+			child, childUnlatch, err := readLatched(n.tree, n.Pointers[x], false)
+			unlatch()
+			if err != nil {
+				return nil, err
+			}
+			return child.selectLatched(i, childUnlatch)
+		}
+		i -= n.Counts[x]
+
+		if x < size && i == 0 {
+			d := n.Data[x]
+			unlatch()
+			return &d, nil
+		} else if x < size {
+			i--
+		}
+	}
+	unlatch()
+	return nil, nil
+}
+
+// rankIndex, selectIndex and countRange are the order statistics of the
+// tree for uint64 keys.
+
+func rankIndex(t BTree, key uint64) (rank uint64, err error) {
+	return rankKey(t, Uint64Key(key), false)
+}
+
+func selectIndex(t BTree, i uint64) (index *Index, err error) {
+	entry, err := selectEntry(t, i)
+	if err != nil {
+		return nil, err
+	}
+	return entry.index()
+}
+
+// countRange counts the keys from lo to hi, both included, as the
+// difference of two ranks. The lower rank is taken first, so keys that
+// are inserted in between can only add to the count.
+func countRange(t BTree, lo uint64, hi uint64) (count uint64, err error) {
+	if t.Compare(Uint64Key(lo), Uint64Key(hi)) > 0 {
+		return 0, nil
+	}
+	below, err := rankKey(t, Uint64Key(lo), false)
+	if err != nil {
+		return 0, err
+	}
+	upTo, err := rankKey(t, Uint64Key(hi), true)
+	if err != nil {
+		return 0, err
+	}
+	return upTo - below, nil
+}
@@ -0,0 +1,209 @@
+package btree
+
+import (
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+// ranker is implemented by the trees and the transactions that answer
+// order statistics.
+type ranker interface {
+	Rank(key uint64) (rank uint64, err error)
+	Select(i uint64) (index *Index, err error)
+	CountRange(lo uint64, hi uint64) (count uint64, err error)
+}
+
+// checkRanks checks Rank, Select and CountRange of a tree against the
+// sorted keys it holds.
+func checkRanks(t *testing.T, tree ranker, sorted []uint64) {
+	for i, key := range sorted {
+		rank, err := tree.Rank(key)
+		if err != nil {
+			t.Error(err)
+		} else if rank != uint64(i) {
+			t.Errorf("the key %v has a rank of %v, expected %v", key, rank, i)
+		}
+
+		//The keys of randomKeys leave gaps of two
+		rank, err = tree.Rank(key + 1)
+		if err != nil {
+			t.Error(err)
+		} else if rank != uint64(i+1) {
+			t.Errorf("the missing key %v has a rank of %v, expected %v", key+1, rank, i+1)
+		}
+
+		index, err := tree.Select(uint64(i))
+		if err != nil {
+			t.Error(err)
+		} else if index.Key != key {
+			t.Errorf("position %v holds the key %v, expected %v", i, index.Key, key)
+		}
+	}
+
+	_, err := tree.Select(uint64(len(sorted)))
+	if err == nil {
+		t.Errorf("a key was selected past the last of %v keys", len(sorted))
+	}
+
+	for i := 0; i < 200; i++ {
+		lo, hi := uint64(rand.Intn(len(sorted)*3+4)), uint64(rand.Intn(len(sorted)*3+4))
+		expected := 0
+		for _, key := range sorted {
+			if key >= lo && key <= hi {
+				expected++
+			}
+		}
+		count, err := tree.CountRange(lo, hi)
+		if err != nil {
+			t.Error(err)
+		} else if count != uint64(expected) {
+			t.Errorf("the range from %v to %v holds %v keys, expected %v", lo, hi, count, expected)
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	forEachBackend(t, "test-rank.bin", func(t *testing.T, tree BTree) {
+		rank, err := tree.Rank(10)
+		if err != nil {
+			t.Error(err)
+		} else if rank != 0 {
+			t.Errorf("a key in an empty tree has a rank of %v", rank)
+		}
+		_, err = tree.Select(0)
+		if err == nil {
+			t.Error("a key was selected from an empty tree")
+		}
+
+		keys := randomKeys(3000)
+		insertKeys(t, tree, keys)
+		checkRanks(t, tree, sortedKeys(keys))
+
+		for _, key := range keys[:1500] {
+			err = tree.RemoveIndex(key)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		_, err = checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+		checkRanks(t, tree, sortedKeys(keys[1500:]))
+
+		count, err := tree.CountRange(maxInt64, 0)
+		if err != nil {
+			t.Error(err)
+		} else if count != 0 {
+			t.Errorf("a range with its bounds the wrong way round holds %v keys", count)
+		}
+	})
+}
+
+func TestRankInsertBatch(t *testing.T) {
+	forEachBackend(t, "test-rank-batch.bin", func(t *testing.T, tree BTree) {
+		keys := randomKeys(2000)
+		insertKeys(t, tree, keys[:500])
+
+		//Failed keys are not counted
+		batch := make([]Index, 0, 1600)
+		for _, key := range keys[400:] {
+			batch = append(batch, Index{Key: key, Pointer: int64(key)})
+		}
+		err := tree.InsertBatch(batch)
+		if err == nil {
+			t.Error("a batch with keys already in the tree did not return an error")
+		}
+		_, err = checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+		checkRanks(t, tree, sortedKeys(keys))
+	})
+}
+
+func TestRankSnapshot(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-rank-snapshot.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CopyOnWrite: true, NoSync: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	keys := randomKeys(1000)
+	insertKeys(t, tree, keys)
+	s, err := tree.Snapshot()
+	if err != nil {
+		t.Error(err)
+		tree.Close()
+		return
+	}
+
+	for _, key := range keys[:500] {
+		err = tree.RemoveIndex(key)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	checkRanks(t, s, sortedKeys(keys))
+	checkRanks(t, tree, sortedKeys(keys[500:]))
+	err = s.Release()
+	if err != nil {
+		t.Error(err)
+	}
+
+	//The counts are kept in the file
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+	checkRanks(t, tree, sortedKeys(keys[500:]))
+}
+
+func TestRankTx(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-rank-tx.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{NoSync: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	tx, err := tree.Begin(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	keys := randomKeys(500)
+	for _, key := range keys {
+		err = tx.InsertIndex(NewIndex(key, 0))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	//The transaction counts its own keys
+	checkRanks(t, tx, sortedKeys(keys))
+	err = tx.Rollback()
+	if err != nil {
+		t.Error(err)
+	}
+
+	count, err := tree.CountRange(0, maxInt64)
+	if err != nil {
+		t.Error(err)
+	} else if count != 0 {
+		t.Errorf("the tree holds %v keys after the transaction was rolled back", count)
+	}
+}
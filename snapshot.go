@@ -0,0 +1,482 @@
+package btree
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Snapshot is a read-only view of a tree as it was when the snapshot was
+// taken. Later changes to the tree do not show up in it, however long it
+// is kept. A tree in copy-on-write mode writes them to other pages and
+// does not reuse the pages the snapshot reads until it is released. Any
+// other tree saves the bytes of a page before it changes it in place
+// for as long as a snapshot still reads them, see pageVersions. Like the
+// tree, a snapshot can be read by several goroutines at once.
+type Snapshot struct {
+	tree     snapshotTree
+	header   fileHeader //Only the root address and key count are used
+	epoch    uint64     //The version of the pages the snapshot reads
+	released bool
+}
+
+// snapshotTree is a tree that snapshots can be taken of. readVersion is
+// called with the lock of the tree held for reading and release with it
+// held for writing. Inserts running in parallel may change the nodes the
+// snapshot reads meanwhile, so readVersion latches the node it reads.
+type snapshotTree interface {
+	PageSize() int
+	MaxKeySize() int
+	InlineValueSize() int
+	Compare(a []byte, b []byte) int
+	locker() *sync.RWMutex
+	checkOpen() error
+	readVersion(address int64, epoch uint64) (data []byte, err error)
+	release(epoch uint64)
+}
+
+// snapshotNodes is the unlocked view of a Snapshot, see diskNodes.
+type snapshotNodes Snapshot
+
+func (s *Snapshot) nodes() *snapshotNodes {
+	return (*snapshotNodes)(s)
+}
+
+// Snapshot takes a snapshot of the tree. Changes that have not been
+// committed yet are not part of a snapshot of a tree in copy-on-write
+// mode. Other trees can not take a snapshot while a read-write
+// transaction is open.
+func (t *BTreeOnDisk) Snapshot() (s *Snapshot, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err = t.checkOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	s = &Snapshot{tree: t}
+	if t.cow != nil {
+		s.header = t.cow.committed
+		s.epoch = t.cow.epoch
+		t.cow.snapshots[s.epoch]++
+		return s, nil
+	} else if t.writer != nil {
+		return nil, fmt.Errorf("a snapshot can not be taken while a read-write transaction is open")
+	}
+
+	s.header = t.header
+	s.epoch = t.versions.pin()
+	return s, nil
+}
+
+// Snapshot takes a snapshot of the tree. It waits for the inserts in
+// progress to finish.
+func (t *BTreeInMemory) Snapshot() (s *Snapshot, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return &Snapshot{
+		tree:   t,
+		header: fileHeader{KeyCount: t.KeyCount(), RootAddress: 0},
+		epoch:  t.versions.pin(),
+	}, nil
+}
+
+// Release lets the tree drop the pages that only the snapshot still
+// reads. The snapshot can not be used afterwards.
+func (s *Snapshot) Release() error {
+	s.tree.locker().Lock()
+	defer s.tree.locker().Unlock()
+
+	err := s.check()
+	if err != nil {
+		return err
+	}
+
+	s.released = true
+	s.tree.release(s.epoch)
+	return nil
+}
+
+func (t *BTreeOnDisk) locker() *sync.RWMutex {
+	return &t.mu
+}
+
+func (t *BTreeOnDisk) readVersion(address int64, epoch uint64) (data []byte, err error) {
+	unlatch := latchNode(t.nodes(), address, false)
+	defer unlatch()
+
+	if t.cow == nil {
+		if data, ok := t.versions.read(address, epoch); ok {
+			return data, nil
+		}
+	}
+	return t.readPage(address)
+}
+
+func (t *BTreeOnDisk) release(epoch uint64) {
+	if t.cow == nil {
+		t.versions.unpin(epoch)
+		return
+	}
+
+	t.cow.snapshots[epoch]--
+	if t.cow.snapshots[epoch] == 0 {
+		delete(t.cow.snapshots, epoch)
+	}
+	t.releaseRetiredPages()
+}
+
+func (t *BTreeInMemory) locker() *sync.RWMutex {
+	return &t.mu
+}
+
+// checkOpen never returns an error as a tree in memory is never closed.
+func (t *BTreeInMemory) checkOpen() error {
+	return nil
+}
+
+func (t *BTreeInMemory) readVersion(address int64, epoch uint64) (data []byte, err error) {
+	unlatch := latchNode(t.nodes(), address, false)
+	defer unlatch()
+
+	t.blockMu.RLock()
+	defer t.blockMu.RUnlock()
+
+	if data, ok := t.versions.read(address, epoch); ok {
+		return data, nil
+	}
+	return t.page(address)
+}
+
+func (t *BTreeInMemory) release(epoch uint64) {
+	t.versions.unpin(epoch)
+}
+
+// KeyCount returns the number of keys in the snapshot.
+func (s *Snapshot) KeyCount() uint64 {
+	return s.header.KeyCount
+}
+
+// PageSize returns the number of bytes in a node page of the tree.
+func (s *Snapshot) PageSize() int {
+	return s.tree.PageSize()
+}
+
+// MaxKeySize returns the length in bytes of the longest key of the tree.
+func (s *Snapshot) MaxKeySize() int {
+	return s.tree.MaxKeySize()
+}
+
+// InlineValueSize returns the length in bytes of the longest value the
+// tree stores next to its key.
+func (s *Snapshot) InlineValueSize() int {
+	return s.tree.InlineValueSize()
+}
+
+// readOverflowPage reads a page of the value of an entry as it was when
+// the snapshot was taken, for the cursors of the snapshot.
+func (s *Snapshot) readOverflowPage(addr int64) (data []byte, err error) {
+	s.tree.locker().RLock()
+	defer s.tree.locker().RUnlock()
+	return s.nodes().readOverflowPage(addr)
+}
+
+// Compare compares two keys in the order of the tree.
+func (s *Snapshot) Compare(a []byte, b []byte) int {
+	return s.tree.Compare(a, b)
+}
+
+// ReadNode reads the node at address as it was when the snapshot was
+// taken.
+func (s *Snapshot) ReadNode(address int64) (n *Node, err error) {
+	s.tree.locker().RLock()
+	defer s.tree.locker().RUnlock()
+	return s.readNode(address, s)
+}
+
+// readNode reads the node at address and binds it to owner, which is
+// either the snapshot or its unlocked view.
+func (s *Snapshot) readNode(address int64, owner BTree) (n *Node, err error) {
+	err = s.check()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.tree.readVersion(address, s.epoch)
+	if err != nil {
+		return nil, err
+	}
+	return nodeFromBinary(data, address, owner)
+}
+
+// Root reads the root node of the snapshot.
+func (s *Snapshot) Root() (n *Node, err error) {
+	return s.ReadNode(s.header.RootAddress)
+}
+
+// QueryEntry finds the entry with the given key in the snapshot.
+func (s *Snapshot) QueryEntry(key []byte) (entry *Entry, err error) {
+	s.tree.locker().RLock()
+	defer s.tree.locker().RUnlock()
+	return queryEntry(s.nodes(), key)
+}
+
+// RangeEntries returns the entries in the snapshot with keys from lo to
+// hi in the order and with the bounds and limit given by opts.
+func (s *Snapshot) RangeEntries(lo []byte, hi []byte, opts *RangeOptions) (entries []Entry, err error) {
+	s.tree.locker().RLock()
+	defer s.tree.locker().RUnlock()
+	return collectEntries(s.nodes(), lo, hi, opts)
+}
+
+// RangeEntriesFunc streams the entries that RangeEntries would return to
+// fn one at a time instead of collecting them. fn must not call any of
+// the methods of the snapshot or its tree.
+func (s *Snapshot) RangeEntriesFunc(lo []byte, hi []byte, opts *RangeOptions, fn func(entry *Entry) bool) (err error) {
+	s.tree.locker().RLock()
+	defer s.tree.locker().RUnlock()
+	return rangeEntries(s.nodes(), lo, hi, opts, fn)
+}
+
+// QueryIndex is QueryEntry for a uint64 key.
+func (s *Snapshot) QueryIndex(key uint64) (index *Index, err error) {
+	s.tree.locker().RLock()
+	defer s.tree.locker().RUnlock()
+	return queryIndex(s.nodes(), key)
+}
+
+// Range is RangeEntries for uint64 keys.
+func (s *Snapshot) Range(lo uint64, hi uint64, opts *RangeOptions) (indexes []Index, err error) {
+	s.tree.locker().RLock()
+	defer s.tree.locker().RUnlock()
+	return collectRange(s.nodes(), lo, hi, opts)
+}
+
+// RangeFunc is RangeEntriesFunc for uint64 keys.
+func (s *Snapshot) RangeFunc(lo uint64, hi uint64, opts *RangeOptions, fn func(index *Index) bool) (err error) {
+	s.tree.locker().RLock()
+	defer s.tree.locker().RUnlock()
+	return rangeIndexes(s.nodes(), lo, hi, opts, fn)
+}
+
+// Rank returns the number of keys before key when the snapshot was taken.
+func (s *Snapshot) Rank(key uint64) (rank uint64, err error) {
+	s.tree.locker().RLock()
+	defer s.tree.locker().RUnlock()
+	return rankIndex(s.nodes(), key)
+}
+
+// Select returns the index at position i when the snapshot was taken.
+func (s *Snapshot) Select(i uint64) (index *Index, err error) {
+	s.tree.locker().RLock()
+	defer s.tree.locker().RUnlock()
+	return selectIndex(s.nodes(), i)
+}
+
+// CountRange returns the number of keys from lo to hi, both included,
+// when the snapshot was taken.
+func (s *Snapshot) CountRange(lo uint64, hi uint64) (count uint64, err error) {
+	s.tree.locker().RLock()
+	defer s.tree.locker().RUnlock()
+	return countRange(s.nodes(), lo, hi)
+}
+
+// InsertEntry returns an error as a snapshot can not be changed.
+func (s *Snapshot) InsertEntry(entry *Entry) (err error) {
+	return errSnapshotReadOnly
+}
+
+// RemoveEntry returns an error as a snapshot can not be changed.
+func (s *Snapshot) RemoveEntry(key []byte) (err error) {
+	return errSnapshotReadOnly
+}
+
+// Put returns an error as a snapshot can not be changed.
+func (s *Snapshot) Put(key []byte, value []byte) (err error) {
+	return errSnapshotReadOnly
+}
+
+// Get returns the value stored with key when the snapshot was taken.
+func (s *Snapshot) Get(key []byte) (value []byte, err error) {
+	return entryValue(s.QueryEntry(key))
+}
+
+// InsertIndex returns an error as a snapshot can not be changed.
+func (s *Snapshot) InsertIndex(index *Index) (err error) {
+	return errSnapshotReadOnly
+}
+
+// InsertBatch returns an error as a snapshot can not be changed.
+func (s *Snapshot) InsertBatch(indexes []Index) (err error) {
+	return errSnapshotReadOnly
+}
+
+// Update returns an error as a snapshot can not be changed.
+func (s *Snapshot) Update(key uint64, pointer int64) (err error) {
+	return errSnapshotReadOnly
+}
+
+// Upsert returns an error as a snapshot can not be changed.
+func (s *Snapshot) Upsert(index *Index) (err error) {
+	return errSnapshotReadOnly
+}
+
+// CompareAndSwap returns an error as a snapshot can not be changed.
+func (s *Snapshot) CompareAndSwap(key uint64, old int64, new int64) (swapped bool, err error) {
+	return false, errSnapshotReadOnly
+}
+
+// RemoveIndex returns an error as a snapshot can not be changed.
+func (s *Snapshot) RemoveIndex(key uint64) (err error) {
+	return errSnapshotReadOnly
+}
+
+// WriteNode returns an error as a snapshot can not be changed.
+func (s *Snapshot) WriteNode(n *Node) error {
+	return errSnapshotReadOnly
+}
+
+// NewNode returns an error as a snapshot can not be changed.
+func (s *Snapshot) NewNode() (n *Node, err error) {
+	return nil, errSnapshotReadOnly
+}
+
+// RemoveNode returns an error as a snapshot can not be changed.
+func (s *Snapshot) RemoveNode(address int64) (err error) {
+	return errSnapshotReadOnly
+}
+
+var errSnapshotReadOnly = fmt.Errorf("a snapshot of a b-tree can not be changed")
+
+// check returns an error if the snapshot can no longer be used.
+func (s *Snapshot) check() error {
+	if s.released {
+		return fmt.Errorf("the snapshot has already been released")
+	}
+	return s.tree.checkOpen()
+}
+
+func (v *snapshotNodes) snapshot() *Snapshot {
+	return (*Snapshot)(v)
+}
+
+func (v *snapshotNodes) InsertEntry(entry *Entry) (err error) {
+	return errSnapshotReadOnly
+}
+
+func (v *snapshotNodes) QueryEntry(key []byte) (entry *Entry, err error) {
+	return queryEntry(v, key)
+}
+
+func (v *snapshotNodes) RangeEntries(lo []byte, hi []byte, opts *RangeOptions) (entries []Entry, err error) {
+	return collectEntries(v, lo, hi, opts)
+}
+
+func (v *snapshotNodes) RangeEntriesFunc(lo []byte, hi []byte, opts *RangeOptions, fn func(entry *Entry) bool) (err error) {
+	return rangeEntries(v, lo, hi, opts, fn)
+}
+
+func (v *snapshotNodes) RemoveEntry(key []byte) (err error) {
+	return errSnapshotReadOnly
+}
+
+func (v *snapshotNodes) Put(key []byte, value []byte) (err error) {
+	return errSnapshotReadOnly
+}
+
+func (v *snapshotNodes) Get(key []byte) (value []byte, err error) {
+	return entryValue(v.QueryEntry(key))
+}
+
+func (v *snapshotNodes) InsertIndex(index *Index) (err error) {
+	return errSnapshotReadOnly
+}
+
+func (v *snapshotNodes) InsertBatch(indexes []Index) (err error) {
+	return errSnapshotReadOnly
+}
+
+func (v *snapshotNodes) Update(key uint64, pointer int64) (err error) {
+	return errSnapshotReadOnly
+}
+
+func (v *snapshotNodes) Upsert(index *Index) (err error) {
+	return errSnapshotReadOnly
+}
+
+func (v *snapshotNodes) CompareAndSwap(key uint64, old int64, new int64) (swapped bool, err error) {
+	return false, errSnapshotReadOnly
+}
+
+func (v *snapshotNodes) QueryIndex(key uint64) (index *Index, err error) {
+	return queryIndex(v, key)
+}
+
+func (v *snapshotNodes) Range(lo uint64, hi uint64, opts *RangeOptions) (indexes []Index, err error) {
+	return collectRange(v, lo, hi, opts)
+}
+
+func (v *snapshotNodes) RangeFunc(lo uint64, hi uint64, opts *RangeOptions, fn func(index *Index) bool) (err error) {
+	return rangeIndexes(v, lo, hi, opts, fn)
+}
+
+func (v *snapshotNodes) Rank(key uint64) (rank uint64, err error) {
+	return rankIndex(v, key)
+}
+
+func (v *snapshotNodes) Select(i uint64) (index *Index, err error) {
+	return selectIndex(v, i)
+}
+
+func (v *snapshotNodes) CountRange(lo uint64, hi uint64) (count uint64, err error) {
+	return countRange(v, lo, hi)
+}
+
+func (v *snapshotNodes) RemoveIndex(key uint64) (err error) {
+	return errSnapshotReadOnly
+}
+
+func (v *snapshotNodes) WriteNode(n *Node) error {
+	return errSnapshotReadOnly
+}
+
+func (v *snapshotNodes) NewNode() (n *Node, err error) {
+	return nil, errSnapshotReadOnly
+}
+
+func (v *snapshotNodes) ReadNode(address int64) (n *Node, err error) {
+	return v.snapshot().readNode(address, v)
+}
+
+func (v *snapshotNodes) Root() (n *Node, err error) {
+	return v.snapshot().readNode(v.header.RootAddress, v)
+}
+
+func (v *snapshotNodes) RemoveNode(address int64) (err error) {
+	return errSnapshotReadOnly
+}
+
+func (v *snapshotNodes) PageSize() int {
+	return v.tree.PageSize()
+}
+
+func (v *snapshotNodes) MaxKeySize() int {
+	return v.tree.MaxKeySize()
+}
+
+func (v *snapshotNodes) InlineValueSize() int {
+	return v.tree.InlineValueSize()
+}
+
+func (v *snapshotNodes) readOverflowPage(addr int64) (data []byte, err error) {
+	err = v.snapshot().check()
+	if err != nil {
+		return nil, err
+	}
+	return v.tree.readVersion(addr, v.epoch)
+}
+
+func (v *snapshotNodes) Compare(a []byte, b []byte) int {
+	return v.tree.Compare(a, b)
+}
@@ -0,0 +1,332 @@
+package btree
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-snapshot.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CopyOnWrite: true, NoSync: true, CacheSize: 16})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	keys := randomKeys(1500)
+	for _, key := range keys[:1000] {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	s, err := tree.Snapshot()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, key := range keys[1000:] {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for _, key := range keys[:500] {
+		err = tree.RemoveIndex(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	//The snapshot still sees the tree as it was
+	_, err = checkBalanced(s)
+	if err != nil {
+		t.Error(err)
+	}
+	if s.KeyCount() != 1000 {
+		t.Errorf("the snapshot has a key count of %v, expected 1000", s.KeyCount())
+	}
+	indexes, err := s.Range(0, maxInt64, nil)
+	if err != nil {
+		t.Error(err)
+	} else if len(indexes) != 1000 {
+		t.Errorf("the snapshot holds %v keys, expected 1000", len(indexes))
+	}
+	for _, key := range keys[:1000] {
+		_, err = s.QueryIndex(key)
+		if err != nil {
+			t.Errorf("the key %v is missing from the snapshot: %v", key, err)
+			break
+		}
+	}
+	for _, key := range keys[1000:] {
+		_, err = s.QueryIndex(key)
+		if err == nil {
+			t.Errorf("the key %v inserted after the snapshot was found in it", key)
+			break
+		}
+	}
+	checkRecovered(t, tree, keys[500:], keys[:500])
+
+	//The pages the snapshot reads are only freed once it is released
+	if len(tree.cow.retired) == 0 {
+		t.Error("no pages were kept for the snapshot")
+	}
+	available := len(tree.AvailableAddresses)
+	err = s.Release()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(tree.cow.retired) != 0 || len(tree.AvailableAddresses) <= available {
+		t.Errorf("releasing the snapshot left %v pages retired and %v free, %v were free before",
+			len(tree.cow.retired), len(tree.AvailableAddresses), available)
+	}
+	checkFreePages(t, tree)
+
+	if _, err = s.QueryIndex(keys[0]); err == nil {
+		t.Error("querying a released snapshot did not return an error")
+	}
+	if s.Release() == nil {
+		t.Error("releasing a snapshot twice did not return an error")
+	}
+}
+
+func TestSnapshotReadOnly(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-snapshot-read-only.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CopyOnWrite: true, NoSync: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	err = tree.InsertIndex(NewIndex(1, 1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	//Changes that are not committed yet are not part of a snapshot
+	tx, err := tree.Begin(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = tx.InsertIndex(NewIndex(4, 4))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s, err := tree.Snapshot()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.Release()
+	err = tx.Commit()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = s.QueryIndex(4); err == nil {
+		t.Error("a change that was not committed when the snapshot was taken was found in it")
+	}
+	if _, err = s.QueryIndex(1); err != nil {
+		t.Error(err)
+	}
+
+	if s.InsertIndex(NewIndex(7, 7)) == nil {
+		t.Error("inserting into a snapshot did not return an error")
+	}
+	if s.RemoveIndex(1) == nil {
+		t.Error("removing from a snapshot did not return an error")
+	}
+}
+
+// snapshotter is a tree that snapshots can be taken of.
+type snapshotter interface {
+	BTree
+	Snapshot() (s *Snapshot, err error)
+}
+
+// savedPages returns the number of pages a tree that is not in
+// copy-on-write mode has saved for its snapshots.
+func savedPages(tree BTree) int {
+	switch tt := tree.(type) {
+	case *BTreeOnDisk:
+		if tt.versions != nil {
+			return len(tt.versions.saved)
+		}
+	case *BTreeInMemory:
+		return len(tt.versions.saved)
+	}
+	return 0
+}
+
+func TestSnapshotInPlace(t *testing.T) {
+	forEachBackend(t, "test-snapshot-in-place.bin", func(t *testing.T, tree BTree) {
+		keys := randomKeys(1500)
+		insertKeys(t, tree, keys[:1000])
+
+		first, err := tree.(snapshotter).Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		insertKeys(t, tree, keys[1000:])
+		for _, key := range keys[:500] {
+			err = tree.RemoveIndex(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		second, err := tree.(snapshotter).Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys[500:700] {
+			err = tree.RemoveIndex(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		checkSnapshot := func(s *Snapshot, present []uint64) {
+			_, err := checkBalanced(s)
+			if err != nil {
+				t.Error(err)
+			}
+			if s.KeyCount() != uint64(len(present)) {
+				t.Errorf("the snapshot has a key count of %v, expected %v", s.KeyCount(), len(present))
+			}
+			indexes, err := s.Range(0, maxInt64, nil)
+			if err != nil {
+				t.Error(err)
+			} else if len(indexes) != len(present) {
+				t.Errorf("the snapshot holds %v keys, expected %v", len(indexes), len(present))
+			}
+			for _, key := range present {
+				_, err = s.QueryIndex(key)
+				if err != nil {
+					t.Errorf("the key %v is missing from the snapshot: %v", key, err)
+					break
+				}
+			}
+		}
+		checkSnapshot(first, keys[:1000])
+		checkSnapshot(second, keys[500:])
+
+		//The pages are kept until the last snapshot that reads them is
+		//released
+		err = first.Release()
+		if err != nil {
+			t.Error(err)
+		}
+		checkSnapshot(second, keys[500:])
+		if savedPages(tree) == 0 {
+			t.Error("no pages were kept for the second snapshot")
+		}
+		err = second.Release()
+		if err != nil {
+			t.Error(err)
+		}
+		if n := savedPages(tree); n != 0 {
+			t.Errorf("releasing every snapshot left %v pages saved", n)
+		}
+
+		_, err = checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+		indexes, err := tree.Range(0, maxInt64, nil)
+		if err != nil {
+			t.Error(err)
+		} else if len(indexes) != 800 {
+			t.Errorf("the tree holds %v keys, expected 800", len(indexes))
+		}
+	})
+}
+
+func TestSnapshotTransaction(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-snapshot-tx.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{NoSync: true, CacheSize: 8})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	keys := randomKeys(600)
+	for _, key := range keys[:300] {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	tx, err := tree.Begin(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = tree.Snapshot(); err == nil {
+		t.Error("a snapshot was taken while a read-write transaction was open")
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s, err := tree.Snapshot()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.Release()
+
+	//A transaction that is rolled back leaves the snapshot as it was, as
+	//does one that is committed
+	for _, commit := range []bool{false, true} {
+		tx, err = tree.Begin(true)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, key := range keys[300:] {
+			err = tx.InsertIndex(NewIndex(key, int64(key)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		indexes, err := s.Range(0, maxInt64, nil)
+		if err != nil {
+			t.Error(err)
+		} else if len(indexes) != 300 {
+			t.Errorf("the snapshot holds %v keys, expected 300", len(indexes))
+		}
+	}
+	checkRecovered(t, tree, keys, nil)
+}
@@ -0,0 +1,391 @@
+package btree
+
+import "fmt"
+
+// Tx is a transaction on a BTreeOnDisk. Every change made through a
+// read-write transaction is logged as a single operation when it is
+// committed, so either all of them become part of the tree or, if it is
+// rolled back or the process stops first, none of them do. The pages it
+// changes are held in memory until then.
+//
+// A tree has at most one read-write transaction open at a time and the
+// tree can only be changed through it while it is open. A read-only
+// transaction sees the tree as it was when it began, no changes can be
+// made to the tree until every read-only transaction is finished.
+//
+// Reads from the tree itself while a read-write transaction is open see
+// the tree as it was last committed, the changes are only seen through
+// the transaction until it is committed.
+//
+// Read-only transactions can be used by several goroutines at once. A
+// read-write transaction has to be used by one goroutine at a time.
+type Tx struct {
+	tree     *BTreeOnDisk
+	writable bool
+	done     bool
+
+	//The state of the tree when the transaction began
+	header    fileHeader
+	available []int64
+	size      int64
+}
+
+// Begin starts a new transaction on the tree. A read-write transaction
+// can not be started while another transaction is open. A read-only
+// transaction can not be started while a read-write one is open.
+func (t *BTreeOnDisk) Begin(writable bool) (tx *Tx, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err = t.checkOpen()
+	if err != nil {
+		return nil, err
+	} else if t.writer != nil {
+		return nil, fmt.Errorf("a read-write transaction is already open on the b-tree")
+	} else if writable && t.readers > 0 {
+		return nil, fmt.Errorf("the b-tree has %v read-only transactions open", t.readers)
+	}
+
+	tx = &Tx{
+		tree:      t,
+		writable:  writable,
+		header:    t.header,
+		available: append([]int64(nil), t.AvailableAddresses...),
+		size:      t.size,
+	}
+
+	if writable {
+		t.writer = tx
+	} else {
+		t.readers++
+	}
+	return tx, nil
+}
+
+// Writable returns true if the transaction is a read-write transaction.
+func (tx *Tx) Writable() bool {
+	return tx.writable
+}
+
+// QueryEntry finds the entry with the given key in the tree.
+func (tx *Tx) QueryEntry(key []byte) (entry *Entry, err error) {
+	tx.tree.mu.RLock()
+	defer tx.tree.mu.RUnlock()
+
+	err = tx.check()
+	if err != nil {
+		return nil, err
+	}
+	return queryEntry(tx.tree.nodes(), key)
+}
+
+// RangeEntries returns the entries with keys from lo to hi in the order
+// and with the bounds and limit given by opts.
+func (tx *Tx) RangeEntries(lo []byte, hi []byte, opts *RangeOptions) (entries []Entry, err error) {
+	tx.tree.mu.RLock()
+	defer tx.tree.mu.RUnlock()
+
+	err = tx.check()
+	if err != nil {
+		return nil, err
+	}
+	return collectEntries(tx.tree.nodes(), lo, hi, opts)
+}
+
+// RangeEntriesFunc streams the entries that RangeEntries would return to
+// fn one at a time instead of collecting them. fn must not call any of
+// the methods of the transaction or its tree.
+func (tx *Tx) RangeEntriesFunc(lo []byte, hi []byte, opts *RangeOptions, fn func(entry *Entry) bool) (err error) {
+	tx.tree.mu.RLock()
+	defer tx.tree.mu.RUnlock()
+
+	err = tx.check()
+	if err != nil {
+		return err
+	}
+	return rangeEntries(tx.tree.nodes(), lo, hi, opts, fn)
+}
+
+// InsertEntry inserts the entry into the tree as part of the transaction.
+func (tx *Tx) InsertEntry(entry *Entry) (err error) {
+	return tx.write(func() error {
+		return tx.tree.insert(entry)
+	})
+}
+
+// RemoveEntry removes the entry with the given key from the tree as part
+// of the transaction.
+func (tx *Tx) RemoveEntry(key []byte) (err error) {
+	return tx.write(func() error {
+		return tx.tree.remove(key)
+	})
+}
+
+// Put inserts key into the tree with value stored next to it as part of
+// the transaction, see BTreeOnDisk.Put.
+func (tx *Tx) Put(key []byte, value []byte) (err error) {
+	return tx.InsertEntry(&Entry{Key: key, Value: value})
+}
+
+// Get returns the value stored with key by Put.
+func (tx *Tx) Get(key []byte) (value []byte, err error) {
+	return entryValue(tx.QueryEntry(key))
+}
+
+// QueryIndex is QueryEntry for a uint64 key.
+func (tx *Tx) QueryIndex(key uint64) (index *Index, err error) {
+	tx.tree.mu.RLock()
+	defer tx.tree.mu.RUnlock()
+
+	err = tx.check()
+	if err != nil {
+		return nil, err
+	}
+	return queryIndex(tx.tree.nodes(), key)
+}
+
+// Range is RangeEntries for uint64 keys.
+func (tx *Tx) Range(lo uint64, hi uint64, opts *RangeOptions) (indexes []Index, err error) {
+	tx.tree.mu.RLock()
+	defer tx.tree.mu.RUnlock()
+
+	err = tx.check()
+	if err != nil {
+		return nil, err
+	}
+	return collectRange(tx.tree.nodes(), lo, hi, opts)
+}
+
+// RangeFunc is RangeEntriesFunc for uint64 keys.
+func (tx *Tx) RangeFunc(lo uint64, hi uint64, opts *RangeOptions, fn func(index *Index) bool) (err error) {
+	tx.tree.mu.RLock()
+	defer tx.tree.mu.RUnlock()
+
+	err = tx.check()
+	if err != nil {
+		return err
+	}
+	return rangeIndexes(tx.tree.nodes(), lo, hi, opts, fn)
+}
+
+// Rank returns the number of keys before key as the transaction sees
+// them, see BTreeOnDisk.Rank.
+func (tx *Tx) Rank(key uint64) (rank uint64, err error) {
+	tx.tree.mu.RLock()
+	defer tx.tree.mu.RUnlock()
+
+	err = tx.check()
+	if err != nil {
+		return 0, err
+	}
+	return rankIndex(tx.tree.nodes(), key)
+}
+
+// Select returns the index at position i as the transaction sees it, see
+// BTreeOnDisk.Select.
+func (tx *Tx) Select(i uint64) (index *Index, err error) {
+	tx.tree.mu.RLock()
+	defer tx.tree.mu.RUnlock()
+
+	err = tx.check()
+	if err != nil {
+		return nil, err
+	}
+	return selectIndex(tx.tree.nodes(), i)
+}
+
+// CountRange returns the number of keys from lo to hi, both included, as
+// the transaction sees them, see BTreeOnDisk.CountRange.
+func (tx *Tx) CountRange(lo uint64, hi uint64) (count uint64, err error) {
+	tx.tree.mu.RLock()
+	defer tx.tree.mu.RUnlock()
+
+	err = tx.check()
+	if err != nil {
+		return 0, err
+	}
+	return countRange(tx.tree.nodes(), lo, hi)
+}
+
+// InsertIndex is InsertEntry for an index with a uint64 key.
+func (tx *Tx) InsertIndex(index *Index) (err error) {
+	return tx.InsertEntry(index.entry())
+}
+
+// InsertBatch inserts the indexes as part of the transaction, see
+// BTreeOnDisk.InsertBatch.
+func (tx *Tx) InsertBatch(indexes []Index) (err error) {
+	return tx.write(func() error {
+		return tx.tree.insertBatch(indexes)
+	})
+}
+
+// Update changes the pointer of key as part of the transaction, see
+// BTreeOnDisk.Update.
+func (tx *Tx) Update(key uint64, pointer int64) (err error) {
+	return tx.write(func() error {
+		return tx.tree.updateIndex(key, pointer)
+	})
+}
+
+// Upsert updates or inserts the index as part of the transaction, see
+// BTreeOnDisk.Upsert.
+func (tx *Tx) Upsert(index *Index) (err error) {
+	return tx.write(func() error {
+		return tx.tree.upsert(index)
+	})
+}
+
+// CompareAndSwap swaps the pointer of key as part of the transaction, see
+// BTreeOnDisk.CompareAndSwap.
+func (tx *Tx) CompareAndSwap(key uint64, old int64, new int64) (swapped bool, err error) {
+	err = tx.write(func() error {
+		swapped, err = tx.tree.compareAndSwap(key, old, new)
+		return err
+	})
+	return swapped, err
+}
+
+// RemoveIndex is RemoveEntry for a uint64 key.
+func (tx *Tx) RemoveIndex(key uint64) (err error) {
+	return tx.RemoveEntry(Uint64Key(key))
+}
+
+// Commit finishes the transaction. The changes made by a read-write
+// transaction are written to the write-ahead log as a single operation.
+// If that fails the transaction is rolled back.
+func (tx *Tx) Commit() (err error) {
+	tx.tree.mu.Lock()
+	defer tx.tree.mu.Unlock()
+
+	err = tx.check()
+	if err != nil {
+		return err
+	}
+
+	t := tx.tree
+	tx.done = true
+	if !tx.writable {
+		t.readers--
+		return nil
+	}
+
+	t.writer = nil
+	err = t.commit()
+	if err != nil {
+		return firstError(err, tx.rollback())
+	}
+	return nil
+}
+
+// Rollback finishes the transaction and throws away every change made
+// through it.
+func (tx *Tx) Rollback() (err error) {
+	tx.tree.mu.Lock()
+	defer tx.tree.mu.Unlock()
+
+	err = tx.check()
+	if err != nil {
+		return err
+	}
+
+	t := tx.tree
+	tx.done = true
+	if !tx.writable {
+		t.readers--
+		return nil
+	}
+
+	t.writer = nil
+	return tx.rollback()
+}
+
+// rollback puts the tree back into the state it was in when the
+// transaction began.
+func (tx *Tx) rollback() error {
+	t := tx.tree
+	t.header = tx.header
+	t.AvailableAddresses = tx.available
+	t.size = tx.size
+	if t.cow != nil {
+		t.cow.reset()
+	}
+	return t.cache.rollback()
+}
+
+// write runs fn, which changes the tree, as part of the transaction.
+func (tx *Tx) write(fn func() error) error {
+	tx.tree.mu.Lock()
+	defer tx.tree.mu.Unlock()
+
+	err := tx.check()
+	if err != nil {
+		return err
+	} else if !tx.writable {
+		return fmt.Errorf("the b-tree can not be changed in a read-only transaction")
+	}
+
+	tx.tree.inTx = true
+	defer func() { tx.tree.inTx = false }()
+	return fn()
+}
+
+// committed returns the snapshot that reads from the tree go through
+// while a read-write transaction is open, or nil if none is. It reads the
+// pages as the last commit left them.
+func (t *BTreeOnDisk) committed() *Snapshot {
+	if t.writer == nil {
+		return nil
+	}
+	return &Snapshot{tree: committedTree{t}, header: t.writer.header}
+}
+
+// readNodes returns the view of the tree that its reads go through, see
+// committed.
+func (t *BTreeOnDisk) readNodes() BTree {
+	if s := t.committed(); s != nil {
+		return s.nodes()
+	}
+	return t.nodes()
+}
+
+// readHeader returns the header of the tree as its reads see it, see
+// committed.
+func (t *BTreeOnDisk) readHeader() fileHeader {
+	if t.writer != nil {
+		return t.writer.header
+	}
+
+	t.headerMu.Lock()
+	defer t.headerMu.Unlock()
+	return t.header
+}
+
+// committedTree is the tree seen by the snapshot of committed. Pages the
+// open read-write transaction wrote are read as they were before.
+type committedTree struct {
+	*BTreeOnDisk
+}
+
+func (c committedTree) readVersion(address int64, epoch uint64) (data []byte, err error) {
+	if !IsValidAddress(address, c.PageSize()) || address == 0 {
+		return nil, fmt.Errorf("Invalid address. Cannot read node at %v", address)
+	}
+
+	err = c.checkOpen()
+	if err != nil {
+		return nil, err
+	}
+	return c.cache.readCommitted(address, c.PageSize())
+}
+
+// release does nothing as the snapshot of committed is not counted.
+func (c committedTree) release(epoch uint64) {}
+
+// check returns an error if the transaction can no longer be used.
+func (tx *Tx) check() error {
+	if tx.done {
+		return fmt.Errorf("the transaction has already been committed or rolled back")
+	}
+	return tx.tree.checkOpen()
+}
@@ -0,0 +1,494 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTxCommit(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-tx-commit.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CacheSize: 8})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tx, err := tree.Begin(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	keys := randomKeys(1000)
+	for _, key := range keys {
+		err = tx.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	//The transaction sees its own changes
+	_, err = tx.QueryIndex(keys[0])
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	checkRecovered(t, tree, keys, nil)
+	if tree.KeyCount() != uint64(len(keys)) {
+		t.Errorf("the tree has a key count of %v, expected %v", tree.KeyCount(), len(keys))
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-tx-rollback.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CacheSize: 8})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	keys := randomKeys(1500)
+	base, batch := keys[:500], keys[500:]
+	for _, key := range base {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for _, key := range base[:200] {
+		err = tree.RemoveIndex(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	available := append([]int64(nil), tree.AvailableAddresses...)
+
+	tx, err := tree.Begin(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, key := range batch {
+		err = tx.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for _, key := range base[200:300] {
+		err = tx.RemoveIndex(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	missing := append(append([]uint64(nil), base[:200]...), batch...)
+	checkRecovered(t, tree, base[200:], missing)
+	if tree.KeyCount() != 300 {
+		t.Errorf("the tree has a key count of %v after the rollback, expected 300", tree.KeyCount())
+	}
+	if len(tree.AvailableAddresses) != len(available) {
+		t.Errorf("the tree has %v free pages after the rollback, expected %v", len(tree.AvailableAddresses), len(available))
+	}
+
+	//The tree keeps working after the rollback and nothing of the
+	//transaction reaches the file
+	err = tree.InsertIndex(NewIndex(batch[0], int64(batch[0])))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	present := append([]uint64{batch[0]}, base[200:]...)
+	missing = append(append([]uint64(nil), base[:200]...), batch[1:]...)
+	checkRecovered(t, tree, present, missing)
+	if tree.KeyCount() != 301 {
+		t.Errorf("the reopened tree has a key count of %v, expected 301", tree.KeyCount())
+	}
+}
+
+func TestTxFailedBatch(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-tx-failed-batch.bin")
+
+	tree, err := CreateBTreeOnDisk(f, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	err = tree.InsertIndex(NewIndex(500, 500))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	//The batch holds a key that is already in the tree
+	tx, err := tree.Begin(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var batch []uint64
+	for key := uint64(1); key <= 1000; key++ {
+		err = tx.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			break
+		}
+		batch = append(batch, key)
+	}
+	if err == nil {
+		t.Error("inserting a key that was already in the tree did not return an error")
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	checkRecovered(t, tree, []uint64{500}, batch)
+}
+
+func TestTxCrash(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-tx-crash.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CacheSize: 4})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	keys := randomKeys(1000)
+	for _, key := range keys[:500] {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	tx, err := tree.Begin(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, key := range keys[500:] {
+		err = tx.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	//Stop before the transaction is committed
+	err = tree.closeFiles()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	checkRecovered(t, tree, keys[:500], keys[500:])
+}
+
+func TestTxHiddenFromTree(t *testing.T) {
+	for _, cow := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cow=%v", cow), func(t *testing.T) {
+			testTxHiddenFromTree(t, cow)
+		})
+	}
+}
+
+func testTxHiddenFromTree(t *testing.T, cow bool) {
+	f := path.Join(os.TempDir(), "test-tx-hidden.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CopyOnWrite: cow, NoSync: true, CacheSize: 8, InlineValueSize: 16})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	keys := randomKeys(1500)
+	base, batch := keys[:500], keys[500:]
+	for _, key := range base {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	//The keys are all one more than a multiple of three so 2 and 5 are not
+	//among them
+	value := longValue(2, 3000)
+	err = tree.Put(Uint64Key(2), value)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	height := tree.Height()
+
+	tx, err := tree.Begin(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, key := range batch {
+		err = tx.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for _, key := range base[:200] {
+		err = tx.RemoveIndex(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	err = tx.RemoveIndex(2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = tx.Put(Uint64Key(5), longValue(5, 3000))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	//The tree is read as it was last committed while the transaction is open
+	checkRecovered(t, tree, base, batch)
+	if tree.KeyCount() != uint64(len(base)+1) {
+		t.Errorf("the tree has a key count of %v with the transaction open, expected %v", tree.KeyCount(), len(base)+1)
+	}
+	if tree.Height() != height {
+		t.Errorf("the tree has a height of %v with the transaction open, expected %v", tree.Height(), height)
+	}
+	if got, err := tree.Get(Uint64Key(2)); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(got, value) {
+		t.Error("the tree returned a value changed by the open transaction")
+	}
+	if _, err = tree.Get(Uint64Key(5)); err == nil {
+		t.Error("the tree returned the value put by the open transaction")
+	}
+	indexes, err := tree.Range(0, maxInt64, nil)
+	if err != nil {
+		t.Error(err)
+	} else if len(indexes) != len(base)+1 {
+		t.Errorf("the range found %v keys with the transaction open, expected %v", len(indexes), len(base)+1)
+	}
+	if count, err := tree.CountRange(0, maxInt64); err != nil {
+		t.Error(err)
+	} else if count != uint64(len(base)+1) {
+		t.Errorf("the tree counts %v keys with the transaction open, expected %v", count, len(base)+1)
+	}
+	if rank, err := tree.Rank(maxInt64); err != nil {
+		t.Error(err)
+	} else if rank != uint64(len(base)+1) {
+		t.Errorf("the tree ranks %v keys with the transaction open, expected %v", rank, len(base)+1)
+	}
+	c := NewCursor(tree)
+	count := 0
+	for c.First(); c.Valid(); c.Next() {
+		count++
+	}
+	if c.Err() != nil {
+		t.Error(c.Err())
+	} else if count != len(base)+1 {
+		t.Errorf("the cursor found %v keys with the transaction open, expected %v", count, len(base)+1)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	checkRecovered(t, tree, append(batch, base[200:]...), base[:200])
+	if tree.KeyCount() != uint64(len(keys)-200+1) {
+		t.Errorf("the tree has a key count of %v after the commit, expected %v", tree.KeyCount(), len(keys)-200+1)
+	}
+	if _, err = tree.Get(Uint64Key(2)); err == nil {
+		t.Error("the tree returned the value removed by the committed transaction")
+	}
+	if got, err := tree.Get(Uint64Key(5)); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(got, longValue(5, 3000)) {
+		t.Error("the tree did not return the value put by the committed transaction")
+	}
+}
+
+func TestTxReadOnly(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-tx-read-only.bin")
+
+	tree, err := CreateBTreeOnDisk(f, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	keys := randomKeys(100)
+	for _, key := range keys {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	tx1, err := tree.Begin(false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tx2, err := tree.Begin(false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if tx1.Writable() {
+		t.Error("a read-only transaction is writable")
+	}
+	indexes, err := tx1.Range(0, maxInt64, nil)
+	if err != nil {
+		t.Error(err)
+	} else if len(indexes) != len(keys) {
+		t.Errorf("the read-only transaction found %v keys, expected %v", len(indexes), len(keys))
+	}
+
+	//The keys are all one more than a multiple of three so 2 is not one of them
+	if tx1.InsertIndex(NewIndex(2, 2)) == nil {
+		t.Error("inserting in a read-only transaction did not return an error")
+	}
+	if tx1.RemoveIndex(keys[0]) == nil {
+		t.Error("removing in a read-only transaction did not return an error")
+	}
+	if tree.InsertIndex(NewIndex(2, 2)) == nil {
+		t.Error("changing the tree while a read-only transaction is open did not return an error")
+	}
+	if _, err = tree.Begin(true); err == nil {
+		t.Error("beginning a read-write transaction while a read-only one is open did not return an error")
+	}
+
+	err = tx1.Commit()
+	if err != nil {
+		t.Error(err)
+	}
+	err = tx2.Rollback()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.InsertIndex(NewIndex(2, 2))
+	if err != nil {
+		t.Errorf("the tree could not be changed after the read-only transactions finished: %v", err)
+	}
+}
+
+func TestTxExclusive(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-tx-exclusive.bin")
+
+	tree, err := CreateBTreeOnDisk(f, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tx, err := tree.Begin(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err = tree.Begin(true); err == nil {
+		t.Error("beginning a second read-write transaction did not return an error")
+	}
+	if _, err = tree.Begin(false); err == nil {
+		t.Error("beginning a read-only transaction while a read-write one is open did not return an error")
+	}
+	if tree.InsertIndex(NewIndex(1, 1)) == nil {
+		t.Error("changing the tree outside of the open transaction did not return an error")
+	}
+	if tree.Flush() == nil {
+		t.Error("flushing the tree while a transaction is open did not return an error")
+	}
+	if tree.Close() == nil {
+		t.Error("closing the tree while a transaction is open did not return an error")
+	}
+
+	err = tx.InsertIndex(NewIndex(1, 1))
+	if err != nil {
+		t.Error(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if tx.InsertIndex(NewIndex(2, 2)) == nil {
+		t.Error("inserting through a committed transaction did not return an error")
+	}
+	if tx.Commit() == nil || tx.Rollback() == nil {
+		t.Error("finishing a transaction twice did not return an error")
+	}
+
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+	}
+}
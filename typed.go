@@ -0,0 +1,277 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Codec turns the keys or the values of a Tree into the bytes they are
+// stored as and back again. The codecs of this package encode keys so
+// that their bytes sort in the same order as the keys themselves, and
+// can be used for values as well.
+type Codec[T any] interface {
+	Encode(key T) []byte
+	Decode(data []byte) (key T, err error)
+}
+
+// Integer is the set of the built-in integer types.
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// IntegerCodec is the Codec of an integer type. An integer is stored in
+// as many bytes as its type has, big endian and with the sign bit of a
+// signed type flipped so that negative numbers come first. The codec of
+// uint64 stores keys the same way as Uint64Key.
+type IntegerCodec[T Integer] struct{}
+
+// Encode returns the bytes key is stored as.
+func (IntegerCodec[T]) Encode(key T) []byte {
+	size := int(unsafe.Sizeof(key))
+	u := uint64(key)
+	if isSigned[T]() {
+		u ^= 1 << (size*8 - 1)
+	}
+
+	data := make([]byte, size)
+	for i := size - 1; i >= 0; i-- {
+		data[i] = byte(u)
+		u >>= 8
+	}
+	return data
+}
+
+// Decode returns the key stored as data.
+func (IntegerCodec[T]) Decode(data []byte) (key T, err error) {
+	size := int(unsafe.Sizeof(key))
+	if len(data) != size {
+		return key, fmt.Errorf("the key %x is not %v bytes long", data, size)
+	}
+
+	var u uint64
+	for _, b := range data {
+		u = u<<8 | uint64(b)
+	}
+	if isSigned[T]() {
+		u ^= 1 << (size*8 - 1)
+	}
+	return T(u), nil
+}
+
+// isSigned returns true if T can hold negative numbers.
+func isSigned[T Integer]() bool {
+	var zero T
+	return ^zero < zero
+}
+
+// StringCodec is the Codec of strings, which are stored as their bytes.
+type StringCodec struct{}
+
+// Encode returns the bytes key is stored as.
+func (StringCodec) Encode(key string) []byte {
+	return []byte(key)
+}
+
+// Decode returns the key stored as data.
+func (StringCodec) Decode(data []byte) (key string, err error) {
+	return string(data), nil
+}
+
+// BytesCodec is the Codec of byte slices, which are stored as they are.
+type BytesCodec struct{}
+
+// Encode returns the bytes key is stored as.
+func (BytesCodec) Encode(key []byte) []byte {
+	return key
+}
+
+// Decode returns the key stored as data.
+func (BytesCodec) Decode(data []byte) (key []byte, err error) {
+	return data, nil
+}
+
+// Tree is a b-tree with keys of type K and values of type V. It is a
+// typed layer over a BTree: keys are stored as the bytes their Codec
+// turns them into and values are stored next to them by Put, in the
+// bytes of a Codec of their own. The keys are kept in the order of the
+// compare function the tree is created with.
+//
+// A Tree is safe for concurrent use in the same way as the BTree it is
+// stored in.
+type Tree[K any, V any] struct {
+	tree   BTree
+	keys   Codec[K]
+	values Codec[V]
+}
+
+// typedValueSize is the InlineValueSize of a Tree that is created without
+// choosing one. It holds the values of every integer codec.
+const typedValueSize = 8
+
+// New creates a new, empty Tree in memory. The keys are ordered by cmp,
+// which returns a negative number if a comes before b, zero if they are
+// the same key and a positive number otherwise. cmp can be nil if the
+// bytes of the keys already sort in key order, as they do for the codecs
+// of this package, and the keys are then compared without decoding them.
+func New[K any, V any](cmp func(a K, b K) int, keys Codec[K], values Codec[V]) (*Tree[K, V], error) {
+	return NewWithOptions[K, V](cmp, keys, values, nil)
+}
+
+// NewWithOptions works like New but creates the tree with the given
+// options. Keys that are longer than eight bytes, such as most strings,
+// need a larger MaxKeySize. Values longer than the InlineValueSize, which
+// defaults to eight bytes, are stored in overflow pages. The Compare of
+// the options is replaced by cmp.
+func NewWithOptions[K any, V any](cmp func(a K, b K) int, keys Codec[K], values Codec[V], opts *Options) (*Tree[K, V], error) {
+	tree, err := NewBTreeInMemWithOptions(0, typedOptions(cmp, keys, opts))
+	if err != nil {
+		return nil, err
+	}
+	return &Tree[K, V]{tree: tree, keys: keys, values: values}, nil
+}
+
+// CreateOnDisk creates a new, empty Tree in file, see
+// CreateBTreeOnDiskWithOptions and NewWithOptions. The tree has to be
+// closed with Close when it is no longer used.
+func CreateOnDisk[K any, V any](file string, overwrite bool, cmp func(a K, b K) int, keys Codec[K], values Codec[V], opts *Options) (*Tree[K, V], error) {
+	tree, err := CreateBTreeOnDiskWithOptions(file, overwrite, typedOptions(cmp, keys, opts))
+	if err != nil {
+		return nil, err
+	}
+	return &Tree[K, V]{tree: tree, keys: keys, values: values}, nil
+}
+
+// OpenOnDisk opens a Tree stored in file, see
+// OpenBTreeOnDiskWithOptions. It has to be opened with the same cmp and
+// codecs it was created with.
+func OpenOnDisk[K any, V any](file string, cmp func(a K, b K) int, keys Codec[K], values Codec[V], opts *Options) (*Tree[K, V], error) {
+	tree, err := OpenBTreeOnDiskWithOptions(file, typedOptions(cmp, keys, opts))
+	if err != nil {
+		return nil, err
+	}
+	return &Tree[K, V]{tree: tree, keys: keys, values: values}, nil
+}
+
+// typedOptions returns a copy of opts that orders the stored keys with
+// cmp, see keyOrder, and leaves room for values.
+func typedOptions[K any](cmp func(a K, b K) int, codec Codec[K], opts *Options) *Options {
+	o := new(Options)
+	if opts != nil {
+		*o = *opts
+	}
+	if o.InlineValueSize == 0 {
+		o.InlineValueSize = typedValueSize
+	}
+	o.Compare = nil
+	if cmp != nil {
+		order := &keyOrder[K]{cmp: cmp, codec: codec}
+		o.Compare = order.compare
+	}
+	return o
+}
+
+// keyOrder orders stored keys by decoding them and comparing them with
+// cmp. Keys that can not be decoded are ordered by their bytes.
+//
+// The nodes compare the key they look for with the keys they hold, so the
+// first key of a comparison stays the same all the way down the tree. The
+// last first key is kept decoded and only the key of the node is decoded
+// for every comparison.
+type keyOrder[K any] struct {
+	cmp   func(a K, b K) int
+	codec Codec[K]
+	last  atomic.Pointer[decodedKey[K]]
+}
+
+// decodedKey is a key together with the bytes it was decoded from.
+type decodedKey[K any] struct {
+	data []byte
+	key  K
+}
+
+func (o *keyOrder[K]) compare(a []byte, b []byte) int {
+	ka, errA := o.decodeFirst(a)
+	kb, errB := o.codec.Decode(b)
+	if errA != nil || errB != nil {
+		return bytes.Compare(a, b)
+	}
+	return o.cmp(ka, kb)
+}
+
+// decodeFirst decodes the first key of a comparison unless it is the one
+// decoded last.
+func (o *keyOrder[K]) decodeFirst(data []byte) (key K, err error) {
+	if last := o.last.Load(); last != nil && bytes.Equal(last.data, data) {
+		return last.key, nil
+	}
+	//The bytes are copied first as the caller is free to change them
+	//afterwards and the key may still refer to them
+	data = append([]byte{}, data...)
+	key, err = o.codec.Decode(data)
+	if err != nil {
+		return key, err
+	}
+	o.last.Store(&decodedKey[K]{data: data, key: key})
+	return key, nil
+}
+
+// Insert adds key to the tree with the given value. It returns an error
+// if the key is already in the tree.
+func (t *Tree[K, V]) Insert(key K, value V) error {
+	return t.tree.Put(t.keys.Encode(key), t.values.Encode(value))
+}
+
+// Get returns the value of key.
+func (t *Tree[K, V]) Get(key K) (value V, err error) {
+	data, err := t.tree.Get(t.keys.Encode(key))
+	if err != nil {
+		return value, err
+	}
+	return t.values.Decode(data)
+}
+
+// Remove deletes key from the tree.
+func (t *Tree[K, V]) Remove(key K) error {
+	return t.tree.RemoveEntry(t.keys.Encode(key))
+}
+
+// Range calls fn for every key between lo and hi and its value, in the
+// way the range queries of BTree do, until fn returns false.
+func (t *Tree[K, V]) Range(lo K, hi K, opts *RangeOptions, fn func(key K, value V) bool) error {
+	return t.rangeEntries(t.keys.Encode(lo), t.keys.Encode(hi), opts, fn)
+}
+
+// Walk calls fn for every key in the tree and its value until fn returns
+// false. Only the Limit and Reverse options are used.
+func (t *Tree[K, V]) Walk(opts *RangeOptions, fn func(key K, value V) bool) error {
+	return t.rangeEntries(nil, nil, opts, fn)
+}
+
+func (t *Tree[K, V]) rangeEntries(lo []byte, hi []byte, opts *RangeOptions, fn func(key K, value V) bool) error {
+	var decodeErr error
+	err := t.tree.RangeEntriesFunc(lo, hi, opts, func(entry *Entry) bool {
+		key, err := t.keys.Decode(entry.Key)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+		value, err := t.values.Decode(entry.Value)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+		return fn(key, value)
+	})
+	return firstError(err, decodeErr)
+}
+
+// Close closes the tree if it is stored on disk.
+func (t *Tree[K, V]) Close() error {
+	if dt, ok := t.tree.(*BTreeOnDisk); ok {
+		return dt.Close()
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// checkCodec checks that the keys, which are in ascending order, survive
+// being encoded and that their bytes sort in the same order.
+func checkCodec[T comparable](t *testing.T, codec Codec[T], keys []T) {
+	for i, key := range keys {
+		data := codec.Encode(key)
+		decoded, err := codec.Decode(data)
+		if err != nil {
+			t.Errorf("the key %v: %v", key, err)
+		} else if decoded != key {
+			t.Errorf("the key %v was decoded as %v", key, decoded)
+		}
+		if i > 0 && bytes.Compare(codec.Encode(keys[i-1]), data) >= 0 {
+			t.Errorf("the key %v is not stored after %v", key, keys[i-1])
+		}
+	}
+}
+
+func TestIntegerCodec(t *testing.T) {
+	checkCodec[int8](t, IntegerCodec[int8]{}, []int8{math.MinInt8, -5, -1, 0, 1, math.MaxInt8})
+	checkCodec[uint16](t, IntegerCodec[uint16]{}, []uint16{0, 1, 0x100, math.MaxUint16})
+	checkCodec[int32](t, IntegerCodec[int32]{}, []int32{math.MinInt32, -70000, 0, 70000, math.MaxInt32})
+	checkCodec[int](t, IntegerCodec[int]{}, []int{math.MinInt, -1, 0, 1, math.MaxInt})
+	checkCodec[uint64](t, IntegerCodec[uint64]{}, []uint64{0, 1, 1 << 63, math.MaxUint64})
+	checkCodec[string](t, StringCodec{}, []string{"", "a", "ab", "b"})
+
+	if data := (IntegerCodec[uint64]{}).Encode(0x1234); !bytes.Equal(data, Uint64Key(0x1234)) {
+		t.Errorf("the uint64 codec stored 0x1234 as %x, expected %x", data, Uint64Key(0x1234))
+	}
+	_, err := IntegerCodec[int16]{}.Decode([]byte{1, 2, 3})
+	if err == nil {
+		t.Error("three bytes were decoded as an int16")
+	}
+}
+
+func TestTree(t *testing.T) {
+	tree, err := New[int64, int](nil, IntegerCodec[int64]{}, IntegerCodec[int]{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	keys := rand.Perm(2000)
+	for _, key := range keys {
+		err = tree.Insert(int64(key-1000), key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	err = tree.Insert(-1000, 0)
+	if err == nil {
+		t.Error("a key was inserted twice")
+	}
+
+	for _, key := range keys {
+		value, err := tree.Get(int64(key - 1000))
+		if err != nil {
+			t.Error(err)
+		} else if value != key {
+			t.Errorf("the key %v has a value of %v, expected %v", key-1000, value, key)
+		}
+	}
+
+	var found []int64
+	err = tree.Range(-10, 10, &RangeOptions{ExcludeHi: true}, func(key int64, value int) bool {
+		found = append(found, key)
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	} else if len(found) != 20 || found[0] != -10 || found[19] != 9 {
+		t.Errorf("the range from -10 to 10 returned %v", found)
+	}
+
+	for _, key := range keys[:1000] {
+		err = tree.Remove(int64(key - 1000))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	count := 0
+	err = tree.Walk(nil, func(key int64, value int) bool {
+		count++
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	} else if count != 1000 {
+		t.Errorf("the tree holds %v keys after removing half of them, expected 1000", count)
+	}
+}
+
+func TestTreeCompare(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-typed-compare.bin")
+
+	//Order the keys without regard to case, words that only differ in case
+	//by their bytes
+	cmp := func(a string, b string) int {
+		if c := strings.Compare(strings.ToLower(a), strings.ToLower(b)); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	}
+	opts := &Options{MaxKeySize: 16}
+
+	tree, err := CreateOnDisk[string, uint32](f, true, cmp, StringCodec{}, IntegerCodec[uint32]{}, opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	words := strings.Fields("the quick Brown fox Jumps over THE lazy dog And then Quick runs away")
+	for i, word := range words {
+		err = tree.Insert(word, uint32(i))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tree, err = OpenOnDisk[string, uint32](f, cmp, StringCodec{}, IntegerCodec[uint32]{}, opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	expected := append([]string(nil), words...)
+	sort.Slice(expected, func(i, j int) bool {
+		return cmp(expected[i], expected[j]) < 0
+	})
+	var found []string
+	err = tree.Walk(nil, func(key string, value uint32) bool {
+		if words[value] != key {
+			t.Errorf("the key %v has the value of %v", key, words[value])
+		}
+		found = append(found, key)
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	} else if strings.Join(found, " ") != strings.Join(expected, " ") {
+		t.Errorf("the keys were walked as %v, expected %v", found, expected)
+	}
+
+	found = nil
+	err = tree.Range("b", "J", &RangeOptions{Reverse: true}, func(key string, value uint32) bool {
+		found = append(found, key)
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	} else if strings.Join(found, " ") != "fox dog Brown" {
+		t.Errorf("the range from b to J returned %v", found)
+	}
+}
+
+func TestTreeValues(t *testing.T) {
+	tree, err := NewWithOptions[string, string](nil, StringCodec{}, StringCodec{}, &Options{MaxKeySize: 16})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	//Values longer than the inline value size go to overflow pages
+	values := map[string]string{
+		"empty": "",
+		"short": "abc",
+		"long":  strings.Repeat("0123456789", 500),
+	}
+	for key, value := range values {
+		err = tree.Insert(key, value)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for key, value := range values {
+		found, err := tree.Get(key)
+		if err != nil {
+			t.Error(err)
+		} else if found != value {
+			t.Errorf("the key %v has a value of %v bytes, expected %v", key, len(found), len(value))
+		}
+	}
+
+	count := 0
+	err = tree.Walk(nil, func(key string, value string) bool {
+		count++
+		if value != values[key] {
+			t.Errorf("the walk returned a value of %v bytes for the key %v, expected %v", len(value), key, len(values[key]))
+		}
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	} else if count != len(values) {
+		t.Errorf("the walk returned %v keys, expected %v", count, len(values))
+	}
+}
+
+// countingCodec is StringCodec that counts how often it decodes the key
+// "needle".
+type countingCodec struct {
+	StringCodec
+	needles *int
+}
+
+func (c countingCodec) Decode(data []byte) (key string, err error) {
+	if string(data) == "needle" {
+		*c.needles++
+	}
+	return c.StringCodec.Decode(data)
+}
+
+func TestTreeCompareDecodesSearchKeyOnce(t *testing.T) {
+	var needles int
+	tree, err := NewWithOptions[string, []byte](strings.Compare, countingCodec{needles: &needles}, BytesCodec{}, &Options{MaxKeySize: 16})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 500; i++ {
+		err = tree.Insert(fmt.Sprintf("key %03d", i), []byte{byte(i)})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	err = tree.Insert("needle", []byte("found"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	//Once as the key searched for and once as the key it is found as
+	needles = 0
+	value, err := tree.Get("needle")
+	if err != nil {
+		t.Error(err)
+	} else if string(value) != "found" {
+		t.Errorf("the needle has a value of %q", value)
+	}
+	if needles > 2 {
+		t.Errorf("the key searched for was decoded %v times", needles)
+	}
+}
@@ -0,0 +1,162 @@
+package btree
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	forEachBackend(t, "test-update.bin", func(t *testing.T, tree BTree) {
+		keys := randomKeys(1000)
+		insertKeys(t, tree, keys)
+
+		for _, key := range keys[:500] {
+			err := tree.Update(key, int64(key)*2+1)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		for i, key := range keys {
+			expected := int64(key) * 2
+			if i < 500 {
+				expected++
+			}
+			index, err := tree.QueryIndex(key)
+			if err != nil {
+				t.Error(err)
+			} else if index.Pointer != expected {
+				t.Errorf("the key %v has a pointer of %v, expected %v", key, index.Pointer, expected)
+			}
+		}
+
+		err := tree.Update(maxInt64, 1)
+		if err == nil {
+			t.Error("a key that is not in the tree was updated")
+		}
+		if kc, ok := tree.(keyCounter); ok && kc.KeyCount() != uint64(len(keys)) {
+			t.Errorf("the tree has a key count of %v, expected %v", kc.KeyCount(), len(keys))
+		}
+		_, err = checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestUpsert(t *testing.T) {
+	forEachBackend(t, "test-upsert.bin", func(t *testing.T, tree BTree) {
+		keys := randomKeys(2000)
+		insertKeys(t, tree, keys[:1000])
+
+		//Half of the keys are in the tree already, half are new
+		for _, key := range keys[500:] {
+			err := tree.Upsert(NewIndex(key, int64(key)*3))
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		for i, key := range keys {
+			expected := int64(key) * 3
+			if i < 500 {
+				expected = int64(key) * 2
+			}
+			index, err := tree.QueryIndex(key)
+			if err != nil {
+				t.Error(err)
+			} else if index.Pointer != expected {
+				t.Errorf("the key %v has a pointer of %v, expected %v", key, index.Pointer, expected)
+			}
+		}
+
+		height, err := checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		} else if dt, ok := tree.(*BTreeOnDisk); ok && height != dt.Height() {
+			t.Errorf("the tree has a height of %v, the header records %v", height, dt.Height())
+		}
+		if kc, ok := tree.(keyCounter); ok && kc.KeyCount() != uint64(len(keys)) {
+			t.Errorf("the tree has a key count of %v, expected %v", kc.KeyCount(), len(keys))
+		}
+	})
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	forEachBackend(t, "test-compare-and-swap.bin", func(t *testing.T, tree BTree) {
+		keys := randomKeys(500)
+		insertKeys(t, tree, keys)
+
+		for _, key := range keys {
+			swapped, err := tree.CompareAndSwap(key, int64(key), 0)
+			if err != nil {
+				t.Error(err)
+			} else if swapped {
+				t.Errorf("the pointer of the key %v was swapped although it did not match", key)
+			}
+
+			swapped, err = tree.CompareAndSwap(key, int64(key)*2, int64(key)+1)
+			if err != nil {
+				t.Error(err)
+			} else if !swapped {
+				t.Errorf("the pointer of the key %v was not swapped", key)
+			}
+		}
+		for _, key := range keys {
+			index, err := tree.QueryIndex(key)
+			if err != nil {
+				t.Error(err)
+			} else if index.Pointer != int64(key)+1 {
+				t.Errorf("the key %v has a pointer of %v, expected %v", key, index.Pointer, int64(key)+1)
+			}
+		}
+
+		_, err := tree.CompareAndSwap(maxInt64, 0, 1)
+		if err == nil {
+			t.Error("the pointer of a key that is not in the tree was swapped")
+		}
+	})
+}
+
+func TestUpdateWritesOneNode(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-update-one-node.bin")
+
+	tree, err := CreateBTreeOnDisk(f, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	keys := randomKeys(2000)
+	insertKeys(t, tree, keys)
+	if tree.Height() < 2 {
+		t.Errorf("the tree has a height of %v, expected a deeper tree", tree.Height())
+	}
+
+	//The pages of a transaction are kept pending until it is committed
+	tx, err := tree.Begin(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.Update(keys[0], 1)
+	if err != nil {
+		t.Error(err)
+	} else if pages := tree.cache.pendingPages(); len(pages) != 1 {
+		t.Errorf("the update wrote %v pages, expected 1", len(pages))
+	}
+	err = tx.Upsert(NewIndex(keys[1], 1))
+	if err != nil {
+		t.Error(err)
+	} else if pages := tree.cache.pendingPages(); len(pages) > 2 {
+		t.Errorf("the upsert of a key in the tree wrote %v pages in all, expected at most 2", len(pages))
+	}
+	swapped, err := tx.CompareAndSwap(keys[2], int64(keys[2]), 1)
+	if err != nil {
+		t.Error(err)
+	} else if pages := tree.cache.pendingPages(); swapped || len(pages) > 2 {
+		t.Errorf("the failed swap wrote %v pages in all, expected at most 2", len(pages))
+	}
+}
@@ -0,0 +1,433 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+// randomValue returns a value of up to max bytes that can be told apart
+// from the values of other keys.
+func randomValue(key uint64, max int) []byte {
+	value := []byte(fmt.Sprintf("%x:", key))
+	for len(value) < max && rand.Intn(4) != 0 {
+		value = append(value, byte(rand.Intn(256)))
+	}
+	if len(value) > max {
+		value = value[:max]
+	}
+	return value
+}
+
+func TestPutGet(t *testing.T) {
+	forEachBackendWithOptions(t, "test-put-get.bin", &Options{InlineValueSize: 24}, func(t *testing.T, tree BTree) {
+		keys := randomKeys(1000)
+		values := make(map[uint64][]byte)
+		for _, key := range keys {
+			values[key] = randomValue(key, 24)
+			err := tree.Put(Uint64Key(key), values[key])
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		err := tree.Put(Uint64Key(keys[0]), nil)
+		if err == nil {
+			t.Error("a key was put into the tree twice")
+		}
+
+		//Removing keys moves the entries around, the values go with them
+		for _, key := range keys[:300] {
+			err = tree.RemoveIndex(key)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		_, err = checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+
+		for i, key := range keys {
+			value, err := tree.Get(Uint64Key(key))
+			if i < 300 {
+				if err == nil {
+					t.Errorf("the removed key %v was found", key)
+				}
+			} else if err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(value, values[key]) {
+				t.Errorf("the key %v has a value of %x, expected %x", key, value, values[key])
+			}
+		}
+
+		//Entries inserted without a value have none
+		err = tree.InsertIndex(NewIndex(1<<41, 5))
+		if err != nil {
+			t.Error(err)
+		}
+		value, err := tree.Get(Uint64Key(1 << 41))
+		if err != nil {
+			t.Error(err)
+		} else if len(value) != 0 {
+			t.Errorf("an index without a value has a value of %x", value)
+		}
+	})
+}
+
+func TestPutWithoutInlineValues(t *testing.T) {
+	forEachBackend(t, "test-put-no-values.bin", func(t *testing.T, tree BTree) {
+		if tree.InlineValueSize() != 0 {
+			t.Errorf("the tree has an inline value size of %v, expected 0", tree.InlineValueSize())
+		}
+		err := tree.Put([]byte("key"), nil)
+		if err != nil {
+			t.Error(err)
+		}
+		err = tree.Put([]byte("value"), []byte("v"))
+		if err == nil {
+			t.Error("a value was put into a tree without room for values")
+		}
+	})
+
+	_, err := NewBTreeInMemWithOptions(0, &Options{InlineValueSize: -1})
+	if err == nil {
+		t.Error("a tree was created with a negative inline value size")
+	}
+	_, err = NewBTreeInMemWithOptions(0, &Options{InlineValueSize: DefaultPageSize})
+	if err == nil {
+		t.Error("a tree was created with values that do not fit in a page")
+	}
+}
+
+func TestPutGetReopen(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-put-get-reopen.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{MaxKeySize: 16, InlineValueSize: 40})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	keys := randomStrings(500, 16)
+	for _, key := range keys {
+		err = tree.Put(key, bytes.Repeat(key, 40/len(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+	if tree.InlineValueSize() != 40 {
+		t.Errorf("the reopened tree has an inline value size of %v, expected 40", tree.InlineValueSize())
+	}
+
+	tx, err := tree.Begin(false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tx.Rollback()
+	for _, key := range keys {
+		value, err := tx.Get(key)
+		if err != nil {
+			t.Errorf("the key %q: %v", key, err)
+		} else if expected := bytes.Repeat(key, 40/len(key)); !bytes.Equal(value, expected) {
+			t.Errorf("the key %q has a value of %q, expected %q", key, value, expected)
+		}
+	}
+}
+
+// longValue returns a value of size bytes that can be told apart from
+// the values of other keys.
+func longValue(key uint64, size int) []byte {
+	value := make([]byte, size)
+	for i := range value {
+		value[i] = byte(key + uint64(i))
+	}
+	return value
+}
+
+// overflowPageCount returns the number of overflow pages a value of size
+// bytes takes in a tree of the given page size.
+func overflowPageCount(size int, pageSize int) int {
+	chunk := pageSize - overflowPageHeaderSize
+	return (size + chunk - 1) / chunk
+}
+
+func TestPutOverflow(t *testing.T) {
+	forEachBackendWithOptions(t, "test-put-overflow.bin", &Options{InlineValueSize: 16}, func(t *testing.T, tree BTree) {
+		keys := randomKeys(300)
+		sizes := make(map[uint64]int)
+		for i, key := range keys {
+			//Some values fit in the node, some fill their last page exactly
+			sizes[key] = rand.Intn(3 * tree.PageSize())
+			if i%10 == 0 {
+				sizes[key] = 2 * (tree.PageSize() - overflowPageHeaderSize)
+			}
+			err := tree.Put(Uint64Key(key), longValue(key, sizes[key]))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		_, err := checkBalanced(tree)
+		if err != nil {
+			t.Error(err)
+		}
+
+		for _, key := range keys {
+			value, err := tree.Get(Uint64Key(key))
+			if err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(value, longValue(key, sizes[key])) {
+				t.Errorf("the key %v has a value of %v bytes, expected %v", key, len(value), sizes[key])
+			}
+		}
+		entries, err := tree.RangeEntries(nil, nil, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		for _, e := range entries {
+			key := keyOf(e)
+			if !bytes.Equal(e.Value, longValue(key, sizes[key])) {
+				t.Errorf("the range returned a value of %v bytes for the key %v, expected %v", len(e.Value), key, sizes[key])
+			}
+		}
+		c := NewCursor(tree)
+		for c.First(); c.Valid(); c.Next() {
+			key := keyOf(*c.Entry())
+			if !bytes.Equal(c.Entry().Value, longValue(key, sizes[key])) {
+				t.Errorf("the cursor returned a value of %v bytes for the key %v, expected %v", len(c.Entry().Value), key, sizes[key])
+			}
+		}
+		if c.Err() != nil {
+			t.Error(c.Err())
+		}
+
+		//Removing a key hands the pages of its value back
+		for _, key := range keys[:100] {
+			before := len(availableAddresses(tree))
+			err = tree.RemoveIndex(key)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			pages := 0
+			if sizes[key] > tree.InlineValueSize() {
+				pages = overflowPageCount(sizes[key], tree.PageSize())
+			}
+			if freed := len(availableAddresses(tree)) - before; freed < pages {
+				t.Errorf("removing the key %v freed %v pages, its value took %v", key, freed, pages)
+			}
+		}
+		for _, key := range keys[100:] {
+			value, err := tree.Get(Uint64Key(key))
+			if err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(value, longValue(key, sizes[key])) {
+				t.Errorf("the key %v has a value of %v bytes after removing others, expected %v", key, len(value), sizes[key])
+			}
+		}
+	})
+}
+
+func TestOverflowReadOnlyForValues(t *testing.T) {
+	forEachBackendWithOptions(t, "test-overflow-lazy.bin", &Options{InlineValueSize: 16}, func(t *testing.T, tree BTree) {
+		err := tree.Put(Uint64Key(1), longValue(1, 3*tree.PageSize()))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		//Break the chain of the value, only the lookups of values read it
+		root, err := tree.Root()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		err = tree.RemoveNode(root.Data[0].overflow.addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, err = tree.Get(Uint64Key(1))
+		if err == nil {
+			t.Error("the value was read from a removed overflow page")
+		}
+
+		index, err := tree.QueryIndex(1)
+		if err != nil {
+			t.Errorf("querying the index read the value: %v", err)
+		} else if index.Key != 1 {
+			t.Errorf("querying the key 1 returned %v", index)
+		}
+		indexes, err := tree.Range(0, 10, nil)
+		if err != nil {
+			t.Errorf("the range of indexes read the value: %v", err)
+		} else if len(indexes) != 1 {
+			t.Errorf("the range returned %v indexes, expected 1", len(indexes))
+		}
+		_, err = tree.Select(0)
+		if err != nil {
+			t.Errorf("selecting the index read the value: %v", err)
+		}
+		c := NewCursor(tree)
+		if !c.First() || c.Index() == nil || c.Key() != 1 {
+			t.Errorf("the cursor returned %v", c.Index())
+		} else if c.Err() != nil {
+			t.Errorf("the cursor read the value: %v", c.Err())
+		}
+	})
+}
+
+func TestPutOverflowDuplicate(t *testing.T) {
+	forEachBackendWithOptions(t, "test-put-overflow-dup.bin", &Options{InlineValueSize: 16}, func(t *testing.T, tree BTree) {
+		err := tree.Put([]byte("key"), []byte("short"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		//The pages written for a value that is not inserted are freed
+		size := 5 * tree.PageSize()
+		err = tree.Put([]byte("key"), make([]byte, size))
+		if err == nil {
+			t.Error("a key was put into the tree twice")
+		}
+		pages := overflowPageCount(size, tree.PageSize())
+		if free := len(availableAddresses(tree)); free != pages {
+			t.Errorf("the tree has %v free pages after a failed put, expected %v", free, pages)
+		}
+
+		value, err := tree.Get([]byte("key"))
+		if err != nil {
+			t.Error(err)
+		} else if string(value) != "short" {
+			t.Errorf("the key has a value of %q after a failed put, expected \"short\"", value)
+		}
+	})
+}
+
+func TestPutOverflowCopyOnWrite(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-put-overflow-cow.bin")
+
+	tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CopyOnWrite: true, NoSync: true, InlineValueSize: 16})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	keys := randomKeys(200)
+	for _, key := range keys {
+		err = tree.Put(Uint64Key(key), longValue(key, int(key%uint64(3*tree.PageSize()))))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	s, err := tree.Snapshot()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, key := range keys[:100] {
+		err = tree.RemoveIndex(key)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	checkFreePages(t, tree)
+
+	//The snapshot still reads the values of the removed keys
+	for _, key := range keys[:100] {
+		value, err := s.Get(Uint64Key(key))
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(value, longValue(key, int(key%uint64(3*tree.PageSize())))) {
+			t.Errorf("the snapshot returned a value of %v bytes for the removed key %v", len(value), key)
+		}
+	}
+	s.Release()
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+	checkFreePages(t, tree)
+	for i, key := range keys {
+		value, err := tree.Get(Uint64Key(key))
+		if i < 100 {
+			if err == nil {
+				t.Errorf("the removed key %v was found", key)
+			}
+		} else if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(value, longValue(key, int(key%uint64(3*tree.PageSize())))) {
+			t.Errorf("the reopened tree returned a value of %v bytes for the key %v", len(value), key)
+		}
+	}
+}
+
+func TestPutOverflowSnapshot(t *testing.T) {
+	tree, err := NewBTreeInMemWithOptions(0, &Options{InlineValueSize: 16})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	old := longValue(1, 3*tree.PageSize())
+	err = tree.Put([]byte("key"), old)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s, err := tree.Snapshot()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.Release()
+
+	//The new value is written to the pages the old one was in
+	err = tree.RemoveEntry([]byte("key"))
+	if err != nil {
+		t.Error(err)
+	}
+	err = tree.Put([]byte("key"), longValue(2, 3*tree.PageSize()))
+	if err != nil {
+		t.Error(err)
+	}
+
+	value, err := s.Get([]byte("key"))
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(value, old) {
+		t.Error("the snapshot returned the value put after it was taken")
+	}
+	value, err = tree.Get([]byte("key"))
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(value, longValue(2, 3*tree.PageSize())) {
+		t.Error("the tree returned the value removed from it")
+	}
+}
@@ -0,0 +1,138 @@
+package btree
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// pageVersions keeps the old bytes of the pages of a tree that changes
+// its pages in place, so that snapshots of it can go on reading the pages
+// as they were when they were taken. Every snapshot is pinned to a
+// version of the pages. The first time a page is written after a
+// snapshot was taken its bytes are saved, and they are dropped again once
+// no pinned snapshot reads them any more.
+//
+// A tree in copy-on-write mode does not need this as it never writes to a
+// page that a snapshot reads.
+type pageVersions struct {
+	mu        sync.Mutex
+	pins      int64                 //The number of pinned snapshots, read by preserve without holding mu
+	version   uint64                //The version of the pages that are written now
+	snapshots map[uint64]int        //The number of snapshots pinned to each version
+	saved     map[int64][]savedPage //The saved bytes of each page, oldest first
+}
+
+// savedPage holds the bytes a page had in the versions before until,
+// back to the until of the savedPage before it.
+type savedPage struct {
+	until uint64
+	data  []byte
+}
+
+func newPageVersions() *pageVersions {
+	return &pageVersions{
+		snapshots: make(map[uint64]int),
+		saved:     make(map[int64][]savedPage),
+	}
+}
+
+// pin pins a new snapshot to the current version of the pages. Pages
+// written from now on are saved before they change.
+func (v *pageVersions) pin() (version uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	version = v.version
+	v.version++
+	v.snapshots[version]++
+	atomic.AddInt64(&v.pins, 1)
+	return version
+}
+
+// unpin releases a snapshot pinned to version and drops the saved pages
+// that no snapshot reads any more.
+func (v *pageVersions) unpin(version uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.snapshots[version]--
+	if v.snapshots[version] == 0 {
+		delete(v.snapshots, version)
+	}
+	atomic.AddInt64(&v.pins, -1)
+
+	for addr, saved := range v.saved {
+		var from uint64
+		kept := saved[:0]
+		for _, p := range saved {
+			if v.pinned(from, p.until) {
+				kept = append(kept, p)
+			}
+			from = p.until
+		}
+		if len(kept) == 0 {
+			delete(v.saved, addr)
+		} else {
+			v.saved[addr] = kept
+		}
+	}
+}
+
+// pinned returns true if a snapshot is pinned to a version from from up
+// to but not including to.
+func (v *pageVersions) pinned(from uint64, to uint64) bool {
+	for version := range v.snapshots {
+		if version >= from && version < to {
+			return true
+		}
+	}
+	return false
+}
+
+// preserve is called before the page at addr is written. If a snapshot
+// still reads the bytes the page has now, read is called to get them and
+// they are saved. Snapshots are only pinned while nothing is written, so
+// the writes running in parallel do not take mu while none are.
+func (v *pageVersions) preserve(addr int64, read func() ([]byte, error)) error {
+	if atomic.LoadInt64(&v.pins) == 0 {
+		return nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	//The page only has to be saved once for the snapshots pinned since
+	//it was last saved
+	var from uint64
+	if saved := v.saved[addr]; len(saved) > 0 {
+		from = saved[len(saved)-1].until
+	}
+	if !v.pinned(from, v.version) {
+		return nil
+	}
+
+	data, err := read()
+	if err != nil {
+		return err
+	}
+	v.saved[addr] = append(v.saved[addr], savedPage{
+		until: v.version,
+		data:  append([]byte(nil), data...),
+	})
+	return nil
+}
+
+// read returns the bytes the page at addr had in the given version. It
+// returns false if the page has not been written since, in which case
+// its current bytes are the ones of that version.
+func (v *pageVersions) read(addr int64, version uint64) (data []byte, ok bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, p := range v.saved[addr] {
+		if p.until > version {
+			return p.data, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,200 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// walSuffix is added to the name of a tree file to get the name of its
+// write-ahead log.
+const walSuffix = ".wal"
+
+// walRecordMagic starts every record in a write-ahead log.
+const walRecordMagic = 0x44524f43_4c415747 //"GWALCORD"
+
+// walCheckpointSize is the size the write-ahead log can grow to before
+// the pages it holds are written to the tree file and the log is emptied.
+const walCheckpointSize = 4 << 20
+
+// writeAheadLog holds the pages changed by every operation on a tree
+// until they are safely written to the tree file. Each operation is a
+// single record of page images followed by a checksum, a record that was
+// only partly written when the process stopped fails its checksum and is
+// ignored when the log is replayed.
+type writeAheadLog struct {
+	file *os.File
+	size int64
+	sync bool
+}
+
+type walRecordHeader struct {
+	Magic     uint64
+	PageCount uint32
+}
+
+type walPageHeader struct {
+	Address int64
+	Length  uint32
+}
+
+// walPage is the image of a single page in a record.
+type walPage struct {
+	Address int64
+	Data    []byte
+}
+
+// createWriteAheadLog creates an empty write-ahead log in file, replacing
+// any log that is already there. The log is synced after every record
+// unless sync is false.
+func createWriteAheadLog(file string, sync bool) (w *writeAheadLog, err error) {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{file: f, sync: sync}, nil
+}
+
+// append writes the pages as a single record to the end of the log.
+func (w *writeAheadLog) append(pages []walPage) error {
+	buf := new(bytes.Buffer)
+
+	err := binary.Write(buf, binary.LittleEndian, walRecordHeader{
+		Magic:     walRecordMagic,
+		PageCount: uint32(len(pages)),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pages {
+		err = binary.Write(buf, binary.LittleEndian, walPageHeader{
+			Address: p.Address,
+			Length:  uint32(len(p.Data)),
+		})
+		if err != nil {
+			return err
+		}
+		buf.Write(p.Data)
+	}
+
+	err = binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.file.WriteAt(buf.Bytes(), w.size)
+	if err != nil {
+		return err
+	}
+	w.size += int64(buf.Len())
+
+	if w.sync {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// reset empties the log once every record in it has been written to the
+// tree file.
+func (w *writeAheadLog) reset() error {
+	err := w.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	w.size = 0
+	return w.file.Sync()
+}
+
+func (w *writeAheadLog) close() error {
+	return w.file.Close()
+}
+
+// readWriteAheadLog returns the records in the log stored in data in the
+// order they were written. Reading stops at the first record that is
+// incomplete or fails its checksum, as that is where the process that
+// wrote the log stopped.
+func readWriteAheadLog(data []byte) (records [][]walPage) {
+	for len(data) > 0 {
+		record, size := readWalRecord(data)
+		if record == nil {
+			break
+		}
+		records = append(records, record)
+		data = data[size:]
+	}
+	return records
+}
+
+// readWalRecord decodes the record at the start of data and returns it
+// together with its size in bytes. It returns nil if the record is not
+// complete and valid.
+func readWalRecord(data []byte) (record []walPage, size int) {
+	r := bytes.NewReader(data)
+
+	var h walRecordHeader
+	err := binary.Read(r, binary.LittleEndian, &h)
+	if err != nil || h.Magic != walRecordMagic {
+		return nil, 0
+	}
+
+	record = make([]walPage, 0, h.PageCount)
+	for i := uint32(0); i < h.PageCount; i++ {
+		var ph walPageHeader
+		err = binary.Read(r, binary.LittleEndian, &ph)
+		if err != nil || int64(ph.Length) > int64(r.Len()) {
+			return nil, 0
+		}
+
+		offset := len(data) - r.Len()
+		record = append(record, walPage{
+			Address: ph.Address,
+			Data:    data[offset : offset+int(ph.Length)],
+		})
+		r.Seek(int64(ph.Length), io.SeekCurrent)
+	}
+
+	size = len(data) - r.Len()
+	var checksum uint32
+	err = binary.Read(r, binary.LittleEndian, &checksum)
+	if err != nil || checksum != crc32.ChecksumIEEE(data[:size]) {
+		return nil, 0
+	}
+	return record, size + 4
+}
+
+// recoverWriteAheadLog replays the write-ahead log of the tree in file.
+// The pages of every complete record are written to the tree file in
+// order, the file is synced and the log is emptied. A missing or empty
+// log means the tree file is already up to date.
+func recoverWriteAheadLog(file string) error {
+	data, err := os.ReadFile(file + walSuffix)
+	if os.IsNotExist(err) || (err == nil && len(data) == 0) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, record := range readWriteAheadLog(data) {
+		for _, p := range record {
+			_, err = f.WriteAt(p.Data, p.Address)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	return os.Truncate(file+walSuffix, 0)
+}
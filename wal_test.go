@@ -0,0 +1,283 @@
+package btree
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestWriteAheadLogRecords(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-wal-records.bin"+walSuffix)
+
+	wal, err := createWriteAheadLog(f, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer wal.close()
+
+	for i := 1; i <= 3; i++ {
+		var pages []walPage
+		for j := 0; j < i; j++ {
+			pages = append(pages, walPage{
+				Address: int64(j * 752),
+				Data:    bytes.Repeat([]byte{byte(i)}, 752),
+			})
+		}
+		err = wal.append(pages)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	data, err := os.ReadFile(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	records := readWriteAheadLog(data)
+	if len(records) != 3 {
+		t.Errorf("read %v records from the log, expected 3", len(records))
+		return
+	}
+	for i, record := range records {
+		if len(record) != i+1 {
+			t.Errorf("record %v holds %v pages, expected %v", i, len(record), i+1)
+		} else if record[i].Address != int64(i*752) || record[i].Data[0] != byte(i+1) {
+			t.Errorf("record %v holds the wrong page %v", i, record[i].Address)
+		}
+	}
+
+	//A record that was only partly written is ignored
+	records = readWriteAheadLog(data[:len(data)-1])
+	if len(records) != 2 {
+		t.Errorf("read %v records from a log with a torn last record, expected 2", len(records))
+	}
+
+	//Reading stops at a record that fails its checksum
+	data[len(data)/2] ^= 0xff
+	records = readWriteAheadLog(data)
+	if len(records) != 1 {
+		t.Errorf("read %v records from a log with a corrupt record, expected 1", len(records))
+	}
+
+	err = wal.reset()
+	if err != nil {
+		t.Error(err)
+	}
+	data, err = os.ReadFile(f)
+	if err != nil {
+		t.Error(err)
+	} else if len(data) != 0 {
+		t.Errorf("the log still holds %v bytes after it was reset", len(data))
+	}
+}
+
+func TestWriteAheadLogRecover(t *testing.T) {
+	for _, cacheSize := range []int{4, 4096} {
+		t.Run(fmt.Sprint(cacheSize), func(t *testing.T) {
+			f := path.Join(os.TempDir(), "test-wal-recover.bin")
+
+			tree, err := CreateBTreeOnDiskWithOptions(f, true, &Options{CacheSize: cacheSize})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			keys := randomKeys(1000)
+			for _, key := range keys {
+				err = tree.InsertIndex(NewIndex(key, int64(key)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			for _, key := range keys[:300] {
+				err = tree.RemoveIndex(key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+
+			//Stop without flushing, the file only holds what was evicted
+			err = tree.closeFiles()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			tree, err = OpenBTreeOnDisk(f)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer tree.Close()
+
+			checkRecovered(t, tree, keys[300:], keys[:300])
+		})
+	}
+}
+
+func TestWriteAheadLogRecoverTornRecord(t *testing.T) {
+	f := path.Join(os.TempDir(), "test-wal-recover-torn.bin")
+
+	tree, err := CreateBTreeOnDisk(f, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	keys := randomKeys(500)
+	for _, key := range keys {
+		err = tree.InsertIndex(NewIndex(key, int64(key)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err = tree.closeFiles()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	//Cut the record of the last insert short as if the process stopped
+	//while it was being written
+	stat, err := os.Stat(f + walSuffix)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = os.Truncate(f+walSuffix, stat.Size()-10)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tree, err = OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	checkRecovered(t, tree, keys[:499], keys[499:])
+}
+
+func TestWriteAheadLogKilledProcess(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping killing a child process in short mode")
+	}
+
+	f := path.Join(os.TempDir(), "test-wal-killed.bin")
+	_, err := CreateBTreeOnDisk(f, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWriteAheadLogKilledProcessHelper$")
+	cmd.Env = append(os.Environ(), "BTREE_KILLED_FILE="+f)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	//Kill the child part way through its inserts
+	inserted := 0
+	scanner := bufio.NewScanner(out)
+	for inserted < 3000 && scanner.Scan() {
+		inserted, _ = strconv.Atoi(scanner.Text())
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	if inserted < 3000 {
+		t.Errorf("the child process stopped after %v inserts", inserted)
+		return
+	}
+
+	tree, err := OpenBTreeOnDisk(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	keys := make([]uint64, inserted)
+	for i := range keys {
+		keys[i] = killedProcessKey(i)
+	}
+	checkRecovered(t, tree, keys, nil)
+}
+
+// TestWriteAheadLogKilledProcessHelper is run in a child process by
+// TestWriteAheadLogKilledProcess. It inserts keys into the tree until it
+// is killed and reports the number of inserts that have finished.
+func TestWriteAheadLogKilledProcessHelper(t *testing.T) {
+	f := os.Getenv("BTREE_KILLED_FILE")
+	if f == "" {
+		t.Skip("only run by TestWriteAheadLogKilledProcess")
+	}
+
+	tree, err := OpenBTreeOnDiskWithOptions(f, &Options{CacheSize: 16, NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; ; i++ {
+		err = tree.InsertIndex(NewIndex(killedProcessKey(i), int64(killedProcessKey(i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Println(i + 1)
+	}
+}
+
+func killedProcessKey(i int) uint64 {
+	return uint64(i)*7919%1000003 + 1
+}
+
+// checkRecovered checks that a tree opened after a crash is balanced,
+// holds every key in present and none of the keys in missing.
+func checkRecovered(t *testing.T, tree *BTreeOnDisk, present []uint64, missing []uint64) {
+	_, err := checkBalanced(tree)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if tree.KeyCount() < uint64(len(present)) {
+		t.Errorf("the recovered tree has a key count of %v, expected at least %v", tree.KeyCount(), len(present))
+	}
+
+	for _, key := range present {
+		index, err := tree.QueryIndex(key)
+		if err != nil {
+			t.Errorf("the key %v was lost: %v", key, err)
+			return
+		} else if index.Pointer != int64(key) {
+			t.Errorf("the key %v has a pointer of %v, expected %v", key, index.Pointer, key)
+		}
+	}
+	for _, key := range missing {
+		_, err := tree.QueryIndex(key)
+		if err == nil {
+			t.Errorf("the key %v was found after it was removed or never logged", key)
+		}
+	}
+}